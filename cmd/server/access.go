@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"collaborative-markdown-editor/internal/acl"
+	"collaborative-markdown-editor/internal/document"
+)
+
+// visitorID returns the ID of the user a request comes from: the user it
+// authenticated as or, when users are anonymous, the user of its browser.
+// It is empty for requests from neither, which only get what a room's link
+// gives.
+func visitorID(r *http.Request) string {
+	if authenticator != nil {
+		u, err := authenticator.Authenticate(r)
+		if err != nil {
+			return ""
+		}
+		return u.ID
+	}
+	userID, _ := cookieUserID(r)
+	return userID
+}
+
+// mayOpen tells whether a user may open a room, replying that they may not
+// otherwise. With claim, the user becomes the owner of a room nobody owns,
+// which is created with backend if it does not exist yet.
+func mayOpen(w http.ResponseWriter, roomID, userID string, claim bool, backend document.Backend) bool {
+	role, err := h.Role(roomID, userID)
+	if claim {
+		role, err = h.ClaimWithBackend(roomID, userID, backend)
+	}
+	if err != nil {
+		apiError(w, err)
+		return false
+	}
+	return permit(w, role, acl.Viewer)
+}
+
+// permit tells whether a role may do what needs another, replying that it
+// may not otherwise
+func permit(w http.ResponseWriter, role, needed acl.Role) bool {
+	if role < needed {
+		http.Error(w, "Forbidden: needs the "+needed.String()+" role", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// serveACL serves who may do what in a room to its owners:
+//
+//	GET    /api/rooms/{id}/acl         the roles given and the link's role
+//	PUT    /api/rooms/{id}/acl/{user}  give a user a role: {"role"}
+//	DELETE /api/rooms/{id}/acl/{user}  take a user's role away
+//	PUT    /api/rooms/{id}/link        set what anyone with the link may
+//	                                   do: {"role"}
+//
+// Every request replies with the resulting ACL.
+func serveACL(w http.ResponseWriter, r *http.Request, roomID string, parts []string) {
+	var err error
+	switch {
+	case len(parts) == 2 && parts[1] == "acl" && r.Method == http.MethodGet:
+	case len(parts) == 3 && parts[1] == "acl" && parts[2] != "" && r.Method == http.MethodPut:
+		role, ok := readRole(w, r)
+		if !ok {
+			return
+		}
+		err = h.Grant(roomID, parts[2], role)
+	case len(parts) == 3 && parts[1] == "acl" && parts[2] != "" && r.Method == http.MethodDelete:
+		err = h.Revoke(roomID, parts[2])
+	case len(parts) == 2 && parts[1] == "link" && r.Method == http.MethodPut:
+		role, ok := readRole(w, r)
+		if !ok {
+			return
+		}
+		err = h.SetLinkRole(roomID, role)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	a, err := h.ACL(roomID)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+// readRole reads the role of a request: {"role"}
+func readRole(w http.ResponseWriter, r *http.Request) (acl.Role, bool) {
+	var request struct {
+		Role *acl.Role `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Role == nil {
+		http.Error(w, "Role required: none, viewer, commenter, editor or owner", http.StatusBadRequest)
+		return acl.None, false
+	}
+	return *request.Role, true
+}
+
+// setOwner makes a user the owner of a room, for rooms that existed before
+// rooms had owners and so cannot be claimed. spec is room=user.
+func setOwner(spec string) error {
+	roomID, userID, ok := strings.Cut(spec, "=")
+	if !ok || !roomIDPattern.MatchString(roomID) || userID == "" {
+		return fmt.Errorf("%q is not room=user", spec)
+	}
+	if err := h.Grant(roomID, userID, acl.Owner); err != nil {
+		return err
+	}
+	log.Printf("User %s owns room %s", userID, roomID)
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"collaborative-markdown-editor/internal/hub"
+)
+
+// setupServer gives the handlers a hub of their own and keys to sign with,
+// with users anonymous
+func setupServer(t *testing.T) {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	h = hub.NewHub()
+	shareKey = bytes.Repeat([]byte("s"), 32)
+	browserKey = bytes.Repeat([]byte("b"), 32)
+	t.Cleanup(func() {
+		log.SetOutput(output)
+		authenticator = nil
+	})
+}
+
+// request serves a request from the browser holding cookie, or from a new
+// browser if it is nil
+func request(handler http.HandlerFunc, method, target, body string, cookie *http.Cookie) *http.Response {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Result()
+}
+
+// newBrowser opens a room page from a new browser and returns its cookie
+func newBrowser(t *testing.T, roomID string) *http.Cookie {
+	t.Helper()
+	resp := request(serveRoom, http.MethodGet, "/room/"+roomID, "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("opening room %s: %s", roomID, resp.Status)
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == userCookie {
+			return cookie
+		}
+	}
+	t.Fatal("the browser was given no cookie")
+	return nil
+}
+
+func TestOnlyOwnersManageAccess(t *testing.T) {
+	setupServer(t)
+	owner := newBrowser(t, "r1")
+	other := newBrowser(t, "r1")
+
+	routes := []struct{ method, path, body string }{
+		{http.MethodGet, "/api/rooms/r1/acl", ""},
+		{http.MethodPut, "/api/rooms/r1/acl/someone", `{"role":"editor"}`},
+		{http.MethodDelete, "/api/rooms/r1/acl/someone", ""},
+		{http.MethodPut, "/api/rooms/r1/link", `{"role":"viewer"}`},
+		{http.MethodGet, "/api/rooms/r1/links", ""},
+		{http.MethodPost, "/api/rooms/r1/links", `{"role":"viewer"}`},
+	}
+	for _, route := range routes {
+		for name, cookie := range map[string]*http.Cookie{"another user": other, "nobody": nil} {
+			if resp := request(serveRoomAPI, route.method, route.path, route.body, cookie); resp.StatusCode != http.StatusForbidden {
+				t.Errorf("%s %s by %s: got %s, want 403", route.method, route.path, name, resp.Status)
+			}
+		}
+	}
+	for _, route := range routes {
+		if resp := request(serveRoomAPI, route.method, route.path, route.body, owner); resp.StatusCode/100 != 2 {
+			t.Errorf("%s %s by the owner: got %s", route.method, route.path, resp.Status)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"collaborative-markdown-editor/internal/acl"
+	"collaborative-markdown-editor/internal/diff"
+	"collaborative-markdown-editor/internal/storage"
+	"collaborative-markdown-editor/internal/user"
+)
+
+// versionInfo describes a version of a room
+type versionInfo struct {
+	Version  int       `json:"version"`
+	Author   string    `json:"author,omitempty"`
+	ClientID string    `json:"clientId"`
+	Time     time.Time `json:"time"`
+}
+
+// serveRoomAPI serves the JSON API of a room:
+//
+//	GET  /api/rooms/{id}/versions       every version with its author and time
+//	GET  /api/rooms/{id}/versions/{n}   the text at version n
+//	GET  /api/rooms/{id}/checkpoints    the named versions
+//	POST /api/rooms/{id}/checkpoints    name a version: {"name", "version"}
+//	POST /api/rooms/{id}/restore        restore a version: {"version"} or {"checkpoint"}
+//	GET  /api/rooms/{id}/diff?from=&to= what changed between two versions or
+//	                                    checkpoints, to the latest by default
+//	GET  /api/rooms/{id}/blame?version= who last wrote most of each line, at
+//	                                    the latest version by default
+//
+// and the ACL and share links of the room, see serveACL and
+// serveShareLinks. Reading a room takes the viewer
+// role, changing it the editor role and changing its ACL the owner role.
+//
+// Requests that change a room are made by the user they authenticated as.
+// When users are anonymous, they may say who made them with "author".
+func serveRoomAPI(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/rooms/"), "/")
+	roomID := parts[0]
+	if !roomIDPattern.MatchString(roomID) {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+	var author user.User
+	if authenticator != nil {
+		var ok bool
+		if author, ok = authenticate(w, r); !ok {
+			return
+		}
+	}
+	userID := author.ID
+	if authenticator == nil {
+		userID, _ = cookieUserID(r)
+	}
+	role, err := h.Role(roomID, userID)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	if !permit(w, role, acl.Viewer) {
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && parts[1] == "versions" && r.Method == http.MethodGet:
+		serveVersions(w, roomID)
+	case len(parts) == 3 && parts[1] == "versions" && r.Method == http.MethodGet:
+		version, err := strconv.Atoi(parts[2])
+		if err != nil {
+			http.Error(w, "Invalid version", http.StatusBadRequest)
+			return
+		}
+		serveVersion(w, roomID, version)
+	case len(parts) == 2 && parts[1] == "checkpoints" && r.Method == http.MethodGet:
+		checkpoints, err := h.Checkpoints(roomID)
+		if err != nil {
+			apiError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"checkpoints": nonNil(checkpoints)})
+	case len(parts) == 2 && parts[1] == "checkpoints" && r.Method == http.MethodPost:
+		if permit(w, role, acl.Editor) {
+			serveAddCheckpoint(w, r, roomID, author.Username)
+		}
+	case len(parts) == 2 && parts[1] == "restore" && r.Method == http.MethodPost:
+		if permit(w, role, acl.Editor) {
+			serveRestore(w, r, roomID, author)
+		}
+	case len(parts) == 2 && parts[1] == "diff" && r.Method == http.MethodGet:
+		serveDiff(w, r, roomID)
+	case len(parts) == 2 && parts[1] == "blame" && r.Method == http.MethodGet:
+		serveBlame(w, r, roomID)
+	case len(parts) >= 2 && (parts[1] == "acl" || parts[1] == "link"):
+		if permit(w, role, acl.Owner) {
+			serveACL(w, r, roomID, parts)
+		}
+	case len(parts) >= 2 && parts[1] == "links":
+		if permit(w, role, acl.Owner) {
+			serveShareLinks(w, r, roomID, parts, userID)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveVersions lists every version of a room
+func serveVersions(w http.ResponseWriter, roomID string) {
+	records, err := h.History(roomID)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	versions := make([]versionInfo, len(records))
+	for i, record := range records {
+		versions[i] = versionInfo{
+			Version:  record.Op.Version,
+			Author:   record.Author,
+			ClientID: record.Op.ClientID,
+			Time:     record.Time,
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"versions": versions})
+}
+
+// serveVersion returns the text of a room at a version
+func serveVersion(w http.ResponseWriter, roomID string, version int) {
+	text, err := h.TextAt(roomID, version)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"version": version, "text": text})
+}
+
+// serveAddCheckpoint names a version of a room, the latest one unless the
+// request gives one. The checkpoint is by author, if known.
+func serveAddCheckpoint(w http.ResponseWriter, r *http.Request, roomID, author string) {
+	var request struct {
+		Name    string `json:"name"`
+		Version *int   `json:"version"`
+		Author  string `json:"author"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Name) == "" {
+		http.Error(w, "Checkpoint name required", http.StatusBadRequest)
+		return
+	}
+	version := -1
+	if request.Version != nil {
+		version = *request.Version
+	}
+	if author == "" {
+		author = request.Author
+	}
+	checkpoint, err := h.AddCheckpoint(roomID, request.Name, version, author)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, checkpoint)
+}
+
+// serveRestore brings a room back to a version or checkpoint, as author if
+// known
+func serveRestore(w http.ResponseWriter, r *http.Request, roomID string, author user.User) {
+	var request struct {
+		Version    *int   `json:"version"`
+		Checkpoint string `json:"checkpoint"`
+		Author     string `json:"author"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || (request.Version == nil) == (request.Checkpoint == "") {
+		http.Error(w, "Either a version or a checkpoint required", http.StatusBadRequest)
+		return
+	}
+
+	version := 0
+	if request.Version != nil {
+		version = *request.Version
+	} else {
+		checkpoint, err := findCheckpoint(roomID, request.Checkpoint)
+		if err != nil {
+			apiError(w, err)
+			return
+		}
+		version = checkpoint.Version
+	}
+
+	if author.ID == "" {
+		author.Username = request.Author
+	}
+	restored, err := h.Restore(roomID, version, author)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	log.Printf("Room %s restored to version %d as version %d", roomID, version, restored)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"restored": version, "version": restored})
+}
+
+// diffStyle frames the HTML diff of serveDiff
+const diffStyle = `<style>
+.diff { font-family: monospace; }
+.hunk { margin-bottom: 1em; border: 1px solid #ddd; }
+.hunk-header { background: #f1f8ff; color: #555; padding: 2px 8px; }
+.hunk pre { margin: 0; padding: 4px 8px; white-space: pre-wrap; }
+ins { background: #e6ffed; text-decoration: none; }
+del { background: #ffeef0; }
+</style>
+`
+
+// serveDiff compares two versions of a room. The format parameter selects a
+// unified diff (the default), a word diff as JSON or HTML; context sets the
+// number of unchanged lines around each hunk.
+func serveDiff(w http.ResponseWriter, r *http.Request, roomID string) {
+	query := r.URL.Query()
+	if query.Get("from") == "" {
+		http.Error(w, "from required", http.StatusBadRequest)
+		return
+	}
+	from, err := parseVersion(roomID, query.Get("from"))
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	to := -1
+	if query.Get("to") != "" {
+		if to, err = parseVersion(roomID, query.Get("to")); err != nil {
+			apiError(w, err)
+			return
+		}
+	}
+	context := 3
+	if c := query.Get("context"); c != "" {
+		if context, err = strconv.Atoi(c); err != nil || context < 0 {
+			http.Error(w, "Invalid context", http.StatusBadRequest)
+			return
+		}
+	}
+
+	changes, err := h.Changes(roomID, from, to)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	authors := diff.Authors{Inserted: changes.Inserted, Deleted: changes.Deleted}
+	switch query.Get("format") {
+	case "", "unified":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		names := []string{query.Get("from"), query.Get("to")}
+		if names[1] == "" {
+			names[1] = "latest"
+		}
+		fmt.Fprint(w, diff.Unified(diff.Lines(changes.From, changes.To, context, authors), names[0], names[1]))
+	case "words":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"spans": nonNil(diff.Words(changes.From, changes.To, authors))})
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, diffStyle+diff.HTML(diff.Lines(changes.From, changes.To, context, authors), authors))
+	default:
+		http.Error(w, "Unknown format", http.StatusBadRequest)
+	}
+}
+
+// blameLine tells who wrote a line
+type blameLine struct {
+	Line    int    `json:"line"` // Counted from 1
+	Text    string `json:"text"`
+	UserID  string `json:"userId,omitempty"`
+	Author  string `json:"author,omitempty"`
+	Version int    `json:"version"`
+}
+
+// serveBlame tells, for each line of a room at a version, who wrote most of
+// it and in which version. Lines written before authorship was tracked
+// have no author. With spans=1, the runs of text each author wrote are
+// returned as well.
+func serveBlame(w http.ResponseWriter, r *http.Request, roomID string) {
+	query := r.URL.Query()
+	version := -1
+	if v := query.Get("version"); v != "" {
+		var err error
+		if version, err = parseVersion(roomID, v); err != nil {
+			apiError(w, err)
+			return
+		}
+	}
+	text, authorship, err := h.Authorship(roomID, version)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	records, err := h.History(roomID)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+
+	lines := make([]blameLine, 0)
+	runes := []rune(text)
+	offset := 0
+	for i, span := range authorship.Lines(text) {
+		line := blameLine{
+			Line:    i + 1,
+			Text:    strings.TrimSuffix(string(runes[offset:offset+span.Length]), "\n"),
+			UserID:  span.UserID,
+			Version: span.Version,
+		}
+		if span.Version > 0 && span.Version <= len(records) {
+			line.Author = records[span.Version-1].Author
+		}
+		lines = append(lines, line)
+		offset += span.Length
+	}
+
+	response := map[string]interface{}{"lines": lines}
+	if query.Get("spans") == "1" {
+		response["spans"] = nonNil(authorship.Spans())
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// parseVersion reads a version number or the name of a checkpoint
+func parseVersion(roomID, s string) (int, error) {
+	if version, err := strconv.Atoi(s); err == nil {
+		return version, nil
+	}
+	checkpoint, err := findCheckpoint(roomID, s)
+	return checkpoint.Version, err
+}
+
+// errNoCheckpoint is returned for checkpoint names a room does not have
+var errNoCheckpoint = errors.New("checkpoint not found")
+
+// findCheckpoint returns the checkpoint of a room with the given name
+func findCheckpoint(roomID, name string) (storage.Checkpoint, error) {
+	checkpoints, err := h.Checkpoints(roomID)
+	if err != nil {
+		return storage.Checkpoint{}, err
+	}
+	for _, checkpoint := range checkpoints {
+		if checkpoint.Name == name {
+			return checkpoint, nil
+		}
+	}
+	return storage.Checkpoint{}, errNoCheckpoint
+}
+
+// apiError replies with the status that fits an error from the hub
+func apiError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound), errors.Is(err, storage.ErrNoVersion), errors.Is(err, errNoCheckpoint), errors.Is(err, acl.ErrNoShareLink):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, storage.ErrCheckpointExists), errors.Is(err, acl.ErrLastOwner):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, acl.ErrLinkRole):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("API request failed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// writeJSON replies with a value as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// nonNil returns an empty slice for nil, so that it encodes as [] and not
+// null
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
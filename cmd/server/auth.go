@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"collaborative-markdown-editor/internal/auth"
+	"collaborative-markdown-editor/internal/user"
+)
+
+var (
+	// authenticator tells who makes requests, nil when users are anonymous
+	authenticator auth.Authenticator
+
+	// tokens signs users in with passwords when they are checked locally
+	tokens *auth.TokenAuthenticator
+)
+
+// authConfig is how the server tells who its users are
+type authConfig struct {
+	mode           string // none, local or header
+	userHeader     string
+	nameHeader     string
+	trustedProxies string // Comma separated CIDRs
+}
+
+// setupAuth selects the authenticator for the configured mode. Local users
+// and the signing key of their tokens are kept in dataDir.
+func setupAuth(config authConfig, dataDir string) error {
+	switch config.mode {
+	case "none":
+		return nil
+	case "local":
+		users, err := auth.OpenUsers(filepath.Join(dataDir, "users.json"))
+		if err != nil {
+			return err
+		}
+		key, err := auth.LoadKey(filepath.Join(dataDir, "auth.key"))
+		if err != nil {
+			return err
+		}
+		tokens = auth.NewTokenAuthenticator(users, key, auth.DefaultTokenTTL)
+		authenticator = tokens
+		http.HandleFunc("/login", serveLoginPage)
+		http.HandleFunc("/auth/login", serveLogin)
+		http.HandleFunc("/auth/logout", serveLogout)
+		return nil
+	case "header":
+		a := &auth.HeaderAuthenticator{UserHeader: config.userHeader, NameHeader: config.nameHeader}
+		for _, cidr := range strings.Split(config.trustedProxies, ",") {
+			if cidr = strings.TrimSpace(cidr); cidr == "" {
+				continue
+			}
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("trusted proxy %q: %w", cidr, err)
+			}
+			a.TrustedProxies = append(a.TrustedProxies, network)
+		}
+		if len(a.TrustedProxies) == 0 {
+			log.Printf("Trusting %s only from loopback addresses; use -auth-trusted-proxies for a proxy elsewhere", config.userHeader)
+		}
+		authenticator = a
+		return nil
+	}
+	return fmt.Errorf("unknown auth mode %q", config.mode)
+}
+
+// addUser adds a local user with the password read from stdin
+func addUser(dataDir, username string) error {
+	users, err := auth.OpenUsers(filepath.Join(dataDir, "users.json"))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Password for %s: ", username)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return err
+	}
+	u, err := users.Add(username, strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Added user %s with ID %s\n", u.Username, u.ID)
+	return nil
+}
+
+// authenticate returns who made a request, or replies that it needs to be
+// authenticated. The user's identity replaces what the hub knew of them.
+func authenticate(w http.ResponseWriter, r *http.Request) (user.User, bool) {
+	u, err := authenticator.Authenticate(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return user.User{}, false
+	}
+	h.GetUserManager().SetUser(u)
+	return u, true
+}
+
+// signedIn tells whether a page may be served, sending browsers that are
+// not signed in to the login page
+func signedIn(w http.ResponseWriter, r *http.Request) bool {
+	if authenticator == nil {
+		return true
+	}
+	if _, err := authenticator.Authenticate(r); err == nil {
+		return true
+	}
+	if tokens != nil {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return false
+	}
+	http.Error(w, "Authentication required", http.StatusUnauthorized)
+	return false
+}
+
+// localPath returns next if it is a path on this server, and / otherwise,
+// so that logging in cannot send browsers elsewhere
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// loginPage asks for a username and password
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Sign in - CollabWrite</title>
+    <style>
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
+            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
+            min-height: 100vh;
+            display: flex;
+            align-items: center;
+            justify-content: center;
+            margin: 0;
+        }
+        form {
+            background: white;
+            padding: 2rem;
+            border-radius: 12px;
+            box-shadow: 0 10px 30px rgba(0, 0, 0, 0.2);
+            display: flex;
+            flex-direction: column;
+            gap: 0.75rem;
+            width: 280px;
+        }
+        input, button {
+            padding: 0.6rem;
+            border-radius: 8px;
+            border: 1px solid #ddd;
+            font-size: 1rem;
+        }
+        button {
+            background: #667eea;
+            color: white;
+            border: none;
+            cursor: pointer;
+        }
+        .error { color: #e53e3e; font-size: 0.9rem; }
+    </style>
+</head>
+<body>
+    <form method="POST" action="/auth/login">
+        <h2>📝 CollabWrite</h2>
+        {{if .Failed}}<div class="error">Invalid username or password</div>{{end}}
+        <input name="username" placeholder="Username" autocomplete="username" required autofocus>
+        <input name="password" type="password" placeholder="Password" autocomplete="current-password" required>
+        <input name="next" type="hidden" value="{{.Next}}">
+        <button type="submit">Sign in</button>
+    </form>
+</body>
+</html>`))
+
+// serveLoginPage serves the login form
+func serveLoginPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	loginPage.Execute(w, struct {
+		Next   string
+		Failed bool
+	}{localPath(r.URL.Query().Get("next")), r.URL.Query().Has("failed")})
+}
+
+// serveLogin signs a user in. The login form gets the token in a cookie and
+// is sent on to the page it came from; JSON requests
+// ({"username", "password"}) get it in the reply, to send as a bearer token.
+func serveLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	isJSON := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	var credentials struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if isJSON {
+		if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	} else {
+		credentials.Username, credentials.Password = r.PostFormValue("username"), r.PostFormValue("password")
+	}
+
+	next := localPath(r.PostFormValue("next"))
+	token, u, err := tokens.Login(credentials.Username, credentials.Password)
+	switch {
+	case errors.Is(err, auth.ErrBadCredentials) && isJSON:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case errors.Is(err, auth.ErrBadCredentials):
+		http.Redirect(w, r, "/login?failed&next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	case err != nil:
+		log.Printf("Failed to sign %s in: %v", credentials.Username, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s signed in", u.Username)
+
+	if isJSON {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"token": token, "user": u})
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     auth.CookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(tokens.TTL().Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// serveLogout signs the token of a request out
+func serveLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		tokens.Logout(strings.TrimPrefix(header, "Bearer "))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if cookie, err := r.Cookie(auth.CookieName); err == nil {
+		tokens.Logout(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: auth.CookieName, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"path/filepath"
+
+	"collaborative-markdown-editor/internal/auth"
+)
+
+// userCookie holds a secret the server gave a browser, so that its tabs join
+// rooms as the same user. The secret itself is never shown to anyone; other
+// users only see the ID derived from it.
+const userCookie = "user"
+
+// browserKey signs the secrets in browser cookies and derives user IDs from
+// them
+var browserKey []byte
+
+// setupBrowsers loads the key browser cookies are signed with from dataDir
+func setupBrowsers(dataDir string) error {
+	key, err := auth.LoadKey(filepath.Join(dataDir, "browser.key"))
+	if err != nil {
+		return err
+	}
+	browserKey = key
+	return nil
+}
+
+// browserUserID returns the user ID of the browser a request comes from,
+// giving it a secret if it has none yet
+func browserUserID(w http.ResponseWriter, r *http.Request) string {
+	if userID, ok := cookieUserID(r); ok {
+		return userID
+	}
+	secret := newClientID() + newClientID()
+	http.SetCookie(w, &http.Cookie{
+		Name:     userCookie,
+		Value:    auth.Sign(browserKey, []byte(secret)),
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return browserID(secret)
+}
+
+// cookieUserID returns the user ID of the secret a request's cookie holds.
+// Cookies the server did not sign are ignored.
+func cookieUserID(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(userCookie)
+	if err != nil {
+		return "", false
+	}
+	secret, err := auth.Verify(browserKey, cookie.Value)
+	if err != nil {
+		return "", false
+	}
+	return browserID(string(secret)), true
+}
+
+// guestPrefix starts the IDs of guests when users sign in, so that no guest
+// can take the ID of a user
+const guestPrefix = "guest-"
+
+// browserID returns the public user ID of a browser secret. The secret
+// cannot be recovered from it, so publishing the ID gives nobody the
+// browser's rights. Browsers that have not signed in are guests when users
+// sign in.
+func browserID(secret string) string {
+	mac := hmac.New(sha256.New, browserKey)
+	mac.Write([]byte("user:" + secret))
+	id := hex.EncodeToString(mac.Sum(nil)[:8])
+	if authenticator != nil {
+		return guestPrefix + id
+	}
+	return id
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"collaborative-markdown-editor/internal/auth"
+)
+
+func TestBrowsersKeepTheirSecret(t *testing.T) {
+	setupServer(t)
+	w := httptest.NewRecorder()
+	userID := browserUserID(w, httptest.NewRequest(http.MethodGet, "/room/r1", nil))
+	cookie := w.Result().Cookies()[0]
+	if !regexp.MustCompile(`^[0-9a-f]{16}$`).MatchString(userID) {
+		t.Errorf("user ID %q is not 16 hex digits", userID)
+	}
+	if strings.Contains(cookie.Value, userID) || !cookie.HttpOnly {
+		t.Errorf("cookie %+v gives the user ID away", cookie)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		cookie string
+		want   string
+	}{
+		{"the browser's cookie", cookie.Value, userID},
+		{"the public user ID", userID, ""},
+		{"a cookie signed with another key", auth.Sign([]byte(strings.Repeat("x", 32)), []byte("secret")), ""},
+		{"a tampered cookie", string(cookie.Value[0]^1) + cookie.Value[1:], ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/room/r1", nil)
+		r.AddCookie(&http.Cookie{Name: userCookie, Value: tt.cookie})
+		if got, _ := cookieUserID(r); got != tt.want {
+			t.Errorf("%s: got user %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGuestsHaveTheirOwnIDs(t *testing.T) {
+	setupServer(t)
+	anonymous := browserID("secret")
+	authenticator = &auth.HeaderAuthenticator{UserHeader: "X-Forwarded-User"}
+	guest := browserID("secret")
+	if guest != guestPrefix+anonymous {
+		t.Errorf("guest ID %q, want %q", guest, guestPrefix+anonymous)
+	}
+
+	// Guests from anywhere but the proxy are not who they say they are
+	r := httptest.NewRequest(http.MethodGet, "/room/r1", nil)
+	r.Header.Set("X-Forwarded-User", "alice")
+	w := httptest.NewRecorder()
+	if got := visitorID(r); got != "" {
+		t.Errorf("request from %s is user %q", r.RemoteAddr, got)
+	}
+	if got := browserUserID(w, r); !strings.HasPrefix(got, guestPrefix) {
+		t.Errorf("guest got ID %q, want one starting with %q", got, guestPrefix)
+	}
+}
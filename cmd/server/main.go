@@ -1,30 +1,90 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"regexp"
+	"strconv"
 	"text/template"
-	"time"
 
+	"collaborative-markdown-editor/internal/acl"
 	"collaborative-markdown-editor/internal/client"
+	"collaborative-markdown-editor/internal/document"
 	"collaborative-markdown-editor/internal/hub"
+	"collaborative-markdown-editor/internal/protocol"
+	"collaborative-markdown-editor/internal/storage"
 	"collaborative-markdown-editor/internal/user"
 )
 
 var h *hub.Hub
 
+// roomIDPattern matches the room IDs the home page creates and users type in
+var roomIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
 func main() {
+	dataDir := flag.String("data", "data", "directory rooms are saved in")
+	idleTimeout := flag.Duration("idle-timeout", hub.DefaultIdleTimeout, "how long a room without clients stays in memory")
+	var authentication authConfig
+	flag.StringVar(&authentication.mode, "auth", "none", "how users are identified: none (anonymous), local (passwords checked by the server) or header (set by a reverse proxy)")
+	flag.StringVar(&authentication.userHeader, "auth-user-header", "X-Forwarded-User", "header the reverse proxy puts the user's ID in")
+	flag.StringVar(&authentication.nameHeader, "auth-name-header", "X-Forwarded-Preferred-Username", "header the reverse proxy puts the user's name in")
+	flag.StringVar(&authentication.trustedProxies, "auth-trusted-proxies", "", "comma separated networks the reverse proxy connects from, loopback if empty")
+	newUser := flag.String("add-user", "", "add a local user with the password read from stdin, then exit")
+	newOwner := flag.String("set-owner", "", "make a user the owner of a room, given as room=user, then exit")
+	linkRole := flag.String("link-role", "editor", "what anyone with the link may do in rooms whose owner has not said: none, viewer, commenter or editor")
+	flag.Parse()
+
+	if *newUser != "" {
+		if err := addUser(*dataDir, *newUser); err != nil {
+			log.Fatalf("Failed to add user: %v", err)
+		}
+		return
+	}
+
+	store, err := storage.NewFileStore(*dataDir)
+	if err != nil {
+		log.Fatalf("Failed to open storage: %v", err)
+	}
+
 	// Create hub
 	h = hub.NewHub()
+	h.SetStore(store)
+	h.SetLifecycle(hub.Lifecycle{IdleTimeout: *idleTimeout})
+	role, err := acl.ParseRole(*linkRole)
+	if err != nil || role == acl.Owner {
+		log.Fatalf("Invalid link role %q", *linkRole)
+	}
+	h.SetDefaultLinkRole(role)
+	if *newOwner != "" {
+		if err := setOwner(*newOwner); err != nil {
+			log.Fatalf("Failed to set owner: %v", err)
+		}
+		return
+	}
 	go h.Run()
 
+	if err := setupAuth(authentication, *dataDir); err != nil {
+		log.Fatalf("Failed to set up authentication: %v", err)
+	}
+	if err := setupShareLinks(*dataDir); err != nil {
+		log.Fatalf("Failed to load the share link key: %v", err)
+	}
+	if err := setupBrowsers(*dataDir); err != nil {
+		log.Fatalf("Failed to load the browser cookie key: %v", err)
+	}
+
 	// HTTP routes
 	http.HandleFunc("/", serveHome)
 
 	http.HandleFunc("/room/", serveRoom)
 
+	http.HandleFunc("/ws/", serveWs)
 
+	http.HandleFunc("/api/rooms/", serveRoomAPI)
 
 	fmt.Println("Server starting on 0.0.0.0:8080")
 	log.Fatal(http.ListenAndServe("0.0.0.0:8080", nil))
@@ -40,6 +100,9 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if !signedIn(w, r) {
+		return
+	}
 
 	// Serve the home page template
 	tmpl := `<!DOCTYPE html>
@@ -252,6 +315,29 @@ func serveRoom(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Room ID required", http.StatusBadRequest)
 		return
 	}
+	if !roomIDPattern.MatchString(roomID) {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	// Guests with a share link need not sign in
+	token := r.URL.Query().Get("t")
+	if token == "" && !signedIn(w, r) {
+		return
+	}
+	// Tabs of the same anonymous browser join as the same user, and so do
+	// guests
+	userID := visitorID(r)
+	if userID == "" {
+		userID = browserUserID(w, r)
+	}
+	// The link is used when the page joins the room
+	if token != "" && !openShareLink(w, roomID, token, userID, false) {
+		return
+	}
+	if token == "" && !mayOpen(w, roomID, userID, true, document.Backend(r.URL.Query().Get("backend"))) {
+		return
+	}
 
 	// Get current content of the room
 	currentContent := h.GetRoomContent(roomID)
@@ -353,6 +439,12 @@ func serveRoom(w http.ResponseWriter, r *http.Request) {
             color: #2d3748;
         }
 
+        .user-position {
+            display: block;
+            font-size: 0.75rem;
+            color: #718096;
+        }
+
         .user-status {
             width: 8px;
             height: 8px;
@@ -622,44 +714,90 @@ func serveRoom(w http.ResponseWriter, r *http.Request) {
         let reconnectInterval;
         let lastContent = '';
         let currentUser = null;
+        let clientID = null;
+        let userID = null;
         let cursorUpdateInterval;
+        let roomUsers = [];
+        let selections = {};
+        let lastSelection = null;
+        let sessionToken = null;
+        let role = null;
+
+        // Guests keep showing the share link they came with
+        const shareToken = new URLSearchParams(window.location.search).get('t');
 
         function connect() {
-            ws = new WebSocket('ws://' + window.location.host + '/ws/' + roomID);
+            let url = 'ws://' + window.location.host + '/ws/' + roomID;
+            const params = new URLSearchParams();
+            if (sessionToken) {
+                params.set('session', sessionToken);
+            }
+            if (shareToken) {
+                params.set('t', shareToken);
+            }
+            if (params.toString()) {
+                url += '?' + params.toString();
+            }
+            ws = new WebSocket(url);
 
             ws.onopen = function(event) {
                 status.innerHTML = '<span>✅</span> Connected';
                 status.className = 'status connected';
                 clearInterval(reconnectInterval);
 
+                if (sessionToken) {
+                    // Coming back: send our text first, with whatever was
+                    // typed while we were offline
+                    clearTimeout(typingTimer);
+                    ws.send(editor.value);
+                    lastContent = editor.value;
+                }
+
                 // Request user info and room users
                 fetchUsers();
                 startCursorUpdates();
             };
 
             ws.onmessage = function(event) {
-                try {
-                    // Try to parse as JSON first (for user list updates)
-                    const data = JSON.parse(event.data);
-                    if (data.type === 'userList') {
-                        // This is a user list update
-                        updateUsersList(data.users);
-                        return;
-                    }
-                } catch (e) {
-                    // Not JSON, treat as regular content
-                    const content = event.data;
-                    if (content !== editor.value) {
-                        const cursorPos = editor.selectionStart;
-                        editor.value = content;
-                        lastContent = content;
-                        updatePreview();
-
-                        // Restore cursor position approximately
-                        if (cursorPos <= content.length) {
-                            editor.selectionStart = editor.selectionEnd = cursorPos;
+                const message = parseEnvelope(event.data);
+                if (!message) {
+                    // Plain text is the whole document
+                    setContent(event.data);
+                    return;
+                }
+
+                const payload = message.payload || {};
+                switch (message.type) {
+                    case 'init':
+                        // Start from the room's document
+                        clientID = payload.clientId;
+                        userID = payload.userId || clientID;
+                        sessionToken = payload.session || null;
+                        setContent(payload.content);
+                        setUsers(payload.users);
+                        setRole(payload.role);
+                        if (payload.resumed) {
+                            showNotification('Reconnected');
                         }
-                    }
+                        break;
+                    case 'userList':
+                        setUsers(payload.users);
+                        break;
+                    case 'presence':
+                        // Selections moved, by their owners or by edits
+                        selections = payload.selections || {};
+                        updateUsersList(roomUsers);
+                        break;
+                    case 'resync':
+                        setContent(payload.content);
+                        showNotification('Reloaded the latest version of the document');
+                        break;
+                    case 'access':
+                        setRole(payload.role);
+                        break;
+                    case 'error':
+                        console.error('Server rejected a message:', payload.code, payload.message);
+                        break;
                 }
             };
 
@@ -668,7 +806,13 @@ func serveRoom(w http.ResponseWriter, r *http.Request) {
                 status.className = 'status disconnected';
                 clearInterval(cursorUpdateInterval);
 
+                if (role === 'none') {
+                    // We may no longer open the room
+                    return;
+                }
+
                 // Try to reconnect every 3 seconds
+                clearInterval(reconnectInterval);
                 reconnectInterval = setInterval(connect, 3000);
             };
 
@@ -677,6 +821,61 @@ func serveRoom(w http.ResponseWriter, r *http.Request) {
             };
         }
 
+        // parseEnvelope returns the protocol message in a frame, or null for
+        // plain text
+        function parseEnvelope(data) {
+            try {
+                const message = JSON.parse(data);
+                if (message && message.v === 1 && typeof message.type === 'string') {
+                    return message;
+                }
+            } catch (e) {
+                // Not JSON
+            }
+            return null;
+        }
+
+        function sendMessage(type, payload) {
+            if (ws && ws.readyState === WebSocket.OPEN) {
+                ws.send(JSON.stringify({ type: type, v: 1, payload: payload }));
+            }
+        }
+
+        function setContent(content) {
+            if (content !== editor.value) {
+                const cursorPos = editor.selectionStart;
+                editor.value = content;
+                updatePreview();
+
+                // Restore cursor position approximately
+                if (cursorPos <= content.length) {
+                    editor.selectionStart = editor.selectionEnd = cursorPos;
+                }
+            }
+            lastContent = content;
+        }
+
+        function setUsers(users) {
+            roomUsers = users || [];
+            roomUsers.forEach(user => {
+                clientsOf(user).forEach(id => {
+                    if (!selections[id]) {
+                        selections[id] = user.selection;
+                    }
+                });
+            });
+            updateUsersList(roomUsers);
+        }
+
+        // Viewers and commenters can read the document but not change it
+        function setRole(newRole) {
+            if (role !== null && newRole !== role) {
+                showNotification(newRole === 'none' ? 'You can no longer open this room' : 'You are now a ' + newRole + ' of this room');
+            }
+            role = newRole;
+            editor.readOnly = role !== 'editor' && role !== 'owner';
+        }
+
         function updatePreview() {
             preview.innerHTML = marked.parse(editor.value);
         }
@@ -727,18 +926,67 @@ func serveRoom(w http.ResponseWriter, r *http.Request) {
                 userElement.className = 'user-item';
                 userElement.innerHTML = '<div class="user-avatar" style="background: ' + user.color + '">' +
                     user.username.charAt(0).toUpperCase() +
-                    '</div><span class="user-name">' + user.username + '</span><div class="user-status"></div>';
+                    '</div><span class="user-name">' + user.username + (user.id === userID ? ' (you)' : '') +
+                    '<span class="user-position">' + describeSelection(selectionOf(user)) + '</span></span><div class="user-status"></div>';
                 usersList.appendChild(userElement);
             });
         }
 
+        // A user has a client for each tab they have the room open in
+        function clientsOf(user) {
+            return user.clients || [user.id];
+        }
+
+        // The selection of this tab for ourselves, and of the first tab
+        // that has one for everyone else
+        function selectionOf(user) {
+            if (user.id === userID && selections[clientID]) {
+                return selections[clientID];
+            }
+            const id = clientsOf(user).find(id => selections[id]);
+            return id ? selections[id] : user.selection;
+        }
+
+        // The server counts offsets in code points, the textarea in UTF-16 units
+        function toRuneOffset(text, offset) {
+            return Array.from(text.slice(0, offset)).length;
+        }
+
+        function fromRuneOffset(text, offset) {
+            return Array.from(text).slice(0, offset).join('').length;
+        }
+
+        function describeSelection(selection) {
+            if (!selection) {
+                return '';
+            }
+            const text = editor.value;
+            const head = fromRuneOffset(text, selection.head);
+            const lines = text.slice(0, head).split('\n');
+            let description = 'Ln ' + lines.length + ', Col ' + (lines[lines.length - 1].length + 1);
+            const selected = Math.abs(selection.head - selection.anchor);
+            if (selected > 0) {
+                description += ' (' + selected + ' selected)';
+            }
+            return description;
+        }
+
         function startCursorUpdates() {
+            lastSelection = null;
             cursorUpdateInterval = setInterval(() => {
                 if (ws && ws.readyState === WebSocket.OPEN) {
-                    // Send cursor position update
-                    const cursorPos = editor.selectionStart;
-                    // In a real implementation, you'd send this to the server
-                    console.log('Cursor position:', cursorPos);
+                    // Send the selection when it changes
+                    const text = editor.value;
+                    let anchor = toRuneOffset(text, editor.selectionStart);
+                    let head = toRuneOffset(text, editor.selectionEnd);
+                    if (editor.selectionDirection === 'backward') {
+                        [anchor, head] = [head, anchor];
+                    }
+                    if (lastSelection && lastSelection.anchor === anchor && lastSelection.head === head) {
+                        return;
+                    }
+                    lastSelection = { anchor: anchor, head: head };
+                    sendMessage('presence', { version: 0, selection: { anchor: anchor, head: head } });
                 }
             }, 100);
         }
@@ -781,6 +1029,18 @@ func serveRoom(w http.ResponseWriter, r *http.Request) {
                         e.preventDefault();
                         wrapText('[', '](url)');
                         break;
+                    case 'z':
+                    case 'Z':
+                        // Undo is shared with the room: only our own edits are undone
+                        e.preventDefault();
+                        doneTyping();
+                        sendMessage(e.shiftKey ? 'redo' : 'undo');
+                        break;
+                    case 'y':
+                        e.preventDefault();
+                        doneTyping();
+                        sendMessage('redo');
+                        break;
                 }
             }
         });
@@ -802,7 +1062,7 @@ func serveRoom(w http.ResponseWriter, r *http.Request) {
 </html>`
 
 	data := struct {
-		RoomID string
+		RoomID  string
 		Content string
 		Host    string
 	}{
@@ -815,4 +1075,129 @@ func serveRoom(w http.ResponseWriter, r *http.Request) {
 	t.Execute(w, data)
 }
 
+// serveWs upgrades a request to a WebSocket connection and joins the room
+func serveWs(w http.ResponseWriter, r *http.Request) {
+	roomID := r.URL.Path[len("/ws/"):]
+	if !roomIDPattern.MatchString(roomID) {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	// Clients that speak the protocol say which version; browsers that
+	// send plain text say nothing
+	legacy := true
+	switch v := r.URL.Query().Get("v"); v {
+	case "":
+	case strconv.Itoa(protocol.Version):
+		legacy = false
+	default:
+		http.Error(w, "Unsupported protocol version", http.StatusBadRequest)
+		return
+	}
+
+	// Guests with a share link connect as the user of their browser
+	token := r.URL.Query().Get("t")
+	var identity user.User
+	if authenticator != nil && token == "" {
+		var ok bool
+		if identity, ok = authenticate(w, r); !ok {
+			return
+		}
+	} else if authenticator != nil {
+		if u, err := authenticator.Authenticate(r); err == nil {
+			identity = u
+			h.GetUserManager().SetUser(u)
+		}
+	}
+	authenticated := identity.ID != ""
+
+	// Only users who come back as themselves can own rooms or use share
+	// links up
+	userID, known := identity.ID, authenticated
+	if !known {
+		userID, known = cookieUserID(r)
+	}
+	if !known {
+		// Never an ID the client chose, so that guests cannot pass for
+		// anyone
+		userID = browserID(newClientID())
+	}
+	if token != "" && !openShareLink(w, roomID, token, userID, true) {
+		return
+	}
+	backend := document.Backend(r.URL.Query().Get("backend"))
+	if !mayOpen(w, roomID, userID, known, backend) {
+		return
+	}
 
+	conn, err := client.Upgrade(w, r)
+	if err != nil {
+		// The upgrader has already replied with an error
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+
+	// A reconnecting browser sends its text before anything else
+	session := r.URL.Query().Get("session")
+	var text string
+	if session != "" && legacy {
+		if text, err = client.ReadText(conn); err != nil {
+			log.Printf("Reconnecting client sent no text: %v", err)
+			conn.Close()
+			return
+		}
+	}
+
+	// Clients that reconnect come back as the same connection of the same
+	// user. New connections belong to the user they authenticated as or,
+	// for anonymous ones and guests, to the user of their browser if it
+	// opened the room page and to a new user otherwise.
+	u, prev, resumed := h.LookupSession(roomID, session)
+	if resumed && (authenticated || token != "") && u.ID != userID {
+		// Someone else's session
+		resumed = false
+	}
+	clientID := newClientID()
+	switch {
+	case resumed && authenticated:
+		clientID, u = prev.ID, identity
+	case resumed:
+		clientID = prev.ID
+	case authenticated:
+		u = identity
+	default:
+		u = h.GetUserManager().LoadOrCreateUser(userID, user.GenerateUsername())
+	}
+
+	c := client.NewClient(conn, roomID, clientID, u)
+	c.Legacy = legacy
+	c.Authorship = !legacy && r.URL.Query().Get("authors") == "1"
+	switch {
+	case resumed && legacy:
+		c.ResumeLegacy(prev, text)
+		h.Resume(c)
+	case resumed && r.URL.Query().Has("version"):
+		version, err := strconv.Atoi(r.URL.Query().Get("version"))
+		if err != nil || version < 0 {
+			// Start the client over, as the same user
+			h.Register(c)
+			break
+		}
+		c.ResumeFrom(version)
+		h.Resume(c)
+	default:
+		h.RegisterWithBackend(c, backend)
+	}
+
+	go c.WritePump(h)
+	go c.ReadPump(h)
+}
+
+// newClientID returns a random ID for a new connection
+func newClientID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Failed to generate client ID: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"collaborative-markdown-editor/internal/acl"
+	"collaborative-markdown-editor/internal/auth"
+)
+
+// defaultShareLinkTTL is how long share links last unless they are given
+// another expiry
+const defaultShareLinkTTL = 7 * 24 * time.Hour
+
+// shareKey signs share links
+var shareKey []byte
+
+// shareClaims is what a share link's token says. The room keeps the link
+// too, so that it can be revoked and its uses counted.
+type shareClaims struct {
+	RoomID  string   `json:"room"`
+	LinkID  string   `json:"link"`
+	Role    acl.Role `json:"role"`
+	Expires int64    `json:"exp"` // Unix seconds
+	MaxUses int      `json:"max,omitempty"`
+}
+
+// shareLinkInfo is a share link as owners see it
+type shareLinkInfo struct {
+	acl.ShareLink
+	URL string `json:"url"`
+}
+
+// setupShareLinks loads the key share links are signed with from dataDir
+func setupShareLinks(dataDir string) error {
+	key, err := auth.LoadKey(filepath.Join(dataDir, "share.key"))
+	if err != nil {
+		return err
+	}
+	shareKey = key
+	return nil
+}
+
+// shareURL returns the address of a share link to a room. Signing the same
+// link again gives the same token, so links can be listed after they are
+// made.
+func shareURL(r *http.Request, roomID string, link acl.ShareLink) string {
+	payload, _ := json.Marshal(shareClaims{
+		RoomID:  roomID,
+		LinkID:  link.ID,
+		Role:    link.Role,
+		Expires: link.Expires.Unix(),
+		MaxUses: link.MaxUses,
+	})
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/room/" + roomID + "?t=" + auth.Sign(shareKey, payload)
+}
+
+// openShareLink lets a user into a room with the token of a share link,
+// replying that they may not if the link is not valid. Only with use does
+// the user count as one of the link's uses, so that previews and prefetches
+// of the page do not use links up.
+func openShareLink(w http.ResponseWriter, roomID, token, userID string, use bool) bool {
+	var claims shareClaims
+	payload, err := auth.Verify(shareKey, token)
+	if err == nil {
+		err = json.Unmarshal(payload, &claims)
+	}
+	if err != nil || claims.RoomID != roomID || time.Now().Unix() >= claims.Expires {
+		http.Error(w, acl.ErrNoShareLink.Error(), http.StatusForbidden)
+		return false
+	}
+	open := h.ShareLinkRole
+	if use {
+		open = h.OpenShareLink
+	}
+	if _, err := open(roomID, claims.LinkID, userID); err != nil {
+		if errors.Is(err, acl.ErrNoShareLink) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		} else {
+			apiError(w, err)
+		}
+		return false
+	}
+	return true
+}
+
+// serveShareLinks serves the share links of a room to its owners:
+//
+//	GET    /api/rooms/{id}/links       the links handed out, with who used them
+//	POST   /api/rooms/{id}/links       make a link: {"role", "expiresIn",
+//	                                   "maxUses"}, by default lasting a week
+//	                                   for any number of users
+//	DELETE /api/rooms/{id}/links/{id}  revoke a link
+//
+// Making a link replies with it, the others with every link left.
+func serveShareLinks(w http.ResponseWriter, r *http.Request, roomID string, parts []string, creator string) {
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		var request struct {
+			Role      *acl.Role `json:"role"`
+			ExpiresIn string    `json:"expiresIn"`
+			MaxUses   int       `json:"maxUses"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Role == nil || *request.Role == acl.None {
+			http.Error(w, "Role required: viewer, commenter or editor", http.StatusBadRequest)
+			return
+		}
+		ttl := defaultShareLinkTTL
+		if request.ExpiresIn != "" {
+			var err error
+			if ttl, err = time.ParseDuration(request.ExpiresIn); err != nil || ttl <= 0 {
+				http.Error(w, "Invalid expiresIn, use a duration such as 72h", http.StatusBadRequest)
+				return
+			}
+		}
+		if request.MaxUses < 0 {
+			http.Error(w, "Invalid maxUses", http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		link := acl.ShareLink{
+			ID:      newClientID(),
+			Role:    *request.Role,
+			Expires: now.Add(ttl).Truncate(time.Second),
+			MaxUses: request.MaxUses,
+			Creator: creator,
+			Created: now,
+		}
+		if err := h.AddShareLink(roomID, link); err != nil {
+			apiError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, shareLinkInfo{ShareLink: link, URL: shareURL(r, roomID, link)})
+		return
+	case len(parts) == 3 && parts[2] != "" && r.Method == http.MethodDelete:
+		if err := h.RevokeShareLink(roomID, parts[2]); err != nil {
+			apiError(w, err)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	a, err := h.ACL(roomID)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	links := make([]shareLinkInfo, len(a.Share))
+	for i, link := range a.Share {
+		links[i] = shareLinkInfo{ShareLink: link, URL: shareURL(r, roomID, link)}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"links": links})
+}
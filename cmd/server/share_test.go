@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// makeLink has the owner of a room make a share link and returns its ID and
+// token
+func makeLink(t *testing.T, owner *http.Cookie, roomID, body string) (string, string) {
+	t.Helper()
+	resp := request(serveRoomAPI, http.MethodPost, "/api/rooms/"+roomID+"/links", body, owner)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("making a link with %s: %s", body, resp.Status)
+	}
+	var link shareLinkInfo
+	if err := json.NewDecoder(resp.Body).Decode(&link); err != nil {
+		t.Fatal(err)
+	}
+	_, token, _ := strings.Cut(link.URL, "?t=")
+	return link.ID, token
+}
+
+func TestShareLinksLetGuestsIn(t *testing.T) {
+	setupServer(t)
+	owner := newBrowser(t, "r1")
+	newBrowser(t, "r2")
+	_, token := makeLink(t, owner, "r1", `{"role":"viewer"}`)
+	_, expired := makeLink(t, owner, "r1", `{"role":"viewer","expiresIn":"1ns"}`)
+	revokedID, revoked := makeLink(t, owner, "r1", `{"role":"viewer"}`)
+	request(serveRoomAPI, http.MethodDelete, "/api/rooms/r1/links/"+revokedID, "", owner)
+	// Nobody gets in without a link
+	request(serveRoomAPI, http.MethodPut, "/api/rooms/r1/link", `{"role":"none"}`, owner)
+
+	for _, tt := range []struct {
+		name, target string
+		want         int
+	}{
+		{"no link", "/room/r1", http.StatusForbidden},
+		{"a link", "/room/r1?t=" + token, http.StatusOK},
+		{"a link to another room", "/room/r2?t=" + token, http.StatusForbidden},
+		{"an expired link", "/room/r1?t=" + expired, http.StatusForbidden},
+		{"a revoked link", "/room/r1?t=" + revoked, http.StatusForbidden},
+		{"a forged link", "/room/r1?t=" + token + "x", http.StatusForbidden},
+	} {
+		if resp := request(serveRoom, http.MethodGet, tt.target, "", nil); resp.StatusCode != tt.want {
+			t.Errorf("%s: got %s, want %d", tt.name, resp.Status, tt.want)
+		}
+	}
+}
+
+func TestShareLinksAreUsedUpByJoining(t *testing.T) {
+	setupServer(t)
+	owner := newBrowser(t, "r1")
+	request(serveRoomAPI, http.MethodPut, "/api/rooms/r1/link", `{"role":"none"}`, owner)
+	_, token := makeLink(t, owner, "r1", `{"role":"viewer","maxUses":1}`)
+	server := httptest.NewServer(http.HandlerFunc(serveWs))
+	t.Cleanup(server.Close)
+
+	// guest opens the page and returns the cookie of its browser
+	guest := func() *http.Cookie {
+		resp := request(serveRoom, http.MethodGet, "/room/r1?t="+token, "", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("opening the page: %s", resp.Status)
+		}
+		return resp.Cookies()[0]
+	}
+	join := func(cookie *http.Cookie) int {
+		header := http.Header{"Cookie": {cookie.String()}}
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/r1?t="+token, header)
+		if err == nil {
+			conn.Close()
+		}
+		return resp.StatusCode
+	}
+
+	// Previews and prefetches of the page use nothing up
+	first, second := guest(), guest()
+	for i := 0; i < 3; i++ {
+		guest()
+	}
+	if got := join(first); got != http.StatusSwitchingProtocols {
+		t.Fatalf("first guest to join: got %d", got)
+	}
+	if got := join(second); got != http.StatusForbidden {
+		t.Errorf("guest joining with a used up link: got %d, want 403", got)
+	}
+	if got := join(first); got != http.StatusSwitchingProtocols {
+		t.Errorf("first guest coming back: got %d", got)
+	}
+	resp := request(serveRoom, http.MethodGet, "/room/r1?t="+token, "", second)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("page for a guest the link is used up for: got %s, want 403", resp.Status)
+	}
+}
@@ -2,4 +2,7 @@ module collaborative-markdown-editor
 
 go 1.21.5
 
-require github.com/gorilla/websocket v1.5.3
+require (
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/crypto v0.21.0
+)
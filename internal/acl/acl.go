@@ -0,0 +1,241 @@
+// Package acl decides what users may do in a room
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Role is what a user may do in a room. Each role may do everything the
+// ones before it may.
+type Role int
+
+const (
+	None      Role = iota // May not open the room
+	Viewer                // May read the document and see who is there
+	Commenter             // May read the document; comments are to come
+	Editor                // May change the document
+	Owner                 // May also decide who else may do what
+)
+
+var roleNames = [...]string{"none", "viewer", "commenter", "editor", "owner"}
+
+// String returns the name of the role
+func (r Role) String() string {
+	if r < None || r > Owner {
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+// ParseRole returns the role with a name
+func ParseRole(name string) (Role, error) {
+	for r, n := range roleNames {
+		if n == name {
+			return Role(r), nil
+		}
+	}
+	return None, fmt.Errorf("unknown role %q", name)
+}
+
+// MarshalText encodes the role by name
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText decodes a role from its name
+func (r *Role) UnmarshalText(text []byte) error {
+	role, err := ParseRole(string(text))
+	if err != nil {
+		return err
+	}
+	*r = role
+	return nil
+}
+
+// CanView tells whether the role may open the room
+func (r Role) CanView() bool {
+	return r >= Viewer
+}
+
+// CanEdit tells whether the role may change the document
+func (r Role) CanEdit() bool {
+	return r >= Editor
+}
+
+var (
+	// ErrLastOwner is returned for changes that would leave a room without
+	// an owner
+	ErrLastOwner = errors.New("a room must keep an owner")
+
+	// ErrLinkRole is returned when giving anyone with a room's link a role
+	// only users can have
+	ErrLinkRole = errors.New("anyone with the link cannot be an owner")
+
+	// ErrNoShareLink is returned for share links that were revoked, expired
+	// or were opened as many times as they may be
+	ErrNoShareLink = errors.New("share link is revoked, expired or used up")
+)
+
+// ShareLink lets whoever opens it do what its role allows until it
+// expires, without being given a role. Each user who opens it uses it once.
+type ShareLink struct {
+	ID      string    `json:"id"`
+	Role    Role      `json:"role"`
+	Expires time.Time `json:"expires"`
+	MaxUses int       `json:"maxUses,omitempty"` // 0 for no limit
+	Users   []string  `json:"users,omitempty"`   // Who opened it
+	Creator string    `json:"creator,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// usedBy tells whether a user opened the link
+func (l ShareLink) usedBy(userID string) bool {
+	for _, id := range l.Users {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL is who may do what in a room: the roles given to users, what anyone
+// who knows the room's link may do, and the share links handed out
+type ACL struct {
+	Roles map[string]Role `json:"roles,omitempty"` // userID -> role
+	Link  Role            `json:"link"`
+	Share []ShareLink     `json:"share,omitempty"`
+}
+
+// RoleOf returns what a user may do in the room now. Users without an
+// identity have an empty ID and only get what the link gives.
+func (a ACL) RoleOf(userID string) Role {
+	role := a.Link
+	if userID == "" {
+		return role
+	}
+	if granted, ok := a.Roles[userID]; ok && granted > role {
+		role = granted
+	}
+	now := time.Now()
+	for _, link := range a.Share {
+		if link.Role > role && now.Before(link.Expires) && link.usedBy(userID) {
+			role = link.Role
+		}
+	}
+	return role
+}
+
+// HasOwner tells whether anyone owns the room
+func (a ACL) HasOwner() bool {
+	for _, role := range a.Roles {
+		if role == Owner {
+			return true
+		}
+	}
+	return false
+}
+
+// Clone returns a copy of the ACL that can be changed on its own
+func (a ACL) Clone() ACL {
+	clone := ACL{Link: a.Link, Roles: make(map[string]Role, len(a.Roles))}
+	for userID, role := range a.Roles {
+		clone.Roles[userID] = role
+	}
+	for _, link := range a.Share {
+		link.Users = append([]string(nil), link.Users...)
+		clone.Share = append(clone.Share, link)
+	}
+	return clone
+}
+
+// Grant gives a user a role, replacing the one they had. Granting None is
+// revoking.
+func (a *ACL) Grant(userID string, role Role) error {
+	if role < None || role > Owner {
+		return fmt.Errorf("unknown role %d", role)
+	}
+	if a.Roles[userID] == Owner && role != Owner && a.owners() == 1 {
+		return ErrLastOwner
+	}
+	if role == None {
+		delete(a.Roles, userID)
+		return nil
+	}
+	if a.Roles == nil {
+		a.Roles = make(map[string]Role)
+	}
+	a.Roles[userID] = role
+	return nil
+}
+
+// Revoke takes away the role given to a user
+func (a *ACL) Revoke(userID string) error {
+	return a.Grant(userID, None)
+}
+
+// SetLink sets what anyone with the room's link may do
+func (a *ACL) SetLink(role Role) error {
+	if role < None || role >= Owner {
+		return ErrLinkRole
+	}
+	a.Link = role
+	return nil
+}
+
+// AddShareLink hands out a share link. Like the room's link, it cannot
+// make anyone an owner.
+func (a *ACL) AddShareLink(link ShareLink) error {
+	if link.Role <= None || link.Role >= Owner {
+		return ErrLinkRole
+	}
+	a.Share = append(a.Share, link)
+	return nil
+}
+
+// RevokeShareLink takes back a share link, and with it what it let its
+// users do
+func (a *ACL) RevokeShareLink(id string) error {
+	for i, link := range a.Share {
+		if link.ID == id {
+			a.Share = append(a.Share[:i], a.Share[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNoShareLink
+}
+
+// OpenShareLink lets a user in with a share link and returns its role. The
+// link is used up once by users who had not opened it before, for whom
+// first is true.
+func (a *ACL) OpenShareLink(id, userID string, now time.Time) (role Role, first bool, err error) {
+	for i := range a.Share {
+		link := &a.Share[i]
+		if link.ID != id {
+			continue
+		}
+		switch {
+		case userID == "", !now.Before(link.Expires):
+			return None, false, ErrNoShareLink
+		case link.usedBy(userID):
+			return link.Role, false, nil
+		case link.MaxUses > 0 && len(link.Users) >= link.MaxUses:
+			return None, false, ErrNoShareLink
+		}
+		link.Users = append(link.Users, userID)
+		return link.Role, true, nil
+	}
+	return None, false, ErrNoShareLink
+}
+
+// owners counts the owners of the room
+func (a ACL) owners() int {
+	n := 0
+	for _, role := range a.Roles {
+		if role == Owner {
+			n++
+		}
+	}
+	return n
+}
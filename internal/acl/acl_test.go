@@ -0,0 +1,106 @@
+package acl
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRolesComeFromGrantsAndTheLink(t *testing.T) {
+	var a ACL
+	if err := a.Grant("alice", Owner); err != nil {
+		t.Fatal(err)
+	}
+	a.Grant("bob", Commenter)
+	a.SetLink(Viewer)
+
+	for userID, want := range map[string]Role{"alice": Owner, "bob": Commenter, "carol": Viewer, "": Viewer} {
+		if got := a.RoleOf(userID); got != want {
+			t.Errorf("role of %q: got %v, want %v", userID, got, want)
+		}
+	}
+	// The link gives more than a grant
+	a.SetLink(Editor)
+	if got := a.RoleOf("bob"); got != Editor {
+		t.Errorf("commenter with an editor link: got %v, want editor", got)
+	}
+	if err := a.SetLink(Owner); !errors.Is(err, ErrLinkRole) {
+		t.Errorf("owner link: got %v, want ErrLinkRole", err)
+	}
+}
+
+func TestRoomsKeepAnOwner(t *testing.T) {
+	var a ACL
+	a.Grant("alice", Owner)
+	if err := a.Revoke("alice"); !errors.Is(err, ErrLastOwner) {
+		t.Fatalf("revoking the last owner: got %v, want ErrLastOwner", err)
+	}
+	if err := a.Grant("alice", Editor); !errors.Is(err, ErrLastOwner) {
+		t.Fatalf("demoting the last owner: got %v, want ErrLastOwner", err)
+	}
+	a.Grant("bob", Owner)
+	if err := a.Revoke("alice"); err != nil || a.RoleOf("alice") != None || !a.HasOwner() {
+		t.Errorf("revoking one of two owners: %v, alice is %v", err, a.RoleOf("alice"))
+	}
+}
+
+func TestRolesAreSavedByName(t *testing.T) {
+	a := ACL{Roles: map[string]Role{"alice": Owner}, Link: Viewer}
+	data, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"roles":{"alice":"owner"},"link":"viewer"}` {
+		t.Errorf("saved as %s", data)
+	}
+	var b ACL
+	if err := json.Unmarshal(data, &b); err != nil || b.RoleOf("alice") != Owner || b.Link != Viewer {
+		t.Errorf("loaded %+v, %v", b, err)
+	}
+	if err := json.Unmarshal([]byte(`{"link":"admin"}`), &b); err == nil {
+		t.Error("loaded an unknown role")
+	}
+}
+
+func TestShareLinksLetTheirUsersIn(t *testing.T) {
+	a := ACL{Link: None}
+	now := time.Now()
+	a.AddShareLink(ShareLink{ID: "review", Role: Commenter, Expires: now.Add(time.Hour), MaxUses: 2})
+	a.AddShareLink(ShareLink{ID: "old", Role: Editor, Expires: now.Add(-time.Hour)})
+	if err := a.AddShareLink(ShareLink{ID: "boss", Role: Owner, Expires: now.Add(time.Hour)}); !errors.Is(err, ErrLinkRole) {
+		t.Errorf("owner share link: got %v, want ErrLinkRole", err)
+	}
+
+	for i, userID := range []string{"alice", "bob", "alice"} {
+		role, first, err := a.OpenShareLink("review", userID, now)
+		if err != nil || role != Commenter || first != (i < 2) {
+			t.Errorf("%s opening the link: got %v, %v, %v", userID, role, first, err)
+		}
+	}
+	if _, _, err := a.OpenShareLink("review", "carol", now); !errors.Is(err, ErrNoShareLink) {
+		t.Errorf("third user of a link for two: got %v, want ErrNoShareLink", err)
+	}
+	if _, _, err := a.OpenShareLink("old", "alice", now); !errors.Is(err, ErrNoShareLink) {
+		t.Errorf("expired link: got %v, want ErrNoShareLink", err)
+	}
+	if got := a.RoleOf("bob"); got != Commenter {
+		t.Errorf("role of a user of the link: got %v, want commenter", got)
+	}
+	if got := a.RoleOf("carol"); got != None {
+		t.Errorf("role of someone else: got %v, want none", got)
+	}
+
+	// A clone is used up on its own
+	clone := a.Clone()
+	clone.RevokeShareLink("review")
+	if got := a.RoleOf("bob"); got != Commenter {
+		t.Errorf("revoking a link in a clone took bob's role: %v", got)
+	}
+	if got := clone.RoleOf("bob"); got != None {
+		t.Errorf("role after the link was revoked: got %v, want none", got)
+	}
+	if err := clone.RevokeShareLink("review"); !errors.Is(err, ErrNoShareLink) {
+		t.Errorf("revoking a link twice: got %v, want ErrNoShareLink", err)
+	}
+}
@@ -0,0 +1,39 @@
+// Package auth tells who makes a request to the editor: a user signed in
+// with a password the server checked itself, or one a trusted reverse
+// proxy vouches for.
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"collaborative-markdown-editor/internal/user"
+)
+
+// ErrUnauthenticated is returned for requests that do not say who made
+// them, or say it in a way that cannot be trusted
+var ErrUnauthenticated = errors.New("not authenticated")
+
+// Authenticator tells who made a request. Implementations are safe for
+// concurrent use.
+type Authenticator interface {
+	// Authenticate returns the user who made a request, or
+	// ErrUnauthenticated
+	Authenticate(r *http.Request) (user.User, error)
+}
+
+// CookieName is the cookie that holds the token of a signed in browser
+const CookieName = "auth"
+
+// requestToken returns the token a request carries, as a bearer token or in
+// its cookie
+func requestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	if cookie, err := r.Cookie(CookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
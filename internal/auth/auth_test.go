@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsersCheckPasswordsAndSurviveRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	users, err := OpenUsers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := users.Add("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Add("alice", "other"); !errors.Is(err, ErrUserExists) {
+		t.Errorf("adding alice twice: got %v, want ErrUserExists", err)
+	}
+
+	users, err = OpenUsers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, err := users.Check("alice", "secret"); err != nil || u != alice {
+		t.Errorf("alice with her password: got %+v, %v; want %+v", u, err, alice)
+	}
+	for _, c := range [][2]string{{"alice", "wrong"}, {"bob", "secret"}} {
+		if _, err := users.Check(c[0], c[1]); !errors.Is(err, ErrBadCredentials) {
+			t.Errorf("%s with password %q: got %v, want ErrBadCredentials", c[0], c[1], err)
+		}
+	}
+}
+
+func TestTokensSignUsersIn(t *testing.T) {
+	users, _ := OpenUsers(filepath.Join(t.TempDir(), "users.json"))
+	alice, _ := users.Add("alice", "secret")
+	tokens := NewTokenAuthenticator(users, []byte(strings.Repeat("k", 32)), time.Hour)
+
+	if _, _, err := tokens.Login("alice", "wrong"); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("login with a wrong password: got %v", err)
+	}
+	token, u, err := tokens.Login("alice", "secret")
+	if err != nil || u != alice {
+		t.Fatalf("login: got %+v, %v", u, err)
+	}
+
+	request := func(token string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(&http.Cookie{Name: CookieName, Value: token})
+		return r
+	}
+	if u, err := tokens.Authenticate(request(token)); err != nil || u != alice {
+		t.Errorf("token in a cookie: got %+v, %v", u, err)
+	}
+	bearer := httptest.NewRequest(http.MethodGet, "/", nil)
+	bearer.Header.Set("Authorization", "Bearer "+token)
+	if u, err := tokens.Authenticate(bearer); err != nil || u != alice {
+		t.Errorf("bearer token: got %+v, %v", u, err)
+	}
+
+	// Tokens signed with another key, or changed, are not accepted
+	other := NewTokenAuthenticator(users, []byte(strings.Repeat("o", 32)), time.Hour)
+	forged, _, _ := other.Login("alice", "secret")
+	payload, signature, _ := strings.Cut(token, ".")
+	for name, token := range map[string]string{
+		"no token":      "",
+		"another key":   forged,
+		"changed":       payload + "x." + signature,
+		"not signed":    payload,
+		"bad signature": payload + "." + signature[1:],
+	} {
+		if _, err := tokens.Authenticate(request(token)); !errors.Is(err, ErrUnauthenticated) {
+			t.Errorf("%s: got %v, want ErrUnauthenticated", name, err)
+		}
+	}
+
+	expired := NewTokenAuthenticator(users, []byte(strings.Repeat("k", 32)), -time.Second)
+	old, _, _ := expired.Login("alice", "secret")
+	if _, err := tokens.Authenticate(request(old)); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("expired token: got %v, want ErrUnauthenticated", err)
+	}
+
+	tokens.Logout(token)
+	if _, err := tokens.Authenticate(request(token)); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("token after logout: got %v, want ErrUnauthenticated", err)
+	}
+}
+
+func TestHeadersAreOnlyTrustedFromTheProxy(t *testing.T) {
+	_, proxy, _ := net.ParseCIDR("10.0.0.0/8")
+	a := &HeaderAuthenticator{
+		UserHeader:     "X-Forwarded-User",
+		NameHeader:     "X-Forwarded-Preferred-Username",
+		TrustedProxies: []*net.IPNet{proxy},
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.1.2.3:4567"
+	r.Header.Set("X-Forwarded-User", "alice@example.com")
+	r.Header.Set("X-Forwarded-Preferred-Username", "Alice")
+	u, err := a.Authenticate(r)
+	if err != nil || u.ID != "alice@example.com" || u.Username != "Alice" || u.Color == "" {
+		t.Errorf("request from the proxy: got %+v, %v", u, err)
+	}
+
+	r.RemoteAddr = "192.168.1.1:4567"
+	if _, err := a.Authenticate(r); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("request from elsewhere: got %v, want ErrUnauthenticated", err)
+	}
+
+	// Without trusted proxies, only a proxy on the same host is trusted
+	a.TrustedProxies = nil
+	if _, err := a.Authenticate(r); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("request from elsewhere without trusted proxies: got %v, want ErrUnauthenticated", err)
+	}
+	r.RemoteAddr = "127.0.0.1:4567"
+	if u, err := a.Authenticate(r); err != nil || u.ID != "alice@example.com" {
+		t.Errorf("request from loopback without trusted proxies: got %+v, %v", u, err)
+	}
+	r.RemoteAddr = "[::1]:4567"
+	if u, err := a.Authenticate(r); err != nil || u.ID != "alice@example.com" {
+		t.Errorf("request from IPv6 loopback without trusted proxies: got %+v, %v", u, err)
+	}
+
+	a.TrustedProxies = []*net.IPNet{proxy}
+	r.RemoteAddr = "10.1.2.3:4567"
+	r.Header.Del("X-Forwarded-User")
+	if _, err := a.Authenticate(r); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("request without a user: got %v, want ErrUnauthenticated", err)
+	}
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"net"
+	"net/http"
+
+	"collaborative-markdown-editor/internal/user"
+)
+
+// HeaderAuthenticator trusts a reverse proxy in front of the server to have
+// signed users in, and to say who they are in request headers. The proxy
+// must strip those headers from the requests it forwards.
+type HeaderAuthenticator struct {
+	// Header with the user's ID, such as X-Forwarded-User
+	UserHeader string
+
+	// Header with the name to show for the user, the ID if empty or missing
+	NameHeader string
+
+	// Networks the proxy connects from. Requests from anywhere else are
+	// not trusted; with none, only requests from loopback addresses are.
+	TrustedProxies []*net.IPNet
+}
+
+// Authenticate returns the user the proxy says made a request
+func (a *HeaderAuthenticator) Authenticate(r *http.Request) (user.User, error) {
+	if !a.trusted(r.RemoteAddr) {
+		return user.User{}, ErrUnauthenticated
+	}
+	userID := r.Header.Get(a.UserHeader)
+	if userID == "" {
+		return user.User{}, ErrUnauthenticated
+	}
+	username := userID
+	if a.NameHeader != "" && r.Header.Get(a.NameHeader) != "" {
+		username = r.Header.Get(a.NameHeader)
+	}
+	return user.User{ID: userID, Username: username, Color: user.ColorFor(userID)}, nil
+}
+
+// trusted tells whether a request came from the proxy
+func (a *HeaderAuthenticator) trusted(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if len(a.TrustedProxies) == 0 {
+		return ip.IsLoopback()
+	}
+	for _, network := range a.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"collaborative-markdown-editor/internal/user"
+)
+
+// DefaultTokenTTL is how long a sign in lasts
+const DefaultTokenTTL = 7 * 24 * time.Hour
+
+// LoadKey reads the server's signing key from path, creating a random one
+// there if there is none yet
+func LoadKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) < 32 {
+			return nil, errors.New("signing key in " + path + " is too short")
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path, key, 0o600)
+}
+
+// Sign returns payload encoded with an HMAC-SHA256 signature made with key,
+// as base64url(payload) "." base64url(signature)
+func Sign(key, payload []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify returns the payload of a string made by Sign with key, or
+// ErrUnauthenticated if the signature does not match
+func Verify(key []byte, signed string) ([]byte, error) {
+	encoded, signature, ok := strings.Cut(signed, ".")
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	got, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return nil, ErrUnauthenticated
+	}
+	return payload, nil
+}
+
+// claims is what a sign in token says
+type claims struct {
+	ID      string `json:"jti"`
+	UserID  string `json:"sub"`
+	Expires int64  `json:"exp"` // Unix seconds
+}
+
+// TokenAuthenticator signs the users of a local database in with tokens
+// signed by the server. Tokens are kept by browsers in a cookie and sent by
+// other clients as bearer tokens.
+type TokenAuthenticator struct {
+	users *Users
+	key   []byte
+	ttl   time.Duration
+
+	// Tokens signed out of, until they expire anyway. They are only
+	// remembered until the server restarts.
+	mu      sync.Mutex
+	revoked map[string]time.Time // token ID -> expiry
+}
+
+// NewTokenAuthenticator creates an authenticator for users that signs
+// tokens lasting ttl with key
+func NewTokenAuthenticator(users *Users, key []byte, ttl time.Duration) *TokenAuthenticator {
+	return &TokenAuthenticator{
+		users:   users,
+		key:     key,
+		ttl:     ttl,
+		revoked: make(map[string]time.Time),
+	}
+}
+
+// TTL returns how long tokens last
+func (a *TokenAuthenticator) TTL() time.Duration {
+	return a.ttl
+}
+
+// Login checks a user's password and returns a token that signs them in
+func (a *TokenAuthenticator) Login(username, password string) (string, user.User, error) {
+	u, err := a.users.Check(username, password)
+	if err != nil {
+		return "", user.User{}, err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", user.User{}, err
+	}
+	payload, err := json.Marshal(claims{
+		ID:      hex.EncodeToString(b),
+		UserID:  u.ID,
+		Expires: time.Now().Add(a.ttl).Unix(),
+	})
+	if err != nil {
+		return "", user.User{}, err
+	}
+	return Sign(a.key, payload), u, nil
+}
+
+// Logout revokes a token
+func (a *TokenAuthenticator) Logout(token string) {
+	c, err := a.verify(token)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for id, expires := range a.revoked {
+		if now.After(expires) {
+			delete(a.revoked, id)
+		}
+	}
+	a.revoked[c.ID] = time.Unix(c.Expires, 0)
+}
+
+// Authenticate returns the user a request's token signs in
+func (a *TokenAuthenticator) Authenticate(r *http.Request) (user.User, error) {
+	c, err := a.verify(requestToken(r))
+	if err != nil {
+		return user.User{}, err
+	}
+	// Users removed from the database are signed out
+	u, ok := a.users.Get(c.UserID)
+	if !ok {
+		return user.User{}, ErrUnauthenticated
+	}
+	return u, nil
+}
+
+// verify returns what a token says if the server signed it and it is
+// neither expired nor revoked
+func (a *TokenAuthenticator) verify(token string) (claims, error) {
+	payload, err := Verify(a.key, token)
+	if err != nil {
+		return claims{}, err
+	}
+	var c claims
+	if err := json.Unmarshal(payload, &c); err != nil || time.Now().Unix() >= c.Expires {
+		return claims{}, ErrUnauthenticated
+	}
+	a.mu.Lock()
+	_, revoked := a.revoked[c.ID]
+	a.mu.Unlock()
+	if revoked {
+		return claims{}, ErrUnauthenticated
+	}
+	return c, nil
+}
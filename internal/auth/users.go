@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"collaborative-markdown-editor/internal/user"
+)
+
+var (
+	// ErrUserExists is returned when adding a user whose name is taken
+	ErrUserExists = errors.New("user already exists")
+
+	// ErrBadCredentials is returned for an unknown user or a wrong password
+	ErrBadCredentials = errors.New("invalid username or password")
+)
+
+// account is a user of the local database as saved
+type account struct {
+	ID           string `json:"id"`
+	Username     string `json:"username"`
+	Color        string `json:"color"`
+	PasswordHash []byte `json:"passwordHash"`
+}
+
+// Users is a local database of users who sign in with a password, saved as
+// a JSON file. Passwords are only kept as bcrypt hashes.
+type Users struct {
+	path string
+
+	mu       sync.RWMutex
+	accounts map[string]*account // username -> account
+}
+
+// OpenUsers opens the user database saved at path, which need not exist yet
+func OpenUsers(path string) (*Users, error) {
+	u := &Users{path: path, accounts: make(map[string]*account)}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return u, nil
+	case err != nil:
+		return nil, err
+	}
+	var accounts []*account
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("users in %s: %w", path, err)
+	}
+	for _, a := range accounts {
+		u.accounts[a.Username] = a
+	}
+	return u, nil
+}
+
+// Add creates a user with a password and saves the database
+func (u *Users) Add(username, password string) (user.User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" || password == "" {
+		return user.User{}, errors.New("username and password required")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return user.User{}, err
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return user.User{}, err
+	}
+	id := hex.EncodeToString(b)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, exists := u.accounts[username]; exists {
+		return user.User{}, ErrUserExists
+	}
+	a := &account{ID: id, Username: username, Color: user.ColorFor(id), PasswordHash: hash}
+	u.accounts[username] = a
+	if err := u.save(); err != nil {
+		delete(u.accounts, username)
+		return user.User{}, err
+	}
+	return a.user(), nil
+}
+
+// Check returns the user a username and password belong to
+func (u *Users) Check(username, password string) (user.User, error) {
+	u.mu.RLock()
+	a, exists := u.accounts[username]
+	u.mu.RUnlock()
+	if !exists {
+		// Take as long as a wrong password would
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return user.User{}, ErrBadCredentials
+	}
+	if bcrypt.CompareHashAndPassword(a.PasswordHash, []byte(password)) != nil {
+		return user.User{}, ErrBadCredentials
+	}
+	return a.user(), nil
+}
+
+// Get returns a user by ID
+func (u *Users) Get(userID string) (user.User, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	for _, a := range u.accounts {
+		if a.ID == userID {
+			return a.user(), true
+		}
+	}
+	return user.User{}, false
+}
+
+// dummyHash returns the hash passwords of unknown users are compared with
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost)
+	return hash
+})
+
+func (a *account) user() user.User {
+	return user.User{ID: a.ID, Username: a.Username, Color: a.Color}
+}
+
+// save writes the database to a temporary file and moves it in place, so a
+// crash never leaves half of it behind. u.mu must be held.
+func (u *Users) save() error {
+	accounts := make([]*account, 0, len(u.accounts))
+	for _, a := range u.accounts {
+		accounts = append(accounts, a)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Username < accounts[j].Username })
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(u.path), 0o755); err != nil {
+		return err
+	}
+	tmp := u.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.path)
+}
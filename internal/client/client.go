@@ -1,15 +1,17 @@
 package client
 
 import (
-	"bytes"
+	"errors"
 	"log"
 	"net/http"
+	"sync"
 	"time"
-	"unicode/utf8"
 
-	"github.com/gorilla/websocket"
 	"collaborative-markdown-editor/internal/ot"
+	"collaborative-markdown-editor/internal/otclient"
+	"collaborative-markdown-editor/internal/protocol"
 	"collaborative-markdown-editor/internal/user"
+	"github.com/gorilla/websocket"
 )
 
 const (
@@ -22,13 +24,9 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer
-	maxMessageSize = 512
-)
-
-var (
-	newline = []byte{'\n'}
-	space   = []byte{' '}
+	// Maximum message size allowed from peer. Legacy clients send the whole
+	// document, so this also bounds the document size.
+	maxMessageSize = 1 << 20
 )
 
 var upgrader = websocket.Upgrader{
@@ -45,14 +43,30 @@ type Client struct {
 	// The WebSocket connection
 	Conn *websocket.Conn
 
-	// Buffered channel of outbound messages
-	Send chan []byte
+	// Outbound messages from the room. The room closes it when it drops
+	// the client.
+	Send *Outbox
+
+	// Replies the client makes itself, such as errors about frames it
+	// rejected. It is never closed.
+	replies chan []byte
+
+	// Legacy clients send the whole document as plain text and get it back
+	// the same way. The client tracks their OT state for them.
+	Legacy bool
+
+	// Clients that asked for it get who wrote each part of the document in
+	// their init message
+	Authorship bool
 
-	// Current content of the document
-	CurrentContent string
+	// Guards CurrentContent and state, which both pumps update
+	mu sync.Mutex
+
+	// Current content of the document, as the browser last saw it
+	CurrentContent *ot.Rope
 
 	// Previous content for diff calculation
-	PreviousContent string
+	PreviousContent *ot.Rope
 
 	// Room ID this client belongs to
 	RoomID string
@@ -60,45 +74,107 @@ type Client struct {
 	// Unique client ID
 	ID string
 
-	// Current version for OT
-	Version int
+	// OT state of a legacy client: the server version CurrentContent is
+	// based on and the edits the hub has not acknowledged yet
+	state *otclient.Client
+
+	// The edit in flight was made or sent before this connection. It goes
+	// out once the hub has replayed what the client missed.
+	unsent bool
+
+	// User the connection belongs to. ID is the connection's own; one
+	// user can have several.
+	User user.User
+}
 
-	// User information
-	User *user.User
+// Hub is what a client needs from the hub
+type Hub interface {
+	Broadcast(msg Message)
+	Unregister(client *Client)
 }
 
-// Message represents a message from a client
+// Message represents a message from a client. Content is a protocol
+// envelope.
 type Message struct {
 	RoomID   string `json:"roomId"`
 	ClientID string `json:"clientId"`
 	Content  []byte `json:"content"`
 }
 
-
+// Upgrade upgrades an HTTP request to a WebSocket connection
+func Upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	return upgrader.Upgrade(w, r, nil)
+}
 
 // NewClient creates a new client instance
-func NewClient(conn *websocket.Conn, roomID, clientID string, user *user.User) *Client {
+func NewClient(conn *websocket.Conn, roomID, clientID string, user user.User) *Client {
 	return &Client{
 		Conn:            conn,
-		Send:            make(chan []byte, 256),
-		CurrentContent:  "",
-		PreviousContent: "",
+		Send:            NewOutbox(OutboxLimit),
+		replies:         make(chan []byte, 16),
+		CurrentContent:  ot.NewRope(""),
+		PreviousContent: ot.NewRope(""),
 		RoomID:          roomID,
 		ID:              clientID,
-		Version:         0,
+		state:           otclient.New(clientID, 0),
 		User:            user,
 	}
 }
 
+// ReadText reads the first frame a reconnecting legacy browser sends: its
+// text, including edits made while it was offline
+func ReadText(conn *websocket.Conn) (string, error) {
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(writeWait))
+	_, message, err := conn.ReadMessage()
+	return string(message), err
+}
+
+// Version returns the server version the client's copy of the document is
+// at, before its unacknowledged edits
+func (c *Client) Version() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state.Version()
+}
+
+// ResumeFrom marks a reconnecting protocol client as having seen the
+// document at version. The client keeps its own OT state.
+func (c *Client) ResumeFrom(version int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.Reset(version)
+}
+
+// ResumeLegacy takes over the OT state prev, an earlier connection of the
+// same legacy client, kept for the browser. text is what the browser sent
+// with ReadText; edits in it were made against the text prev last sent, so
+// they are recorded before the hub replays what the client missed.
+func (c *Client) ResumeLegacy(prev *Client, text string) {
+	prev.mu.Lock()
+	content, state := prev.CurrentContent, *prev.state
+	prev.mu.Unlock()
+
+	c.mu.Lock()
+	c.CurrentContent = content
+	c.PreviousContent = content
+	c.state = &state
+	c.mu.Unlock()
+
+	if _, err := protocol.Decode([]byte(text)); errors.Is(err, protocol.ErrNotEnvelope) {
+		c.localEdit(text)
+	}
+	c.mu.Lock()
+	c.unsent = c.state.State() != otclient.Synchronized
+	c.mu.Unlock()
+}
+
 // readPump pumps messages from the WebSocket connection to the hub.
 //
 // The application runs readPump in a per-connection goroutine. The application
 // ensures that there is at most one reader on a connection by executing all
 // reads from this goroutine.
-func (c *Client) ReadPump(hub interface {
-	Broadcast(msg Message)
-	Unregister(client *Client)
-}) {
+func (c *Client) ReadPump(hub Hub) {
 	defer func() {
 		hub.Unregister(c)
 		c.Conn.Close()
@@ -120,59 +196,81 @@ func (c *Client) ReadPump(hub interface {
 			break
 		}
 
-		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-		msgContent := string(message)
-
-		// Check if this is a JSON operation or plain content
-		if len(msgContent) > 0 && msgContent[0] == "{" {
-			// Try to parse as JSON operation
-			operation, err := ot.OperationFromJSON(message)
-			if err != nil {
-				log.Printf("Failed to parse operation: %v", err)
-				return
+		env, err := protocol.Decode(message)
+		switch {
+		case errors.Is(err, protocol.ErrNotEnvelope) && c.Legacy:
+			// Plain text holds the whole document. It is turned into an
+			// operation against the text the browser last saw.
+			if operation := c.localEdit(string(message)); operation != nil {
+				c.sendOperation(hub, operation)
 			}
+			continue
+		case err != nil:
+			c.replyError(protocol.CodeInvalidMessage, err.Error())
+			continue
+		}
 
-			// Update current content based on operation
-			c.applyOperation(operation)
-			c.Version = operation.Version
-
-			// Send the operation to hub
-			msg := Message{
-				RoomID:   c.RoomID,
-				ClientID: c.ID,
-				Content:  message,
-			}
+		if err := c.checkInbound(env); err != nil {
+			c.replyError(protocol.CodeInvalidMessage, err.Error())
+			continue
+		}
+		if env.Type == protocol.TypePresence && c.Legacy {
+			// Legacy clients do not know versions; their selection is in
+			// the text the client tracks for them
+			message = c.stampPresence(env)
+		}
 
-			hub.Broadcast(msg)
-		} else {
-			// Plain text content (from JavaScript)
-			newContent := msgContent
-
-			// Simple approach: replace entire content
-			c.PreviousContent = c.CurrentContent
-			c.CurrentContent = newContent
-			c.Version++
-
-			// Send the full content to hub
-			msg := Message{
-				RoomID:   c.RoomID,
-				ClientID: c.ID,
-				Content:  []byte(newContent),
-			}
+		hub.Broadcast(Message{
+			RoomID:   c.RoomID,
+			ClientID: c.ID,
+			Content:  message,
+		})
+	}
+}
 
-			hub.Broadcast(msg)
+// checkInbound validates a message sent by the peer
+func (c *Client) checkInbound(env *protocol.Envelope) error {
+	switch env.Type {
+	case protocol.TypeOp:
+		if c.Legacy {
+			return errors.New("legacy clients send the document as text")
+		}
+		_, err := env.DecodeOp()
+		return err
+	case protocol.TypeAck:
+		return env.DecodePayload(&protocol.Ack{})
+	case protocol.TypePresence:
+		var presence protocol.Presence
+		if err := env.DecodePayload(&presence); err != nil {
+			return err
 		}
+		if presence.Selection == nil {
+			return errors.New("presence without a selection")
+		}
+		return nil
+	case protocol.TypeUndo, protocol.TypeRedo:
+		return nil
 	}
+	return errors.New("clients cannot send " + string(env.Type) + " messages")
 }
 
-
+// stampPresence dates a legacy client's selection with the version of the
+// text the client tracks for it
+func (c *Client) stampPresence(env *protocol.Envelope) []byte {
+	var presence protocol.Presence
+	env.DecodePayload(&presence)
+	c.mu.Lock()
+	presence.Version = c.state.Version()
+	c.mu.Unlock()
+	return protocol.MustEncode(protocol.TypePresence, presence)
+}
 
 // writePump pumps messages from the hub to the WebSocket connection.
 //
 // A goroutine running writePump is started for each connection. The
 // application ensures that there is at most one writer to a connection by
 // executing all writes from this goroutine.
-func (c *Client) WritePump() {
+func (c *Client) WritePump(hub Hub) {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
@@ -181,32 +279,23 @@ func (c *Client) WritePump() {
 
 	for {
 		select {
-		case message, ok := <-c.Send:
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+		case <-c.Send.Ready():
+			if err := c.writeQueued(hub); err != nil {
 				return
 			}
 
-			// Parse the operation and apply to local content
-			operation, err := ot.OperationFromJSON(message)
-			if err != nil {
-				log.Printf("Failed to parse operation: %v", err)
-				continue
-			}
-
-			// Apply operation to local content
-			c.applyOperation(operation)
-
-			// Send the full current content to the client
-			w, err := c.Conn.NextWriter(websocket.TextMessage)
-			if err != nil {
+		case <-c.Send.Done():
+			// The room dropped the client; send what it queued first
+			if err := c.writeQueued(hub); err != nil {
 				return
 			}
-			w.Write([]byte(c.CurrentContent))
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
 
-			if err := w.Close(); err != nil {
+		case message := <-c.replies:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				return
 			}
 
@@ -219,32 +308,177 @@ func (c *Client) WritePump() {
 	}
 }
 
-// applyOperation applies an OT operation to the client's current content
-func (c *Client) applyOperation(operation *ot.Operation) {
-	runes := []rune(c.CurrentContent)
+// writeQueued writes the messages queued in the outbox to the peer
+func (c *Client) writeQueued(hub Hub) error {
+	for _, message := range c.Send.Take() {
+		if c.Legacy {
+			message = c.translateOutbound(hub, message)
+		}
+		if message == nil {
+			continue
+		}
+		c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// translateOutbound keeps a legacy client's OT state up to date with a
+// message from the hub and returns the frame to send it instead, or nil
+func (c *Client) translateOutbound(hub Hub, message []byte) []byte {
+	env, err := protocol.Decode(message)
+	if err != nil {
+		log.Printf("Failed to decode message for client %s: %v", c.ID, err)
+		return nil
+	}
+
+	switch env.Type {
+	case protocol.TypeOp:
+		operation, err := env.DecodeOp()
+		if err != nil {
+			log.Printf("Failed to parse operation: %v", err)
+			return nil
+		}
+		// Send the full current content to the client
+		return []byte(c.remoteEdit(operation))
+
+	case protocol.TypeAck:
+		var ack protocol.Ack
+		if err := env.DecodePayload(&ack); err != nil {
+			log.Printf("Failed to parse ack: %v", err)
+			return nil
+		}
+		operation, err := c.acknowledge(ack.Version)
+		if err != nil {
+			log.Printf("Unexpected ack for client %s: %v", c.ID, err)
+		}
+		if operation != nil {
+			c.sendOperation(hub, operation)
+		}
+		return nil
 
-	switch operation.Type {
-	case ot.Insert:
-		if operation.Position > len(runes) {
-			operation.Position = len(runes)
+	case protocol.TypeInit:
+		// Start from the server's copy and let the browser do the same
+		var init protocol.Init
+		if err := env.DecodePayload(&init); err != nil {
+			log.Printf("Failed to parse init: %v", err)
+			return nil
+		}
+		if !init.Resumed {
+			c.reset(init.Content, init.Version)
+			break
 		}
-		newRunes := make([]rune, 0, len(runes)+utf8.RuneCountInString(operation.Character))
-		newRunes = append(newRunes, runes[:operation.Position]...)
-		newRunes = append(newRunes, []rune(operation.Character)...)
-		newRunes = append(newRunes, runes[operation.Position:]...)
-		c.CurrentContent = string(newRunes)
 
-	case ot.Delete:
-		if operation.Position >= len(runes) {
-			return
+		// The browser keeps its text, with the missed operations merged in
+		content, operation := c.resume()
+		if operation != nil {
+			c.sendOperation(hub, operation)
 		}
-		end := operation.Position + operation.Length
-		if end > len(runes) {
-			end = len(runes)
+		init.Content = content
+		return protocol.MustEncode(protocol.TypeInit, init)
+
+	case protocol.TypeResync:
+		// Start over from the server's copy, dropping unacknowledged edits
+		var resync protocol.Resync
+		if err := env.DecodePayload(&resync); err != nil {
+			log.Printf("Failed to parse resync: %v", err)
+			return nil
 		}
-		newRunes := make([]rune, 0, len(runes)-operation.Length)
-		newRunes = append(newRunes, runes[:operation.Position]...)
-		newRunes = append(newRunes, runes[end:]...)
-		c.CurrentContent = string(newRunes)
+		c.reset(resync.Content, resync.Version)
+	}
+	return message
+}
+
+// replyError tells the peer that one of its frames was rejected
+func (c *Client) replyError(code, message string) {
+	select {
+	case c.replies <- protocol.MustEncode(protocol.TypeError, protocol.Error{Code: code, Message: message}):
+	default:
+		log.Printf("Dropped error for client %s: %s", c.ID, message)
+	}
+}
+
+// reset replaces the content with the server's copy at version, dropping
+// unacknowledged edits
+func (c *Client) reset(content string, version int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.PreviousContent = c.CurrentContent
+	c.CurrentContent = ot.NewRope(content)
+	c.state.Reset(version)
+	c.unsent = false
+}
+
+// localEdit records new text from the browser and returns the operation to
+// send to the hub, or nil if there is nothing to send yet
+func (c *Client) localEdit(text string) *ot.Operation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	edit := ot.Diff(c.CurrentContent.String(), text)
+	if edit.IsNoop() {
+		return nil
+	}
+	c.PreviousContent = c.CurrentContent
+	c.CurrentContent = ot.NewRope(text)
+	return c.state.ApplyLocal(edit)
+}
+
+// remoteEdit applies an operation committed by the hub on top of the
+// unacknowledged edits and returns the new content
+func (c *Client) remoteEdit(operation *ot.Operation) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.applyOperation(c.state.ApplyRemote(operation))
+	return c.CurrentContent.String()
+}
+
+// acknowledge marks the pending edit as committed as version and returns the
+// buffered edits to send next, if any
+func (c *Client) acknowledge(version int) (*ot.Operation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unsent = false
+	return c.state.Ack(version)
+}
+
+// resume finishes resuming a legacy client once the hub has replayed what
+// it missed. It returns the content to show the browser and the edit to
+// send again, if the hub has not acknowledged it.
+func (c *Client) resume() (string, *ot.Operation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var operation *ot.Operation
+	if c.unsent {
+		operation = c.state.Pending()
+		c.unsent = false
+	}
+	return c.CurrentContent.String(), operation
+}
+
+// sendOperation sends one of our edits to the hub
+func (c *Client) sendOperation(hub Hub, operation *ot.Operation) {
+	data, err := protocol.Encode(protocol.TypeOp, operation)
+	if err != nil {
+		log.Printf("Failed to encode operation: %v", err)
+		return
+	}
+	hub.Broadcast(Message{
+		RoomID:   c.RoomID,
+		ClientID: c.ID,
+		Content:  data,
+	})
+}
+
+// applyOperation applies an OT operation to the client's current content
+func (c *Client) applyOperation(operation *ot.Operation) {
+	content, err := operation.Text().ApplyRope(c.CurrentContent)
+	if err != nil {
+		log.Printf("Failed to apply operation %s: %v", operation, err)
+		return
 	}
+	c.CurrentContent = content
 }
@@ -0,0 +1,206 @@
+package client
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"collaborative-markdown-editor/internal/ot"
+	"collaborative-markdown-editor/internal/protocol"
+)
+
+// OutboxLimit is how many messages a client's outbox holds before it
+// coalesces them
+const OutboxLimit = 256
+
+// Stats counts what an outbox did to keep up with a slow client
+type Stats struct {
+	Coalesced int64 `json:"coalesced"` // Messages merged into others or superseded
+	Dropped   int64 `json:"dropped"`   // Messages replaced by a resync
+	Resyncs   int64 `json:"resyncs"`   // Resyncs that replaced a backlog
+}
+
+// totals adds up the stats of every outbox
+var totals struct {
+	coalesced, dropped, resyncs atomic.Int64
+}
+
+// TotalStats returns the stats of every outbox since the process started
+func TotalStats() Stats {
+	return Stats{
+		Coalesced: totals.coalesced.Load(),
+		Dropped:   totals.dropped.Load(),
+		Resyncs:   totals.resyncs.Load(),
+	}
+}
+
+// Outbox queues the messages a room sends a client until its write pump
+// takes them. A full outbox first coalesces its backlog: only the latest
+// presence and user list are kept, and runs of operations by the same
+// author are composed into one. If that is not enough the room replaces
+// the backlog with a resync.
+//
+// The room is the only producer and closes the outbox once it drops the
+// client; Close may be called more than once.
+type Outbox struct {
+	mu     sync.Mutex
+	queue  [][]byte
+	limit  int
+	stats  Stats
+	ready  chan struct{} // Signalled when messages are queued, never closed
+	done   chan struct{} // Closed by Close
+	closed bool
+}
+
+// NewOutbox creates an outbox holding up to limit messages
+func NewOutbox(limit int) *Outbox {
+	return &Outbox{
+		limit: limit,
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+}
+
+// Push queues a message. It returns false if the outbox is full even after
+// coalescing, in which case the message is not queued and the caller should
+// Replace the backlog.
+func (o *Outbox) Push(data []byte) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return true
+	}
+	if len(o.queue) >= o.limit {
+		o.coalesce()
+		if len(o.queue) >= o.limit {
+			return false
+		}
+	}
+	o.queue = append(o.queue, data)
+	o.signal()
+	return true
+}
+
+// Replace drops the backlog for a single message, usually a resync, and
+// returns how many messages were dropped
+func (o *Outbox) Replace(data []byte) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return 0
+	}
+	dropped := len(o.queue)
+	o.queue = append(o.queue[:0:0], data)
+	o.stats.Dropped += int64(dropped)
+	o.stats.Resyncs++
+	totals.dropped.Add(int64(dropped))
+	totals.resyncs.Add(1)
+	o.signal()
+	return dropped
+}
+
+// Close tells the write pump to send what is queued and hang up
+func (o *Outbox) Close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.closed {
+		o.closed = true
+		close(o.done)
+	}
+}
+
+// Ready is signalled when messages are queued
+func (o *Outbox) Ready() <-chan struct{} {
+	return o.ready
+}
+
+// Done is closed when the outbox is closed
+func (o *Outbox) Done() <-chan struct{} {
+	return o.done
+}
+
+// Take removes and returns the queued messages, oldest first
+func (o *Outbox) Take() [][]byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	queue := o.queue
+	o.queue = nil
+	return queue
+}
+
+// Len returns the number of queued messages
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.queue)
+}
+
+// Stats returns what the outbox did to keep up so far
+func (o *Outbox) Stats() Stats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.stats
+}
+
+// signal wakes the write pump without blocking
+func (o *Outbox) signal() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// coalesce shrinks the backlog without changing what the client ends up
+// with. Operations by different authors are not composed, since clients
+// break ties between concurrent inserts by author.
+func (o *Outbox) coalesce() {
+	// Only the latest presence and user list matter
+	latest := make(map[protocol.Type]int)
+	envs := make([]*protocol.Envelope, len(o.queue))
+	for i, data := range o.queue {
+		env, err := protocol.Decode(data)
+		if err != nil {
+			continue
+		}
+		envs[i] = env
+		if env.Type == protocol.TypePresence || env.Type == protocol.TypeUserList {
+			latest[env.Type] = i
+		}
+	}
+
+	queue := o.queue[:0:0]
+	var last *ot.Operation // Operation at the end of queue, if any
+	for i, data := range o.queue {
+		env := envs[i]
+		if env == nil {
+			queue = append(queue, data)
+			last = nil
+			continue
+		}
+		switch env.Type {
+		case protocol.TypePresence, protocol.TypeUserList:
+			if latest[env.Type] != i {
+				continue
+			}
+		case protocol.TypeOp:
+			op, err := env.DecodeOp()
+			if err != nil {
+				break
+			}
+			if last != nil && last.ClientID == op.ClientID && last.Version+1 == op.Version {
+				last = ot.NewOperation(last.Text().Compose(op.Text()), op.Version, op.ClientID)
+				queue[len(queue)-1] = protocol.MustEncode(protocol.TypeOp, last)
+				continue
+			}
+			queue = append(queue, data)
+			last = op
+			continue
+		}
+		queue = append(queue, data)
+		last = nil
+	}
+
+	coalesced := int64(len(o.queue) - len(queue))
+	o.stats.Coalesced += coalesced
+	totals.coalesced.Add(coalesced)
+	o.queue = queue
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"testing"
+
+	"collaborative-markdown-editor/internal/ot"
+	"collaborative-markdown-editor/internal/protocol"
+)
+
+func opMessage(position int, text string, version int, clientID string) []byte {
+	return protocol.MustEncode(protocol.TypeOp, ot.NewInsertOperation(position, text, version, clientID))
+}
+
+func presenceMessage(version int) []byte {
+	return protocol.MustEncode(protocol.TypePresence, protocol.Presence{
+		Version:    version,
+		Selections: map[string]ot.Selection{"alice": ot.Cursor(version)},
+	})
+}
+
+func TestOutboxCoalescesOperationsAndPresence(t *testing.T) {
+	o := NewOutbox(5)
+	messages := [][]byte{
+		opMessage(0, "a", 1, "alice"),
+		presenceMessage(1),
+		opMessage(1, "b", 2, "alice"),
+		opMessage(2, "c", 3, "alice"),
+		presenceMessage(3),
+		// The outbox is full: alice's operations become one and only the
+		// presence after them is kept
+		opMessage(0, "x", 4, "bob"),
+		presenceMessage(4),
+	}
+	for i, m := range messages {
+		if !o.Push(m) {
+			t.Fatalf("message %d did not fit", i)
+		}
+	}
+
+	queue := o.Take()
+	if len(queue) != 4 {
+		t.Fatalf("got %d messages, want 4", len(queue))
+	}
+	doc := ""
+	for _, m := range [][]byte{queue[0], queue[2]} {
+		env, err := protocol.Decode(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		op, err := env.DecodeOp()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc, err = op.Text().Apply(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if doc != "xabc" {
+		t.Errorf("coalesced operations give %q, want %q", doc, "xabc")
+	}
+	env, _ := protocol.Decode(queue[3])
+	var presence protocol.Presence
+	if err := env.DecodePayload(&presence); err != nil || presence.Version != 4 {
+		t.Errorf("kept presence %+v, %v; want the one at version 4", presence, err)
+	}
+	if got := o.Stats().Coalesced; got != 3 {
+		t.Errorf("coalesced %d messages, want 3", got)
+	}
+}
+
+func TestOutboxAsksForResyncWhenCoalescingIsNotEnough(t *testing.T) {
+	o := NewOutbox(3)
+	for i := 0; i < 3; i++ {
+		// Alternating authors and acks cannot be merged
+		if !o.Push(opMessage(0, "x", i+1, []string{"alice", "bob", "carol"}[i])) {
+			t.Fatalf("message %d did not fit", i)
+		}
+	}
+	if o.Push(protocol.MustEncode(protocol.TypeAck, protocol.Ack{Version: 4})) {
+		t.Fatal("full outbox took another message")
+	}
+
+	resync := protocol.MustEncode(protocol.TypeResync, protocol.Resync{Content: "xxxx", Version: 4})
+	if dropped := o.Replace(resync); dropped != 3 {
+		t.Errorf("dropped %d messages, want 3", dropped)
+	}
+	if queue := o.Take(); len(queue) != 1 || string(queue[0]) != string(resync) {
+		t.Errorf("backlog after resync: %q", queue)
+	}
+	if stats := o.Stats(); stats.Dropped != 3 || stats.Resyncs != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestOutboxClosesOnce(t *testing.T) {
+	o := NewOutbox(1)
+	o.Close()
+	o.Close()
+	select {
+	case <-o.Done():
+	default:
+		t.Fatal("Done not closed")
+	}
+	if !o.Push([]byte("late")) || o.Len() != 0 {
+		t.Error("closed outbox queued a message")
+	}
+}
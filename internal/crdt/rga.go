@@ -0,0 +1,274 @@
+package crdt
+
+import (
+	"strings"
+	"sync"
+
+	"collaborative-markdown-editor/internal/ot"
+)
+
+// ID identifies a single character for its whole life. Seq is the document
+// version whose operation inserted the character (0 for the initial text)
+// and Offset tells apart the characters inserted by the same operation.
+type ID struct {
+	Seq    int `json:"seq"`
+	Offset int `json:"offset"`
+}
+
+// node is a character of the sequence. Deleted characters stay in place as
+// tombstones so that positions from older versions can still be resolved.
+type node struct {
+	id        ID
+	char      rune
+	deletedAt int // Version that deleted the character, 0 while it is visible
+}
+
+// visibleAt reports whether the character was part of the text at version
+func (n *node) visibleAt(version int) bool {
+	return n.id.Seq <= version && (n.deletedAt == 0 || n.deletedAt > version)
+}
+
+// Document is a replicated growable array (RGA): every character carries a
+// unique ID and deletions leave tombstones. Operations made against an older
+// version are transformed against what the versions since did, which the
+// tombstones keep, so that they land where OT clients with edits in flight
+// put them: concurrent inserts at the same place are ordered by client ID.
+type Document struct {
+	mu         sync.RWMutex
+	nodes      []node // In document order, tombstones included
+	text       string // Cached visible text
+	version    int
+	base       int                     // Version of the initial text
+	clients    map[int]string          // Client that made each version after base
+	selections map[string]ot.Selection // By client ID, in current offsets
+}
+
+// NewDocument creates a CRDT document with the given initial text
+func NewDocument(initialDoc string) *Document {
+	return NewDocumentAt(ot.Snapshot{Text: initialDoc})
+}
+
+// NewDocumentAt creates a CRDT document for a text that was saved at a
+// version. Operations based on older versions cannot be resolved.
+func NewDocumentAt(snapshot ot.Snapshot) *Document {
+	d := &Document{
+		text:       snapshot.Text,
+		version:    snapshot.Version,
+		base:       snapshot.Version,
+		clients:    make(map[int]string),
+		selections: make(map[string]ot.Selection),
+	}
+	for i, r := range []rune(snapshot.Text) {
+		d.nodes = append(d.nodes, node{id: ID{Seq: 0, Offset: i}, char: r})
+	}
+	return d
+}
+
+// ApplyOperation integrates an operation made against op.Version and returns
+// its effect on the current text
+func (d *Document) ApplyOperation(op *ot.Operation) (*ot.Operation, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if op == nil {
+		return op, nil
+	}
+	if op.Version > d.version {
+		return nil, ot.ErrFutureVersion
+	}
+	if op.Version < d.base {
+		return nil, &ot.StaleVersionError{Version: op.Version, Oldest: d.base}
+	}
+
+	text := op.Text()
+	if !d.fits(text, op.Version) {
+		return nil, ot.ErrOutOfRange
+	}
+
+	version := d.version + 1
+	d.integrate(d.catchUp(op), d.version, version)
+	d.version = version
+	d.clients[version] = op.ClientID
+
+	effect := d.effectOf(version)
+	d.text = d.visibleText()
+	for clientID, sel := range d.selections {
+		d.selections[clientID] = sel.Transform(effect, clientID == op.ClientID)
+	}
+	return ot.NewOperation(effect, version, op.ClientID), nil
+}
+
+// fits reports whether text can be applied to the document as it was at
+// base
+func (d *Document) fits(text ot.TextOperation, base int) bool {
+	remaining := 0
+	for i := range d.nodes {
+		if d.nodes[i].visibleAt(base) {
+			remaining++
+		}
+	}
+	for _, c := range text {
+		n := c.Retain + c.Delete
+		if n > remaining {
+			return false
+		}
+		remaining -= n
+	}
+	return true
+}
+
+// catchUp transforms an operation against the versions committed since it
+// was made and returns it as an operation on the current text
+func (d *Document) catchUp(op *ot.Operation) ot.TextOperation {
+	for v := op.Version + 1; v <= d.version; v++ {
+		op, _ = op.Transform(ot.NewOperation(d.effectOf(v), v-1, d.clients[v]))
+	}
+	return op.Text()
+}
+
+// integrate walks text over the characters visible at base, marking deleted
+// characters and placing inserted ones right after their left neighbour
+func (d *Document) integrate(text ot.TextOperation, base, version int) {
+	i, offset := 0, 0
+	for _, c := range text {
+		switch {
+		case c.Retain > 0 || c.Delete > 0:
+			n := c.Retain + c.Delete
+			for ; n > 0; i++ {
+				if !d.nodes[i].visibleAt(base) {
+					continue
+				}
+				if c.Delete > 0 && d.nodes[i].deletedAt == 0 {
+					d.nodes[i].deletedAt = version
+				}
+				n--
+			}
+		case c.Insert != "":
+			runes := []rune(c.Insert)
+			inserted := make([]node, len(runes))
+			for j, r := range runes {
+				inserted[j] = node{id: ID{Seq: version, Offset: offset}, char: r}
+				offset++
+			}
+			d.nodes = append(d.nodes[:i], append(inserted, d.nodes[i:]...)...)
+			i += len(inserted)
+		}
+	}
+}
+
+// effectOf describes what the operation committed as version did to the
+// text of the previous version
+func (d *Document) effectOf(version int) ot.TextOperation {
+	effect := ot.NewTextOperation()
+	for i := range d.nodes {
+		n := &d.nodes[i]
+		switch {
+		case n.id.Seq == version:
+			effect.Insert(string(n.char))
+		case n.deletedAt == version:
+			effect.Delete(1)
+		case n.visibleAt(version):
+			effect.Retain(1)
+		}
+	}
+	return *effect
+}
+
+// visibleText returns the current text
+func (d *Document) visibleText() string {
+	var b strings.Builder
+	for i := range d.nodes {
+		if d.nodes[i].deletedAt == 0 {
+			b.WriteRune(d.nodes[i].char)
+		}
+	}
+	return b.String()
+}
+
+// IDs returns the IDs of the currently visible characters, in order
+func (d *Document) IDs() []ID {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	ids := make([]ID, 0, len(d.nodes))
+	for i := range d.nodes {
+		if d.nodes[i].deletedAt == 0 {
+			ids = append(ids, d.nodes[i].id)
+		}
+	}
+	return ids
+}
+
+// GetCurrentDocument returns the current text
+func (d *Document) GetCurrentDocument() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.text
+}
+
+// GetVersion returns the current version
+func (d *Document) GetVersion() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.version
+}
+
+// Snapshot returns the current text and version together
+func (d *Document) Snapshot() ot.Snapshot {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return ot.Snapshot{Text: d.text, Version: d.version}
+}
+
+// SetSelection records the selection a client made against version and
+// returns it in current offsets. Each end stays right after the character it
+// followed at that version.
+func (d *Document) SetSelection(clientID string, sel ot.Selection, version int) (ot.Selection, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if version > d.version {
+		return ot.Selection{}, ot.ErrFutureVersion
+	}
+	if version < d.base {
+		return ot.Selection{}, &ot.StaleVersionError{Version: version, Oldest: d.base}
+	}
+
+	sel = ot.Selection{
+		Anchor: d.resolve(sel.Anchor, version),
+		Head:   d.resolve(sel.Head, version),
+	}
+	d.selections[clientID] = sel
+	return sel, nil
+}
+
+// resolve maps an offset in the text at base to the current text
+func (d *Document) resolve(offset, base int) int {
+	current := 0
+	for i := 0; i < len(d.nodes) && offset > 0; i++ {
+		if d.nodes[i].deletedAt == 0 {
+			current++
+		}
+		if d.nodes[i].visibleAt(base) {
+			offset--
+		}
+	}
+	return current
+}
+
+// Selections returns the current selection of every client that set one
+func (d *Document) Selections() map[string]ot.Selection {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	selections := make(map[string]ot.Selection, len(d.selections))
+	for clientID, sel := range d.selections {
+		selections[clientID] = sel
+	}
+	return selections
+}
+
+// RemoveClient drops the selection of a client that has left
+func (d *Document) RemoveClient(clientID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.selections, clientID)
+}
@@ -0,0 +1,146 @@
+// Package diff finds the shortest edit script between two sequences using
+// Myers' O(ND) algorithm
+package diff
+
+// MaxEditDistance bounds the work done for very different inputs. Past it
+// the differing middle of the inputs is reported as replaced outright.
+const MaxEditDistance = 1000
+
+// Kind tells what an edit does
+type Kind int
+
+const (
+	Equal Kind = iota
+	Insert
+	Delete
+)
+
+// Edit is a run of elements kept, inserted or deleted. A and B are where the
+// run starts in the old and new sequence.
+type Edit struct {
+	Kind Kind
+	A, B int
+	Len  int
+}
+
+// Diff returns the edits that turn a into b, in order. Equal runs cover the
+// elements kept, Delete runs elements of a and Insert runs elements of b.
+func Diff[T comparable](a, b []T) []Edit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var edits []Edit
+	edits = appendEdit(edits, Edit{Kind: Equal, A: 0, B: 0, Len: prefix})
+	for _, e := range myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]) {
+		e.A += prefix
+		e.B += prefix
+		edits = appendEdit(edits, e)
+	}
+	edits = appendEdit(edits, Edit{Kind: Equal, A: len(a) - suffix, B: len(b) - suffix, Len: suffix})
+	return edits
+}
+
+// appendEdit adds e to edits, merging it into the last edit when they are of
+// the same kind
+func appendEdit(edits []Edit, e Edit) []Edit {
+	if e.Len == 0 {
+		return edits
+	}
+	if n := len(edits); n > 0 && edits[n-1].Kind == e.Kind {
+		edits[n-1].Len += e.Len
+		return edits
+	}
+	return append(edits, e)
+}
+
+// myers finds the shortest edit script between a and b. trace[d] holds the
+// furthest x reached on every diagonal k in [-d, d] after d edits.
+func myers[T comparable](a, b []T) []Edit {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return replace(n, m)
+	}
+
+	offset := n + m
+	v := make([]int, 2*offset+2)
+	var trace [][]int
+	for d := 0; d <= n+m; d++ {
+		if d > MaxEditDistance {
+			return replace(n, m)
+		}
+		done := false
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1] // Down: insert b[y-1]
+			} else {
+				x = v[offset+k-1] + 1 // Right: delete a[x-1]
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			done = done || (x == n && y == m)
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		if done {
+			return backtrack(trace, n, m)
+		}
+	}
+	return replace(n, m)
+}
+
+// backtrack walks the trace from the end back to the start and returns the
+// edits in order
+func backtrack(trace [][]int, n, m int) []Edit {
+	var reversed []Edit
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := prev[prevK+d-1]
+		prevY := prevX - prevK
+
+		// Elements kept after the edit
+		midX, midY := prevX, prevY+1
+		if prevK == k-1 {
+			midX, midY = prevX+1, prevY
+		}
+		reversed = append(reversed, Edit{Kind: Equal, A: midX, B: midY, Len: x - midX})
+		if prevK == k+1 {
+			reversed = append(reversed, Edit{Kind: Insert, A: prevX, B: prevY, Len: 1})
+		} else {
+			reversed = append(reversed, Edit{Kind: Delete, A: prevX, B: prevY, Len: 1})
+		}
+		x, y = prevX, prevY
+	}
+	reversed = append(reversed, Edit{Kind: Equal, A: 0, B: 0, Len: x})
+
+	var edits []Edit
+	for i := len(reversed) - 1; i >= 0; i-- {
+		edits = appendEdit(edits, reversed[i])
+	}
+	return edits
+}
+
+// replace deletes all of a and inserts all of b
+func replace(n, m int) []Edit {
+	var edits []Edit
+	edits = appendEdit(edits, Edit{Kind: Delete, A: 0, B: 0, Len: n})
+	edits = appendEdit(edits, Edit{Kind: Insert, A: n, B: 0, Len: m})
+	return edits
+}
@@ -0,0 +1,92 @@
+package diff
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// apply rebuilds b from a and the edits, checking that they cover both
+// sequences in order
+func apply(t *testing.T, a, b []byte, edits []Edit) []byte {
+	t.Helper()
+	var out []byte
+	i, j := 0, 0
+	for _, e := range edits {
+		if e.A != i || e.B != j {
+			t.Fatalf("edit %+v starts at %d/%d, want %d/%d", e, e.A, e.B, i, j)
+		}
+		switch e.Kind {
+		case Equal:
+			out = append(out, a[i:i+e.Len]...)
+			i += e.Len
+			j += e.Len
+		case Insert:
+			out = append(out, b[j:j+e.Len]...)
+			j += e.Len
+		case Delete:
+			i += e.Len
+		}
+	}
+	if i != len(a) || j != len(b) {
+		t.Fatalf("edits end at %d/%d, want %d/%d", i, j, len(a), len(b))
+	}
+	return out
+}
+
+// lcs returns the length of the longest common subsequence of a and b
+func lcs(a, b []byte) int {
+	prev := make([]int, len(b)+1)
+	for i := range a {
+		cur := make([]int, len(b)+1)
+		for j := range b {
+			if a[i] == b[j] {
+				cur[j+1] = prev[j] + 1
+			} else {
+				cur[j+1] = max(prev[j+1], cur[j])
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	s := make([]byte, n)
+	for i := range s {
+		s[i] = "abc"[r.Intn(3)]
+	}
+	return s
+}
+
+func TestDiffIsMinimal(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		a, b := randomBytes(r, r.Intn(20)), randomBytes(r, r.Intn(20))
+		edits := Diff(a, b)
+		if got := apply(t, a, b, edits); string(got) != string(b) {
+			t.Fatalf("Diff(%q, %q) rebuilds %q", a, b, got)
+		}
+		kept := 0
+		for _, e := range edits {
+			if e.Kind == Equal {
+				kept += e.Len
+			}
+		}
+		if want := lcs(a, b); kept != want {
+			t.Fatalf("Diff(%q, %q) keeps %d elements, want %d", a, b, kept, want)
+		}
+	}
+}
+
+func TestDiffGivesUpOnLargeDistances(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	a, b := randomBytes(r, 5*MaxEditDistance), randomBytes(r, 5*MaxEditDistance)
+	a[0], b[0] = 'x', 'x'
+	edits := Diff(a, b)
+	if got := apply(t, a, b, edits); string(got) != string(b) {
+		t.Fatal("edits do not rebuild b")
+	}
+	if len(edits) != 3 {
+		t.Fatalf("got %d edits, want the common prefix and a replacement", len(edits))
+	}
+}
@@ -0,0 +1,337 @@
+package diff
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// String returns the name of the kind
+func (k Kind) String() string {
+	switch k {
+	case Insert:
+		return "insert"
+	case Delete:
+		return "delete"
+	}
+	return "equal"
+}
+
+// MarshalText encodes the kind by name
+func (k Kind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// Run is a run of runes changed by the same author, "" for runes that did
+// not change
+type Run struct {
+	Author string
+	Length int
+}
+
+// Authors tells who changed two texts being compared: who inserted the
+// runes of the new text and who deleted the runes of the old one, as runs
+// in text order. Either may be nil.
+type Authors struct {
+	Inserted []Run
+	Deleted  []Run
+}
+
+// slice returns the authors of the runes of a part of both texts
+func (a Authors) slice(oldFrom, oldTo, newFrom, newTo int) Authors {
+	return Authors{
+		Inserted: clip(a.Inserted, newFrom, newTo),
+		Deleted:  clip(a.Deleted, oldFrom, oldTo),
+	}
+}
+
+// clip returns the runs of runes [from, to)
+func clip(runs []Run, from, to int) []Run {
+	var clipped []Run
+	start := 0
+	for _, run := range runs {
+		if start >= to {
+			break
+		}
+		end := start + run.Length
+		if lo, hi := max(start, from), min(end, to); lo < hi {
+			run.Length = hi - lo
+			clipped = append(clipped, run)
+		}
+		start = end
+	}
+	return clipped
+}
+
+// collect adds the authors of runes [from, to) to list, skipping those
+// already in it
+func collect(list []string, runs []Run, from, to int) []string {
+	for _, run := range clip(runs, from, to) {
+		if run.Author != "" && !contains(list, run.Author) {
+			list = append(list, run.Author)
+		}
+	}
+	return list
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Line is a line of a hunk, with its newline unless it ends the text
+type Line struct {
+	Kind Kind   `json:"kind"`
+	Text string `json:"text"`
+}
+
+// Hunk is a run of changed lines and the unchanged lines around them
+type Hunk struct {
+	// First line, counted from 1, and number of lines of each text the hunk
+	// covers. A hunk that covers no lines starts after the line it follows.
+	OldStart int `json:"oldStart"`
+	OldLines int `json:"oldLines"`
+	NewStart int `json:"newStart"`
+	NewLines int `json:"newLines"`
+
+	Lines []Line `json:"lines"`
+
+	// Who made the changes, in the order they appear
+	Authors []string `json:"authors,omitempty"`
+
+	// Rune offsets where the hunk starts in each text
+	oldOffset, newOffset int
+}
+
+// splitLines splits text after each newline
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// offsets returns the rune offset of every line and of the end of the text
+func offsets(lines []string) []int {
+	offsets := make([]int, len(lines)+1)
+	for i, line := range lines {
+		offsets[i+1] = offsets[i] + utf8.RuneCountInString(line)
+	}
+	return offsets
+}
+
+// Lines compares two texts line by line and groups the changes into hunks,
+// with up to context unchanged lines around them
+func Lines(a, b string, context int, authors Authors) []Hunk {
+	oldLines, newLines := splitLines(a), splitLines(b)
+	oldOffsets, newOffsets := offsets(oldLines), offsets(newLines)
+
+	// Every line of either text in order, with the line of each text it is
+	// at
+	type entry struct {
+		kind Kind
+		a, b int
+	}
+	var entries []entry
+	for _, e := range Diff(oldLines, newLines) {
+		for i := 0; i < e.Len; i++ {
+			switch e.Kind {
+			case Equal:
+				entries = append(entries, entry{Equal, e.A + i, e.B + i})
+			case Delete:
+				entries = append(entries, entry{Delete, e.A + i, e.B})
+			case Insert:
+				entries = append(entries, entry{Insert, e.A, e.B + i})
+			}
+		}
+	}
+
+	// More context than there are lines cannot show more, and would
+	// overflow below
+	context = min(context, len(entries))
+
+	var hunks []Hunk
+	for i := 0; i < len(entries); i++ {
+		if entries[i].kind == Equal {
+			continue
+		}
+		// Changes with at most twice the context between them share a hunk
+		last := i
+		for j := i; j < len(entries) && j-last <= 2*context+1; j++ {
+			if entries[j].kind != Equal {
+				last = j
+			}
+		}
+		start, end := max(i-context, 0), min(last+context+1, len(entries))
+
+		first := entries[start]
+		hunk := Hunk{
+			OldStart:  first.a + 1,
+			NewStart:  first.b + 1,
+			oldOffset: oldOffsets[first.a],
+			newOffset: newOffsets[first.b],
+		}
+		for _, e := range entries[start:end] {
+			switch e.kind {
+			case Equal:
+				hunk.Lines = append(hunk.Lines, Line{Equal, oldLines[e.a]})
+				hunk.OldLines++
+				hunk.NewLines++
+			case Delete:
+				hunk.Lines = append(hunk.Lines, Line{Delete, oldLines[e.a]})
+				hunk.OldLines++
+				hunk.Authors = collect(hunk.Authors, authors.Deleted, oldOffsets[e.a], oldOffsets[e.a+1])
+			case Insert:
+				hunk.Lines = append(hunk.Lines, Line{Insert, newLines[e.b]})
+				hunk.NewLines++
+				hunk.Authors = collect(hunk.Authors, authors.Inserted, newOffsets[e.b], newOffsets[e.b+1])
+			}
+		}
+		if hunk.OldLines == 0 {
+			hunk.OldStart--
+		}
+		if hunk.NewLines == 0 {
+			hunk.NewStart--
+		}
+		hunks = append(hunks, hunk)
+		i = end - 1
+	}
+	return hunks
+}
+
+// header returns the @@ line of a hunk, naming its authors
+func (h Hunk) header() string {
+	header := fmt.Sprintf("@@ -%d,%d +%d,%d @@", h.OldStart, h.OldLines, h.NewStart, h.NewLines)
+	if len(h.Authors) > 0 {
+		header += " " + strings.Join(h.Authors, ", ")
+	}
+	return header
+}
+
+// Unified renders hunks as a unified diff between files named from and to
+func Unified(hunks []Hunk, from, to string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", from, to)
+	for _, hunk := range hunks {
+		b.WriteString(hunk.header())
+		b.WriteByte('\n')
+		for _, line := range hunk.Lines {
+			b.WriteByte(" +-"[line.Kind])
+			b.WriteString(line.Text)
+			if !strings.HasSuffix(line.Text, "\n") {
+				b.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+	return b.String()
+}
+
+// Span is a run of text kept, inserted or deleted
+type Span struct {
+	Kind    Kind     `json:"kind"`
+	Text    string   `json:"text"`
+	Authors []string `json:"authors,omitempty"` // Who inserted or deleted it
+}
+
+// tokenize splits text into words, runs of whitespace and single other
+// runes, and returns them with the rune offset of each and of the end
+func tokenize(text string) ([]string, []int) {
+	var tokens []string
+	offsets := []int{0}
+	class := func(r rune) int {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_':
+			return 1
+		case unicode.IsSpace(r):
+			return 2
+		}
+		return 0
+	}
+	start, runes := 0, 0
+	prev := -1
+	for i, r := range text {
+		c := class(r)
+		if i > start && (c != prev || c == 0) {
+			tokens = append(tokens, text[start:i])
+			offsets = append(offsets, runes)
+			start = i
+		}
+		prev = c
+		runes++
+	}
+	if start < len(text) {
+		tokens = append(tokens, text[start:])
+		offsets = append(offsets, runes)
+	}
+	return tokens, offsets
+}
+
+// Words compares two texts word by word
+func Words(a, b string, authors Authors) []Span {
+	oldTokens, oldOffsets := tokenize(a)
+	newTokens, newOffsets := tokenize(b)
+
+	var spans []Span
+	for _, e := range Diff(oldTokens, newTokens) {
+		span := Span{Kind: e.Kind}
+		switch e.Kind {
+		case Equal:
+			span.Text = strings.Join(oldTokens[e.A:e.A+e.Len], "")
+		case Delete:
+			span.Text = strings.Join(oldTokens[e.A:e.A+e.Len], "")
+			span.Authors = collect(nil, authors.Deleted, oldOffsets[e.A], oldOffsets[e.A+e.Len])
+		case Insert:
+			span.Text = strings.Join(newTokens[e.B:e.B+e.Len], "")
+			span.Authors = collect(nil, authors.Inserted, newOffsets[e.B], newOffsets[e.B+e.Len])
+		}
+		spans = append(spans, span)
+	}
+	return spans
+}
+
+// HTML renders hunks with the changes in each highlighted word by word:
+// deleted text in <del> and inserted text in <ins>, titled with who made
+// the change
+func HTML(hunks []Hunk, authors Authors) string {
+	var b strings.Builder
+	b.WriteString(`<div class="diff">` + "\n")
+	for _, hunk := range hunks {
+		var oldText, newText strings.Builder
+		for _, line := range hunk.Lines {
+			if line.Kind != Insert {
+				oldText.WriteString(line.Text)
+			}
+			if line.Kind != Delete {
+				newText.WriteString(line.Text)
+			}
+		}
+		oldEnd := hunk.oldOffset + utf8.RuneCountInString(oldText.String())
+		newEnd := hunk.newOffset + utf8.RuneCountInString(newText.String())
+
+		b.WriteString(`<div class="hunk">` + "\n")
+		fmt.Fprintf(&b, `<div class="hunk-header">%s</div>`+"\n", html.EscapeString(hunk.header()))
+		b.WriteString("<pre>")
+		for _, span := range Words(oldText.String(), newText.String(), authors.slice(hunk.oldOffset, oldEnd, hunk.newOffset, newEnd)) {
+			text := html.EscapeString(span.Text)
+			title := html.EscapeString(strings.Join(span.Authors, ", "))
+			switch span.Kind {
+			case Equal:
+				b.WriteString(text)
+			case Insert:
+				fmt.Fprintf(&b, `<ins title="%s">%s</ins>`, title, text)
+			case Delete:
+				fmt.Fprintf(&b, `<del title="%s">%s</del>`, title, text)
+			}
+		}
+		b.WriteString("</pre>\n</div>\n")
+	}
+	b.WriteString("</div>\n")
+	return b.String()
+}
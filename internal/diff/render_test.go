@@ -0,0 +1,90 @@
+package diff
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnified(t *testing.T) {
+	a := "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten"
+	b := "one\n2\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten!"
+
+	// Who inserted each rune of b and deleted each rune of a
+	authors := Authors{
+		Inserted: []Run{{"", 4}, {"alice", 1}, {"", len(b) - 6}, {"bob", 1}}, // The 2 and the !
+		Deleted:  []Run{{"", 4}, {"alice", 1}},                               // The t of two
+	}
+
+	got := Unified(Lines(a, b, 2, authors), "v1", "v2")
+	want := `--- v1
++++ v2
+@@ -1,4 +1,4 @@ alice
+ one
+-two
++2
+ three
+ four
+@@ -8,3 +8,3 @@ bob
+ eight
+ nine
+-ten
+\ No newline at end of file
++ten!
+\ No newline at end of file
+`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// Changes closer than twice the context share a hunk
+	if hunks := Lines(a, b, 4, Authors{}); len(hunks) != 1 {
+		t.Errorf("got %d hunks with 4 lines of context, want 1", len(hunks))
+	}
+	if hunks := Lines("", "new\n", 3, Authors{}); len(hunks) != 1 || hunks[0].OldStart != 0 || hunks[0].NewStart != 1 {
+		t.Errorf("hunks for a new text: %+v", hunks)
+	}
+
+	// Any amount of context shows the whole text at most
+	hunks := Lines(a, b, math.MaxInt, Authors{})
+	if len(hunks) != 1 || !reflect.DeepEqual(hunks, Lines(a, b, 10, Authors{})) {
+		t.Errorf("hunks with the most context: %+v", hunks)
+	}
+}
+
+func TestWords(t *testing.T) {
+	a := "the quick brown fox"
+	b := "the slow brown fox!"
+	authors := Authors{
+		Inserted: []Run{{"", 4}, {"alice", 4}, {"", len(b) - 9}, {"carol", 1}},
+		Deleted:  []Run{{"", 4}, {"bob", 5}, {"", len(a) - 9}},
+	}
+
+	want := []Span{
+		{Kind: Equal, Text: "the "},
+		{Kind: Delete, Text: "quick", Authors: []string{"bob"}},
+		{Kind: Insert, Text: "slow", Authors: []string{"alice"}},
+		{Kind: Equal, Text: " brown fox"},
+		{Kind: Insert, Text: "!", Authors: []string{"carol"}},
+	}
+	if got := Words(a, b, authors); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestHTML(t *testing.T) {
+	a := "# Title\n\nSome <b>text</b>\n"
+	b := "# Title\n\nSome <b>new</b> text\n"
+	authors := Authors{Inserted: []Run{{"alice", len(b)}}}
+
+	got := HTML(Lines(a, b, 3, authors), authors)
+	for _, want := range []string{
+		`<div class="hunk-header">@@ -1,3 +1,3 @@ alice</div>`,
+		`Some &lt;b&gt;<del title="">text</del><ins title="alice">new</ins>&lt;/b&gt;`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%s\ndoes not contain %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package document
+
+import (
+	"fmt"
+
+	"collaborative-markdown-editor/internal/crdt"
+	"collaborative-markdown-editor/internal/ot"
+)
+
+// Document is a shared text document that several clients edit concurrently
+type Document interface {
+	// ApplyOperation integrates an operation a client made against
+	// op.Version and returns its effect on the current text, for broadcast
+	ApplyOperation(op *ot.Operation) (*ot.Operation, error)
+
+	// GetCurrentDocument returns the current text
+	GetCurrentDocument() string
+
+	// GetVersion returns the number of operations applied so far
+	GetVersion() int
+
+	// Snapshot returns the current text and version together
+	Snapshot() ot.Snapshot
+
+	// SetSelection records the selection a client made against version and
+	// returns it in current offsets. Selections follow later operations.
+	SetSelection(clientID string, sel ot.Selection, version int) (ot.Selection, error)
+
+	// Selections returns the current selection of every client that set one
+	Selections() map[string]ot.Selection
+
+	// RemoveClient drops any per-client state kept for a client that has left
+	RemoveClient(clientID string)
+}
+
+// Undoer is implemented by documents that keep per-client undo history
+type Undoer interface {
+	Undo(clientID string) (*ot.Operation, error)
+	Redo(clientID string) (*ot.Operation, error)
+}
+
+// Compactor is implemented by documents that drop history no connected
+// client needs. Operations and selections based on dropped versions fail
+// with *ot.StaleVersionError, and the client has to resync.
+type Compactor interface {
+	// Ack records that a client has seen the document at version
+	Ack(clientID string, version int)
+}
+
+// Replayer is implemented by documents that can list the operations a
+// reconnecting client missed. Versions older than the history kept fail
+// with *ot.StaleVersionError.
+type Replayer interface {
+	OperationsSince(version int) ([]*ot.Operation, error)
+}
+
+// Backend selects a Document implementation
+type Backend string
+
+const (
+	// BackendOT transforms operations against a server-side history
+	BackendOT Backend = "ot"
+
+	// BackendCRDT integrates operations into a sequence CRDT
+	BackendCRDT Backend = "crdt"
+)
+
+// New creates an empty-history document with the given initial text
+func New(backend Backend, initialDoc string) (Document, error) {
+	switch backend {
+	case BackendOT, "":
+		return ot.NewManager(initialDoc), nil
+	case BackendCRDT:
+		return crdt.NewDocument(initialDoc), nil
+	}
+	return nil, fmt.Errorf("unknown document backend %q", backend)
+}
+
+// Load rebuilds a document from a snapshot and the operations committed
+// after it, in the form they were broadcast in
+func Load(backend Backend, snapshot ot.Snapshot, ops []*ot.Operation) (Document, error) {
+	switch backend {
+	case BackendOT, "":
+		m := ot.NewManagerAt(snapshot)
+		for _, op := range ops {
+			if err := m.Replay(op); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case BackendCRDT:
+		d := crdt.NewDocumentAt(snapshot)
+		for _, op := range ops {
+			// A committed operation was based on the version before it
+			based := *op
+			based.Version--
+			if _, err := d.ApplyOperation(&based); err != nil {
+				return nil, fmt.Errorf("replaying version %d: %w", op.Version, err)
+			}
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("unknown document backend %q", backend)
+}
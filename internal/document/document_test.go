@@ -0,0 +1,394 @@
+package document
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"collaborative-markdown-editor/internal/ot"
+	"collaborative-markdown-editor/internal/otclient"
+)
+
+var backends = []Backend{BackendOT, BackendCRDT}
+
+var alphabet = []rune("ab ç€😀\n")
+
+func randomText(r *rand.Rand, n int) string {
+	runes := make([]rune, n)
+	for i := range runes {
+		runes[i] = alphabet[r.Intn(len(alphabet))]
+	}
+	return string(runes)
+}
+
+// randomEdit generates a random operation that applies to doc. kinds limits
+// the components used: "r" retain, "i" insert, "d" delete.
+func randomEdit(r *rand.Rand, doc string, kinds string) ot.TextOperation {
+	remaining := len([]rune(doc))
+	op := ot.NewTextOperation()
+	for remaining > 0 && r.Intn(4) > 0 {
+		n := r.Intn(remaining) + 1
+		switch kinds[r.Intn(len(kinds))] {
+		case 'r':
+			op.Retain(n)
+			remaining -= n
+		case 'i':
+			op.Insert(randomText(r, r.Intn(3)+1))
+		case 'd':
+			op.Delete(min(n, 3))
+			remaining -= min(n, 3)
+		}
+	}
+	if strings.Contains(kinds, "i") && r.Intn(3) == 0 {
+		op.Insert(randomText(r, 2))
+	}
+	return *op
+}
+
+// follower mirrors a document by applying the operations it broadcasts, the
+// way a client without local edits does
+type follower struct {
+	text    string
+	version int
+}
+
+func (f *follower) apply(t *testing.T, op *ot.Operation) {
+	t.Helper()
+	if op.Version != f.version+1 {
+		t.Fatalf("follower at version %d got operation for version %d", f.version, op.Version)
+	}
+	text, err := op.Text().Apply(f.text)
+	if err != nil {
+		t.Fatalf("broadcast %s does not apply to %q: %v", op, f.text, err)
+	}
+	f.text, f.version = text, op.Version
+}
+
+// runConcurrent sends edits made against random recent versions from
+// several clients and returns the document and a follower fed with its
+// broadcasts
+func runConcurrent(t *testing.T, r *rand.Rand, backend Backend, initial, kinds string, edits int) (Document, *follower, []ot.TextOperation) {
+	doc, err := New(backend, initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &follower{text: initial}
+	texts := []string{initial} // Text at every version, for edits against stale versions
+	var sent []ot.TextOperation
+
+	for i := 0; i < edits; i++ {
+		base := len(texts) - 1 - r.Intn(min(len(texts), 4))
+		edit := randomEdit(r, texts[base], kinds)
+		sent = append(sent, edit)
+		op := ot.NewOperation(edit, base, fmt.Sprintf("client%d", r.Intn(3)))
+
+		broadcast, err := doc.ApplyOperation(op)
+		if err != nil {
+			t.Fatalf("%s: apply %s at version %d: %v", backend, op, base, err)
+		}
+		f.apply(t, broadcast)
+		texts = append(texts, doc.GetCurrentDocument())
+	}
+	return doc, f, sent
+}
+
+func TestSequentialEditsMatchDirectApplication(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(string(backend), func(t *testing.T) {
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < 200; i++ {
+				want := randomText(r, r.Intn(10))
+				doc, _ := New(backend, want)
+				for j := 0; j < 20; j++ {
+					edit := randomEdit(r, want, "rid")
+					if _, err := doc.ApplyOperation(ot.NewOperation(edit, doc.GetVersion(), "alice")); err != nil {
+						t.Fatal(err)
+					}
+					want, _ = edit.Apply(want)
+					if got := doc.GetCurrentDocument(); got != want {
+						t.Fatalf("after %s: got %q, want %q", edit, got, want)
+					}
+				}
+				if snapshot := doc.Snapshot(); snapshot.Text != want || snapshot.Version != 20 {
+					t.Fatalf("snapshot %+v does not match %q at version 20", snapshot, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFollowersConvergeUnderConcurrentEdits(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(string(backend), func(t *testing.T) {
+			r := rand.New(rand.NewSource(2))
+			for i := 0; i < 300; i++ {
+				doc, f, _ := runConcurrent(t, r, backend, randomText(r, r.Intn(12)), "rid", 30)
+				if f.text != doc.GetCurrentDocument() || f.version != doc.GetVersion() {
+					t.Fatalf("follower at %q v%d, document at %q v%d", f.text, f.version, doc.GetCurrentDocument(), doc.GetVersion())
+				}
+			}
+		})
+	}
+}
+
+// editor is an OT client of a document with its own text and edits the
+// document has not acknowledged yet, the way a browser is
+type editor struct {
+	client *otclient.Client
+	text   string
+	inbox  []*ot.Operation // Broadcasts on their way to the editor
+}
+
+// edit makes a local edit and returns the operation to send, if any
+func (e *editor) edit(t *testing.T, edit ot.TextOperation) *ot.Operation {
+	t.Helper()
+	text, err := edit.Apply(e.text)
+	if err != nil {
+		t.Fatalf("local edit %s does not apply to %q: %v", edit, e.text, err)
+	}
+	e.text = text
+	return e.client.ApplyLocal(edit)
+}
+
+// receive takes the next broadcast and returns the operation to send next,
+// if any
+func (e *editor) receive(t *testing.T) *ot.Operation {
+	t.Helper()
+	op := e.inbox[0]
+	e.inbox = e.inbox[1:]
+	if op.ClientID == e.client.ID() {
+		next, err := e.client.Ack(op.Version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return next
+	}
+	op = e.client.ApplyRemote(op)
+	text, err := op.Text().Apply(e.text)
+	if err != nil {
+		t.Fatalf("broadcast %s does not apply to %q: %v", op, e.text, err)
+	}
+	e.text = text
+	return nil
+}
+
+func TestEditorsWithEditsInFlightConverge(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(string(backend), func(t *testing.T) {
+			// z's insert reaches the document after a's, at the same place
+			doc, _ := New(backend, "x")
+			a := &editor{client: otclient.New("a", 0), text: "x"}
+			z := &editor{client: otclient.New("z", 0), text: "x"}
+			fromA := a.edit(t, ot.TextOperation{{Retain: 1}, {Insert: "B"}})
+			fromZ := z.edit(t, ot.TextOperation{{Retain: 1}, {Insert: "A"}})
+			for _, op := range []*ot.Operation{fromA, fromZ} {
+				broadcast, err := doc.ApplyOperation(op)
+				if err != nil {
+					t.Fatal(err)
+				}
+				a.inbox = append(a.inbox, broadcast)
+				z.inbox = append(z.inbox, broadcast)
+			}
+			for _, e := range []*editor{a, z} {
+				for len(e.inbox) > 0 {
+					e.receive(t)
+				}
+				if e.text != doc.GetCurrentDocument() {
+					t.Errorf("%s has %q, document has %q", e.client.ID(), e.text, doc.GetCurrentDocument())
+				}
+			}
+
+			r := rand.New(rand.NewSource(6))
+			for i := 0; i < 200; i++ {
+				initial := randomText(r, r.Intn(12))
+				doc, _ := New(backend, initial)
+				editors := make([]*editor, 3)
+				for j := range editors {
+					editors[j] = &editor{client: otclient.New(fmt.Sprintf("client%d", j), 0), text: initial}
+				}
+				var sent []*ot.Operation // Operations on their way to the document
+				busy := func() bool {
+					for _, e := range editors {
+						if len(e.inbox) > 0 {
+							return true
+						}
+					}
+					return len(sent) > 0
+				}
+				for step := 0; step < 60 || busy(); step++ {
+					e := editors[r.Intn(len(editors))]
+					var op *ot.Operation
+					switch {
+					case step < 60 && r.Intn(3) == 0:
+						op = e.edit(t, randomEdit(r, e.text, "rid"))
+					case len(e.inbox) > 0:
+						op = e.receive(t)
+					case len(sent) > 0:
+						broadcast, err := doc.ApplyOperation(sent[0])
+						if err != nil {
+							t.Fatalf("apply %s: %v", sent[0], err)
+						}
+						sent = sent[1:]
+						for _, e := range editors {
+							e.inbox = append(e.inbox, broadcast)
+						}
+					}
+					if op != nil {
+						sent = append(sent, op)
+					}
+				}
+				for _, e := range editors {
+					if e.text != doc.GetCurrentDocument() {
+						t.Fatalf("%s has %q, document has %q", e.client.ID(), e.text, doc.GetCurrentDocument())
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentInsertsAreNeverLost(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(string(backend), func(t *testing.T) {
+			r := rand.New(rand.NewSource(3))
+			for i := 0; i < 300; i++ {
+				initial := randomText(r, r.Intn(12))
+				doc, _, sent := runConcurrent(t, r, backend, initial, "ri", 20)
+
+				want := []rune(initial)
+				for _, edit := range sent {
+					for _, c := range edit {
+						want = append(want, []rune(c.Insert)...)
+					}
+				}
+				if got := sortedRunes(doc.GetCurrentDocument()); got != sortedRunes(string(want)) {
+					t.Fatalf("inserted text lost: got %q from %q", doc.GetCurrentDocument(), initial)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentDeletesOnlyRemoveText(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(string(backend), func(t *testing.T) {
+			r := rand.New(rand.NewSource(4))
+			for i := 0; i < 300; i++ {
+				initial := randomText(r, r.Intn(30))
+				doc, _, _ := runConcurrent(t, r, backend, initial, "rd", 10)
+				if !isSubsequence([]rune(doc.GetCurrentDocument()), []rune(initial)) {
+					t.Fatalf("%q is not a subsequence of %q", doc.GetCurrentDocument(), initial)
+				}
+			}
+		})
+	}
+}
+
+func TestRejectsInvalidOperations(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(string(backend), func(t *testing.T) {
+			doc, _ := New(backend, "abc")
+			for _, op := range []*ot.Operation{
+				ot.NewInsertOperation(0, "x", 1, "alice"),
+				ot.NewDeleteOperation(2, 5, 0, "alice"),
+				ot.NewInsertOperation(4, "x", 0, "alice"),
+			} {
+				if _, err := doc.ApplyOperation(op); err == nil {
+					t.Errorf("%s accepted", op)
+				}
+			}
+			if doc.GetCurrentDocument() != "abc" || doc.GetVersion() != 0 {
+				t.Errorf("rejected operations changed the document to %q v%d", doc.GetCurrentDocument(), doc.GetVersion())
+			}
+		})
+	}
+}
+
+func TestSelectionsFollowEdits(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(string(backend), func(t *testing.T) {
+			doc, _ := New(backend, "hello world")
+			// Alice selects "world", then Bob edits before it
+			if _, err := doc.SetSelection("alice", ot.Selection{Anchor: 6, Head: 11}, 0); err != nil {
+				t.Fatal(err)
+			}
+			doc.ApplyOperation(ot.NewInsertOperation(0, "# ", 0, "bob"))
+			doc.ApplyOperation(ot.NewDeleteOperation(2, 6, 1, "bob"))
+			// Carol's cursor was set against the original text, before "world"
+			carol, err := doc.SetSelection("carol", ot.Cursor(6), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			text := []rune(doc.GetCurrentDocument())
+			alice := doc.Selections()["alice"]
+			if got := string(text[alice.Anchor:alice.Head]); got != "world" {
+				t.Errorf("alice's selection covers %q in %q, want %q", got, string(text), "world")
+			}
+			if got := string(text[carol.Head:]); got != "world" {
+				t.Errorf("carol's cursor is before %q in %q, want %q", got, string(text), "world")
+			}
+
+			doc.RemoveClient("alice")
+			if _, ok := doc.Selections()["alice"]; ok {
+				t.Error("selection kept after the client left")
+			}
+		})
+	}
+}
+
+func sortedRunes(s string) string {
+	runes := []rune(s)
+	sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+	return string(runes)
+}
+
+func isSubsequence(sub, of []rune) bool {
+	i := 0
+	for _, r := range of {
+		if i < len(sub) && sub[i] == r {
+			i++
+		}
+	}
+	return i == len(sub)
+}
+
+func TestLoadRebuildsTheDocument(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(string(backend), func(t *testing.T) {
+			r := rand.New(rand.NewSource(7))
+			for i := 0; i < 50; i++ {
+				doc, _ := New(backend, randomText(r, r.Intn(10)))
+				var snapshot ot.Snapshot
+				var broadcasts []*ot.Operation
+				for j := 0; j < 20; j++ {
+					if j == 10 {
+						snapshot, broadcasts = doc.Snapshot(), nil
+					}
+					edit := randomEdit(r, doc.GetCurrentDocument(), "rid")
+					op, err := doc.ApplyOperation(ot.NewOperation(edit, doc.GetVersion(), fmt.Sprintf("client%d", r.Intn(3))))
+					if err != nil {
+						t.Fatal(err)
+					}
+					broadcasts = append(broadcasts, op)
+				}
+
+				loaded, err := Load(backend, snapshot, broadcasts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := loaded.Snapshot(), doc.Snapshot(); got != want {
+					t.Fatalf("loaded %+v, want %+v", got, want)
+				}
+				stale := ot.NewInsertOperation(0, "x", snapshot.Version-1, "alice")
+				var staleErr *ot.StaleVersionError
+				if _, err := loaded.ApplyOperation(stale); !errors.As(err, &staleErr) {
+					t.Fatalf("operation from before the snapshot: got %v, want a stale version error", err)
+				}
+			}
+		})
+	}
+}
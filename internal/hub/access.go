@@ -0,0 +1,236 @@
+package hub
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"collaborative-markdown-editor/internal/acl"
+	"collaborative-markdown-editor/internal/client"
+	"collaborative-markdown-editor/internal/document"
+	"collaborative-markdown-editor/internal/protocol"
+	"collaborative-markdown-editor/internal/storage"
+)
+
+// accessRequest asks a room to change who may do what in it
+type accessRequest struct {
+	change func(*acl.ACL) error
+	result chan accessResult
+}
+
+type accessResult struct {
+	acl acl.ACL
+	err error
+}
+
+// SetDefaultLinkRole sets what anyone with its link may do in a room whose
+// owner has not said otherwise, including rooms from before rooms had
+// owners. It must be called before clients register.
+func (h *Hub) SetDefaultLinkRole(role acl.Role) {
+	h.defaultLinkRole = role
+}
+
+// loadMetadata returns what the store has of a room besides its text, with
+// the default link role for rooms it has nothing of, and whether it had
+// anything
+func (h *Hub) loadMetadata(roomID string) (storage.Metadata, bool, error) {
+	metadata, err := h.store.Metadata(roomID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return storage.Metadata{ACL: acl.ACL{Link: h.defaultLinkRole}}, false, nil
+	}
+	return metadata, err == nil, err
+}
+
+// ACL returns who may do what in a room
+func (h *Hub) ACL(roomID string) (acl.ACL, error) {
+	if r := h.room(roomID); r != nil {
+		return r.acl(), nil
+	}
+	metadata, _, err := h.loadMetadata(roomID)
+	return metadata.ACL, err
+}
+
+// Role returns what a user may do in a room
+func (h *Hub) Role(roomID, userID string) (acl.Role, error) {
+	a, err := h.ACL(roomID)
+	if err != nil {
+		return acl.None, err
+	}
+	return a.RoleOf(userID), nil
+}
+
+// Claim returns what a user may do in a room, making them its owner if it
+// is new. Rooms are claimed by whoever opens them first; rooms the store
+// already had without an owner, such as rooms from before rooms had owners,
+// are left for an operator to assign.
+func (h *Hub) Claim(roomID, userID string) (acl.Role, error) {
+	return h.ClaimWithBackend(roomID, userID, "")
+}
+
+// ClaimWithBackend claims a room like Claim, creating it with the given
+// document backend if it does not exist yet
+func (h *Hub) ClaimWithBackend(roomID, userID string, backend document.Backend) (acl.Role, error) {
+	a, err := h.ACL(roomID)
+	if err != nil || userID == "" || a.HasOwner() {
+		return a.RoleOf(userID), err
+	}
+	r := h.openRoom(roomID, backend)
+	a, err = h.changeRoomACL(r, func(a *acl.ACL) error {
+		if a.HasOwner() || !r.claimable {
+			// Someone else got there first, or the room is not new
+			return nil
+		}
+		log.Printf("User %s owns room %s", userID, roomID)
+		return a.Grant(userID, acl.Owner)
+	})
+	return a.RoleOf(userID), err
+}
+
+// Grant gives a user a role in a room, replacing the one they had
+func (h *Hub) Grant(roomID, userID string, role acl.Role) error {
+	_, err := h.changeACL(roomID, func(a *acl.ACL) error {
+		return a.Grant(userID, role)
+	})
+	return err
+}
+
+// Revoke takes away the role a user was given in a room
+func (h *Hub) Revoke(roomID, userID string) error {
+	_, err := h.changeACL(roomID, func(a *acl.ACL) error {
+		return a.Revoke(userID)
+	})
+	return err
+}
+
+// SetLinkRole sets what anyone with a room's link may do
+func (h *Hub) SetLinkRole(roomID string, role acl.Role) error {
+	_, err := h.changeACL(roomID, func(a *acl.ACL) error {
+		return a.SetLink(role)
+	})
+	return err
+}
+
+// AddShareLink hands out a share link to a room
+func (h *Hub) AddShareLink(roomID string, link acl.ShareLink) error {
+	_, err := h.changeACL(roomID, func(a *acl.ACL) error {
+		return a.AddShareLink(link)
+	})
+	return err
+}
+
+// RevokeShareLink takes back a share link to a room. Clients who could only
+// see the room through it are dropped.
+func (h *Hub) RevokeShareLink(roomID, linkID string) error {
+	_, err := h.changeACL(roomID, func(a *acl.ACL) error {
+		return a.RevokeShareLink(linkID)
+	})
+	return err
+}
+
+// OpenShareLink lets a user into a room with a share link and returns the
+// role it gives them. The link is used up once for each user who opens it.
+func (h *Hub) OpenShareLink(roomID, linkID, userID string) (acl.Role, error) {
+	a, err := h.ACL(roomID)
+	if err != nil {
+		return acl.None, err
+	}
+	now := time.Now()
+	role, first, err := a.OpenShareLink(linkID, userID, now)
+	if err != nil || !first {
+		// Users coming back through the link change nothing
+		return role, err
+	}
+	_, err = h.changeACL(roomID, func(a *acl.ACL) error {
+		var err error
+		role, _, err = a.OpenShareLink(linkID, userID, now)
+		return err
+	})
+	return role, err
+}
+
+// ShareLinkRole returns the role a share link would give a user, without
+// using the link up
+func (h *Hub) ShareLinkRole(roomID, linkID, userID string) (acl.Role, error) {
+	a, err := h.ACL(roomID)
+	if err != nil {
+		return acl.None, err
+	}
+	role, _, err := a.OpenShareLink(linkID, userID, time.Now())
+	return role, err
+}
+
+// changeACL has a room change its ACL and returns the result. Changes go
+// through the room so that its clients follow them.
+func (h *Hub) changeACL(roomID string, change func(*acl.ACL) error) (acl.ACL, error) {
+	return h.changeRoomACL(h.openRoom(roomID, ""), change)
+}
+
+// changeRoomACL has a room the caller acquired change its ACL
+func (h *Hub) changeRoomACL(r *room, change func(*acl.ACL) error) (acl.ACL, error) {
+	result := make(chan accessResult, 1)
+	h.post(r, accessRequest{change: change, result: result})
+	changed := <-result
+	return changed.acl, changed.err
+}
+
+// acl returns who may do what in the room
+func (r *room) acl() acl.ACL {
+	r.metadataMu.Lock()
+	defer r.metadataMu.Unlock()
+	return r.metadata.ACL.Clone()
+}
+
+// roleOf returns what a client may do in the room
+func (r *room) roleOf(c *client.Client) acl.Role {
+	r.metadataMu.Lock()
+	defer r.metadataMu.Unlock()
+	return r.metadata.ACL.RoleOf(c.User.ID)
+}
+
+// changeACL saves a change to the room's ACL, then tells its clients what
+// they may do now and drops those who may no longer see the room
+func (r *room) changeACL(change func(*acl.ACL) error) (acl.ACL, error) {
+	if r.store == nil {
+		return acl.ACL{}, errors.New("the room is not saved")
+	}
+	r.metadataMu.Lock()
+	metadata := r.metadata
+	metadata.ACL = metadata.ACL.Clone()
+	r.metadataMu.Unlock()
+	if err := change(&metadata.ACL); err != nil {
+		return acl.ACL{}, err
+	}
+	if err := r.store.SaveMetadata(r.id, metadata); err != nil {
+		return acl.ACL{}, err
+	}
+	r.metadataMu.Lock()
+	r.metadata = metadata
+	r.metadataMu.Unlock()
+	r.reviewRoles()
+	return metadata.ACL.Clone(), nil
+}
+
+// reviewRoles tells the clients whose role changed what they may do now,
+// and drops those who may no longer see the room
+func (r *room) reviewRoles() {
+	for c, told := range r.clients {
+		role := r.roleOf(c)
+		switch {
+		case role == told:
+		case !role.CanView():
+			r.reject(c)
+		default:
+			r.clients[c] = role
+			r.send(c, protocol.MustEncode(protocol.TypeAccess, protocol.Access{Role: role}))
+		}
+	}
+}
+
+// reject tells a client it may not be in the room and drops it, whether it
+// registered or not
+func (r *room) reject(c *client.Client) {
+	log.Printf("Client %s may not be in room %s", c.ID, r.id)
+	r.send(c, protocol.MustEncode(protocol.TypeAccess, protocol.Access{Role: acl.None}))
+	r.unregister(c)
+	c.Send.Close()
+}
@@ -0,0 +1,136 @@
+package hub
+
+import (
+	"errors"
+	"time"
+
+	"collaborative-markdown-editor/internal/ot"
+	"collaborative-markdown-editor/internal/storage"
+	"collaborative-markdown-editor/internal/user"
+)
+
+// restoreClientID is the client ID of operations that restore a past
+// version
+const restoreClientID = "restore"
+
+// restoreRequest asks a room to bring its document back to the text it had
+// at a version
+type restoreRequest struct {
+	version int
+	author  user.User
+	result  chan restoreResult
+}
+
+type restoreResult struct {
+	version int
+	err     error
+}
+
+// History returns every version of a room, oldest first
+func (h *Hub) History(roomID string) ([]storage.Record, error) {
+	return h.store.History(roomID)
+}
+
+// TextAt returns the text a room had at a version
+func (h *Hub) TextAt(roomID string, version int) (string, error) {
+	return storage.TextAt(h.store, roomID, version)
+}
+
+// Authorship returns the text a room had at a version and who wrote each
+// rune of it. A negative version stands for the latest one.
+func (h *Hub) Authorship(roomID string, version int) (string, *ot.Authorship, error) {
+	if version < 0 {
+		var err error
+		if version, err = h.latestVersion(roomID); err != nil {
+			return "", nil, err
+		}
+	}
+	return storage.AuthorshipAt(h.store, roomID, version)
+}
+
+// Checkpoints returns the named versions of a room, oldest first
+func (h *Hub) Checkpoints(roomID string) ([]storage.Checkpoint, error) {
+	return h.store.Checkpoints(roomID)
+}
+
+// latestVersion returns the version a room's log reaches
+func (h *Hub) latestVersion(roomID string) (int, error) {
+	snapshot, records, err := h.store.Load(roomID)
+	if err != nil {
+		return 0, err
+	}
+	return snapshot.Version + len(records), nil
+}
+
+// AddCheckpoint names a version of a room. A negative version names the
+// latest one.
+func (h *Hub) AddCheckpoint(roomID, name string, version int, author string) (storage.Checkpoint, error) {
+	if version < 0 {
+		var err error
+		if version, err = h.latestVersion(roomID); err != nil {
+			return storage.Checkpoint{}, err
+		}
+	}
+	checkpoint := storage.Checkpoint{
+		Name:    name,
+		Version: version,
+		Author:  author,
+		Time:    time.Now(),
+	}
+	return checkpoint, h.store.AddCheckpoint(roomID, checkpoint)
+}
+
+// Changes returns what changed in a room between two versions and who
+// changed it. A negative to stands for the latest version.
+func (h *Hub) Changes(roomID string, from, to int) (*storage.Changes, error) {
+	if to < 0 {
+		var err error
+		if to, err = h.latestVersion(roomID); err != nil {
+			return nil, err
+		}
+	}
+	return storage.ChangesBetween(h.store, roomID, from, to)
+}
+
+// Restore brings a room back to the text it had at a version. The change is
+// committed as a new operation, so connected clients follow it like any
+// other edit. It returns the version the restore became. An author without
+// an ID is only known by their name.
+func (h *Hub) Restore(roomID string, version int, author user.User) (int, error) {
+	if _, _, err := h.store.Load(roomID); err != nil {
+		return 0, err
+	}
+	result := make(chan restoreResult, 1)
+	h.post(h.openRoom(roomID, ""), restoreRequest{version: version, author: author, result: result})
+	restored := <-result
+	return restored.version, restored.err
+}
+
+// restore commits the operation that turns the document back into the text
+// it had at a version, and returns the version that operation became
+func (r *room) restore(version int, author user.User) (int, error) {
+	if r.store == nil {
+		return 0, errors.New("the room is not saved")
+	}
+	text, err := storage.TextAt(r.store, r.id, version)
+	if err != nil {
+		return 0, err
+	}
+
+	current := r.doc.Snapshot()
+	edit := ot.Diff(current.Text, text)
+	if edit.IsNoop() {
+		return current.Version, nil
+	}
+	op, err := r.doc.ApplyOperation(ot.NewOperation(edit, current.Version, restoreClientID))
+	// Nobody is going to undo the restore or acknowledge versions for it
+	r.doc.RemoveClient(restoreClientID)
+	if err != nil {
+		return 0, err
+	}
+	if author.ID == "" {
+		author.ID = restoreClientID
+	}
+	r.publish(op, author, false)
+	return op.Version, nil
+}
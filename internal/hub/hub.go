@@ -1,12 +1,16 @@
 package hub
 
 import (
-	"encoding/json"
+	"errors"
 	"log"
+	"sync"
 	"time"
 
+	"collaborative-markdown-editor/internal/acl"
 	"collaborative-markdown-editor/internal/client"
+	"collaborative-markdown-editor/internal/document"
 	"collaborative-markdown-editor/internal/ot"
+	"collaborative-markdown-editor/internal/storage"
 	"collaborative-markdown-editor/internal/user"
 )
 
@@ -14,241 +18,292 @@ import (
 type RegisterRequest struct {
 	Client *client.Client
 	RoomID string
+
+	// Document backend to use if the room has to be created. Empty selects
+	// the hub's default. Rooms that exist keep the backend they have.
+	Backend document.Backend
+
+	// Resume replays what a reconnecting client missed since the version
+	// it last saw, instead of starting it over
+	Resume bool
 }
 
-// Hub maintains the set of active clients and broadcasts messages to the
-// clients in each room.
+// Hub routes clients and their messages to rooms. Each room runs on its
+// own goroutine; the hub only creates rooms and keeps them going.
 type Hub struct {
-	// Registered clients organized by room ID
-	rooms map[string]map[*client.Client]bool
+	// Rooms by ID, guarded by mu
+	rooms map[string]*room
+	mu    sync.RWMutex
 
-	// OT managers for each room
-	otManagers map[string]*ot.Manager
+	// Backend for rooms created without an explicit choice
+	defaultBackend document.Backend
 
-	// User manager
-	userManager *user.UserManager
+	// Where rooms are loaded from and their operations saved to
+	store storage.Store
 
-	// Inbound messages from the clients
-	broadcast chan client.Message
+	// What happens to rooms without clients
+	lifecycle Lifecycle
 
-	// Register requests from the clients
-	register chan RegisterRequest
+	// What anyone with its link may do in a room whose owner has not said
+	defaultLinkRole acl.Role
 
-	// Unregister requests from clients
-	unregister chan *client.Client
+	// User manager
+	userManager *user.UserManager
 }
 
 // NewHub creates a new hub instance
 func NewHub() *Hub {
 	return &Hub{
-		broadcast:    make(chan client.Message),
-		register:     make(chan RegisterRequest),
-		unregister:   make(chan *client.Client),
-		rooms:        make(map[string]map[*client.Client]bool),
-		otManagers:   make(map[string]*ot.Manager),
-		userManager:  user.NewUserManager(),
+		rooms:           make(map[string]*room),
+		defaultBackend:  document.BackendOT,
+		store:           storage.NewMemoryStore(),
+		lifecycle:       Lifecycle{IdleTimeout: DefaultIdleTimeout},
+		defaultLinkRole: acl.Editor,
+		userManager:     user.NewUserManager(),
 	}
 }
 
-// Run starts the hub and handles client registration, unregistration, and message broadcasting
+// Run looks after the rooms: it has them expire the sessions of clients
+// that did not come back, and logs how often slow clients had to be caught
+// up
 func (h *Hub) Run() {
-	for {
-		select {
-		case request := <-h.register:
-			// Initialize room if it doesn't exist
-			if h.rooms[request.RoomID] == nil {
-				h.rooms[request.RoomID] = make(map[*client.Client]bool)
-				// Create OT manager for new room
-				h.otManagers[request.RoomID] = ot.NewManager("")
-			}
-			// Add client to the room
-			h.rooms[request.RoomID][request.Client] = true
-			log.Printf("Client registered in room %s. Total clients in room: %d", request.RoomID, len(h.rooms[request.RoomID]))
-
-			// Broadcast updated user list to all clients in the room
-			h.broadcastUserList(request.RoomID)
-
-		case client := <-h.unregister:
-			// Remove client from all rooms
-			for roomID, clients := range h.rooms {
-				if _, ok := clients[client]; ok {
-					delete(clients, client)
-					close(client.Send)
-					log.Printf("Client unregistered from room %s. Remaining clients: %d", roomID, len(clients))
-
-					// Broadcast updated user list to all remaining clients in the room
-					h.broadcastUserList(roomID)
-
-					// Clean up empty rooms
-					if len(clients) == 0 {
-						delete(h.rooms, roomID)
-						log.Printf("Room %s deleted (empty)", roomID)
-					}
-					break
-				}
-			}
+	sessionTicker := time.NewTicker(time.Minute)
+	defer sessionTicker.Stop()
 
-		case message := <-h.broadcast:
-			// Process the message with OT manager
-			if otManager, ok := h.otManagers[message.RoomID]; ok {
-				msgContent := string(message.Content)
-
-				// Check if this is a JSON operation or plain content
-				if len(msgContent) > 0 && msgContent[0] == "{" {
-					// JSON operation
-					operation, err := ot.OperationFromJSON(message.Content)
-					if err != nil {
-						log.Printf("Failed to parse operation: %v", err)
-						continue
-					}
-
-					// Apply the operation
-					transformedOp, err := otManager.ApplyOperation(operation)
-					if err != nil {
-						log.Printf("Failed to apply operation: %v", err)
-						continue
-					}
-
-					if transformedOp == nil {
-						// Operation was cancelled due to conflicts
-						continue
-					}
-
-					// Broadcast the transformed operation to all clients in the room except sender
-					if clients, ok := h.rooms[message.RoomID]; ok {
-						transformedJSON, _ := transformedOp.ToJSON()
-						for client := range clients {
-							if client.ID != message.ClientID {
-								select {
-								case client.Send <- transformedJSON:
-								default:
-									// Client's send channel is full or closed, remove client
-									close(client.Send)
-									delete(clients, client)
-								}
-							}
-						}
-					}
-
-					// Update cursor position for the user who made the change
-					if user, exists := h.userManager.GetUser(message.ClientID); exists {
-						user.CursorPos = operation.Position + len(operation.Character)
-						user.LastSeen = time.Now()
-					}
-				} else {
-					// Plain text content
-					otManager.SetCurrentDocument(msgContent)
-
-					// Broadcast the plain content to all clients in the room except sender
-					if clients, ok := h.rooms[message.RoomID]; ok {
-						for client := range clients {
-							if client.ID != message.ClientID {
-								select {
-								case client.Send <- message.Content:
-								default:
-									// Client's send channel is full or closed, remove client
-									close(client.Send)
-									delete(clients, client)
-								}
-							}
-						}
-					}
-
-					// Update cursor position for the user who made the change
-					if user, exists := h.userManager.GetUser(message.ClientID); exists {
-						user.CursorPos = len(msgContent)
-						user.LastSeen = time.Now()
-					}
-				}
+	var reported client.Stats
+	for now := range sessionTicker.C {
+		for _, r := range h.allRooms() {
+			select {
+			case r.inbox <- expireRequest{now: now}:
+			default:
+				// The room is busy; it will catch up on the next tick
 			}
 		}
+		if stats := client.TotalStats(); stats != reported {
+			log.Printf("Slow clients so far: %d messages coalesced, %d dropped for %d resyncs",
+				stats.Coalesced, stats.Dropped, stats.Resyncs)
+			reported = stats
+		}
+	}
+}
+
+// room returns the room with the given ID, or nil
+func (h *Hub) room(roomID string) *room {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.rooms[roomID]
+}
+
+// acquire returns the room with the given ID, or nil, and keeps it from
+// being evicted until the caller sends it an event with post
+func (h *Hub) acquire(roomID string) *room {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	r := h.rooms[roomID]
+	if r != nil {
+		r.senders.Add(1)
+	}
+	return r
+}
+
+// post sends an event to a room the caller acquired
+func (h *Hub) post(r *room, event interface{}) {
+	r.inbox <- event
+	r.senders.Add(-1)
+}
+
+// closeRoom removes an idle room from the hub, unless an event for it is
+// on its way. It returns whether the room was removed.
+func (h *Hub) closeRoom(r *room) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// Rooms are only acquired under the lock, so neither count can grow
+	// while it is held
+	if r.senders.Load() > 0 || len(r.inbox) > 0 {
+		return false
+	}
+	delete(h.rooms, r.id)
+	return true
+}
+
+// allRooms returns every room
+func (h *Hub) allRooms() []*room {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	rooms := make([]*room, 0, len(h.rooms))
+	for _, r := range h.rooms {
+		rooms = append(rooms, r)
 	}
+	return rooms
 }
 
-// GetRoomContent returns the current content of a room from OT manager
+// openRoom acquires the room with the given ID, loading its document from
+// the store and starting its goroutine if it is not open yet. A room that
+// does not exist yet is created with the given backend.
+func (h *Hub) openRoom(roomID string, backend document.Backend) *room {
+	if r := h.acquire(roomID); r != nil {
+		return r
+	}
+
+	// Load outside the lock so that a slow store only holds up this room.
+	// If another request opens it meanwhile, its document wins.
+	metadata, found, err := h.loadMetadata(roomID)
+	doc, backend, authorship, store := h.loadDocument(roomID, backend, metadata.Backend)
+	// Only a room the store had nothing of may be claimed. Stored rooms
+	// without metadata have a log, so their version is not 0.
+	claimable := err == nil && !found && doc.GetVersion() == 0
+	if err != nil {
+		// Nobody may open a room whose ACL is unknown
+		log.Printf("Failed to load metadata of room %s: %v, locking it", roomID, err)
+		metadata, store = storage.Metadata{}, nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, ok := h.rooms[roomID]
+	if !ok {
+		r = newRoom(h, roomID, doc, authorship, store, metadata)
+		r.claimable = claimable
+		h.rooms[roomID] = r
+		go r.run(backend)
+	}
+	r.senders.Add(1)
+	return r
+}
+
+// loadDocument rebuilds a room's document and who wrote it from the store
+// with the backend saved for it, or creates an empty one for a new room
+// with the backend asked for. It also returns the backend of the document
+// and the store the room should save to, which is nil if the stored room
+// could not be loaded, so that it is not overwritten.
+func (h *Hub) loadDocument(roomID string, requested, saved document.Backend) (document.Document, document.Backend, *ot.Authorship, storage.Store) {
+	backend := saved
+	store := h.store
+	snapshot, records, err := store.Load(roomID)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		if backend == "" {
+			backend = requested
+		}
+	case err != nil:
+		log.Printf("Failed to load room %s: %v, starting it empty without saving it", roomID, err)
+		snapshot, records, store = storage.Snapshot{}, nil, nil
+	}
+	if backend == "" {
+		backend = h.defaultBackend
+	}
+
+	authorship := snapshot.Authorship()
+	ops := make([]*ot.Operation, len(records))
+	for i, record := range records {
+		ops[i] = record.Op
+		if err := authorship.Apply(record.Op, record.AuthorID()); err != nil {
+			log.Printf("Failed to replay who wrote room %s: %v", roomID, err)
+			authorship = nil
+			break
+		}
+	}
+	doc, err := document.Load(backend, snapshot.Snapshot, ops)
+	if err != nil && backend != h.defaultBackend {
+		log.Printf("Failed to create document for room %s: %v, using %s", roomID, err, h.defaultBackend)
+		backend = h.defaultBackend
+		doc, err = document.Load(backend, snapshot.Snapshot, ops)
+	}
+	if err != nil {
+		log.Printf("Failed to replay room %s: %v, starting it empty without saving it", roomID, err)
+		backend = h.defaultBackend
+		doc, _ = document.New(backend, "")
+		store, authorship = nil, nil
+	}
+	if authorship == nil {
+		authorship = ot.Unattributed(doc.GetCurrentDocument())
+	}
+	return doc, backend, authorship, store
+}
+
+// GetRoomContent returns the current content of a room's document
 func (h *Hub) GetRoomContent(roomID string) string {
-	if otManager, ok := h.otManagers[roomID]; ok {
-		return otManager.GetCurrentDocument()
+	if r := h.room(roomID); r != nil {
+		return r.doc.GetCurrentDocument()
 	}
 	return ""
 }
 
+// SetDefaultBackend selects the document backend for rooms created without
+// an explicit choice. It must be called before clients register.
+func (h *Hub) SetDefaultBackend(backend document.Backend) {
+	h.defaultBackend = backend
+}
+
+// SetLifecycle configures what happens to rooms without clients. It must be
+// called before clients register.
+func (h *Hub) SetLifecycle(lifecycle Lifecycle) {
+	h.lifecycle = lifecycle
+}
+
+// SetStore selects where rooms are loaded from and saved to. It must be
+// called before clients register.
+func (h *Hub) SetStore(store storage.Store) {
+	h.store = store
+}
+
 // GetUserManager returns the user manager
 func (h *Hub) GetUserManager() *user.UserManager {
 	return h.userManager
 }
 
 // GetRoomUsers returns all users in a room
-func (h *Hub) GetRoomUsers(roomID string) map[string]*user.User {
+func (h *Hub) GetRoomUsers(roomID string) map[string]user.User {
 	return h.userManager.GetRoomUsers(roomID)
 }
 
+// LookupSession returns the user and latest connection of the session a
+// client reconnects to a room with
+func (h *Hub) LookupSession(roomID, token string) (user.User, *client.Client, bool) {
+	r := h.room(roomID)
+	if r == nil {
+		return user.User{}, nil, false
+	}
+	return r.lookupSession(token)
+}
+
 // Register adds a client to the hub
 func (h *Hub) Register(client *client.Client) {
-	request := RegisterRequest{
+	h.RegisterWithBackend(client, "")
+}
+
+// Resume adds a reconnecting client to the hub and sends it the operations
+// it missed since c.Version()
+func (h *Hub) Resume(client *client.Client) {
+	h.post(h.openRoom(client.RoomID, ""), RegisterRequest{
 		Client: client,
 		RoomID: client.RoomID,
+		Resume: true,
+	})
+}
+
+// RegisterWithBackend adds a client to the hub, creating its room with the
+// given document backend if the room does not exist yet. Rooms that exist
+// keep the backend they were created with.
+func (h *Hub) RegisterWithBackend(client *client.Client, backend document.Backend) {
+	request := RegisterRequest{
+		Client:  client,
+		RoomID:  client.RoomID,
+		Backend: backend,
 	}
-	h.register <- request
+	h.post(h.openRoom(request.RoomID, backend), request)
 }
 
-// Broadcast sends a message to all clients in a room except the sender
+// Broadcast hands a message from a client to its room
 func (h *Hub) Broadcast(msg client.Message) {
-	h.broadcast <- msg
+	if r := h.acquire(msg.RoomID); r != nil {
+		h.post(r, msg)
+	}
 }
 
-// Unregister removes a client from the hub
+// Unregister removes a client from its room
 func (h *Hub) Unregister(client *client.Client) {
-	h.unregister <- client
-}
-
-// broadcastUserList sends the current user list to all clients in a room
-func (h *Hub) broadcastUserList(roomID string) {
-	if clients, ok := h.rooms[roomID]; ok {
-		roomUsers := h.userManager.GetRoomUsers(roomID)
-
-		// Convert users to a simple format for JSON
-		type UserInfo struct {
-			ID       string `json:"id"`
-			Username string `json:"username"`
-			Color    string `json:"color"`
-		}
-
-		var userList []UserInfo
-		for _, user := range roomUsers {
-			userList = append(userList, UserInfo{
-				ID:       user.ID,
-				Username: user.Username,
-				Color:    user.Color,
-			})
-		}
-
-		// Create a special message type for user list updates
-		type UserListMessage struct {
-			Type string     `json:"type"`
-			Users []UserInfo `json:"users"`
-		}
-
-		userListMsg := UserListMessage{
-			Type: "userList",
-			Users: userList,
-		}
-
-		jsonData, err := json.Marshal(userListMsg)
-		if err != nil {
-			log.Printf("Failed to marshal user list: %v", err)
-			return
-		}
-
-		// Send to all clients in the room
-		for client := range clients {
-			select {
-			case client.Send <- jsonData:
-			default:
-				// Client's send channel is full or closed, remove client
-				close(client.Send)
-				delete(clients, client)
-			}
-		}
+	if r := h.acquire(client.RoomID); r != nil {
+		h.post(r, unregisterRequest{client: client})
 	}
 }
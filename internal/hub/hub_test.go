@@ -0,0 +1,863 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"collaborative-markdown-editor/internal/acl"
+	"collaborative-markdown-editor/internal/client"
+	"collaborative-markdown-editor/internal/crdt"
+	"collaborative-markdown-editor/internal/document"
+	"collaborative-markdown-editor/internal/ot"
+	"collaborative-markdown-editor/internal/protocol"
+	"collaborative-markdown-editor/internal/storage"
+	"collaborative-markdown-editor/internal/user"
+
+	"github.com/gorilla/websocket"
+)
+
+// peer is a client without a connection. It drains what the hub sends it
+// and remembers the latest version it saw.
+type peer struct {
+	c       *client.Client
+	version atomic.Int64
+	acks    *sync.WaitGroup
+	ops     atomic.Int64
+	authors atomic.Pointer[[]ot.Span] // Sent in init
+	role    atomic.Int32              // Sent in init and access
+	refused atomic.Int64              // Edits refused for the peer's role
+	done    chan struct{}             // Closed once the room closed Send
+}
+
+func newPeer(h *Hub, roomID string, id int, acks *sync.WaitGroup) *peer {
+	clientID := fmt.Sprintf("%s-%d", roomID, id)
+	u := h.GetUserManager().CreateUser(clientID, clientID)
+	p := &peer{c: client.NewClient(nil, roomID, clientID, u), acks: acks, done: make(chan struct{})}
+	// Init counts as the acknowledgement of joining
+	acks.Add(1)
+	go p.drain()
+	h.Register(p.c)
+	return p
+}
+
+func (p *peer) drain() {
+	defer close(p.done)
+	for {
+		select {
+		case <-p.c.Send.Ready():
+		case <-p.c.Send.Done():
+			p.receive(p.c.Send.Take())
+			return
+		}
+		p.receive(p.c.Send.Take())
+	}
+}
+
+func (p *peer) receive(messages [][]byte) {
+	for _, message := range messages {
+		env, err := protocol.Decode(message)
+		if err != nil {
+			panic(err)
+		}
+		switch env.Type {
+		case protocol.TypeInit:
+			var init protocol.Init
+			env.DecodePayload(&init)
+			p.version.Store(int64(init.Version))
+			p.authors.Store(&init.Authors)
+			p.role.Store(int32(init.Role))
+			p.acks.Done()
+		case protocol.TypeAccess:
+			var access protocol.Access
+			env.DecodePayload(&access)
+			p.role.Store(int32(access.Role))
+		case protocol.TypeError:
+			var e protocol.Error
+			env.DecodePayload(&e)
+			if e.Code == protocol.CodeForbidden {
+				p.refused.Add(1)
+			}
+		case protocol.TypeOp:
+			op, _ := env.DecodeOp()
+			p.version.Store(int64(op.Version))
+			p.ops.Add(1)
+		case protocol.TypeAck:
+			var ack protocol.Ack
+			env.DecodePayload(&ack)
+			p.version.Store(int64(ack.Version))
+			p.acks.Done()
+		}
+	}
+}
+
+// edit sends an insert at the start of the document
+func (p *peer) edit(h *Hub) {
+	p.acks.Add(1)
+	op := ot.NewInsertOperation(0, "x", int(p.version.Load()), p.c.ID)
+	h.Broadcast(client.Message{
+		RoomID:   p.c.RoomID,
+		ClientID: p.c.ID,
+		Content:  protocol.MustEncode(protocol.TypeOp, op),
+	})
+}
+
+// setup creates rooms full of peers and waits until they are registered
+func setup(tb testing.TB, rooms, clients int) (*Hub, []*peer, *sync.WaitGroup) {
+	return setupHub(tb, NewHub(), rooms, clients)
+}
+
+// setupHub is setup for a hub the test configured
+func setupHub(tb testing.TB, h *Hub, rooms, clients int) (*Hub, []*peer, *sync.WaitGroup) {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	tb.Cleanup(func() { log.SetOutput(output) })
+
+	acks := &sync.WaitGroup{}
+	peers := make([]*peer, 0, rooms*clients)
+	for i := 0; i < rooms; i++ {
+		for j := 0; j < clients; j++ {
+			peers = append(peers, newPeer(h, fmt.Sprintf("room%d", i), j, acks))
+		}
+	}
+	tb.Cleanup(func() {
+		for _, p := range peers {
+			h.Unregister(p.c)
+		}
+		for _, p := range peers {
+			<-p.done
+		}
+	})
+	acks.Wait()
+	return h, peers, acks
+}
+
+func TestRoomsDeliverOperations(t *testing.T) {
+	h, peers, acks := setup(t, 2, 3)
+	for _, p := range peers {
+		p.edit(h)
+	}
+	acks.Wait()
+
+	for i := 0; i < 2; i++ {
+		if got := h.GetRoomContent(fmt.Sprintf("room%d", i)); got != "xxx" {
+			t.Errorf("room%d has %q", i, got)
+		}
+	}
+	// Everyone hears about the edits of the others in their room, which
+	// are queued before the acks of their own
+	deadline := time.Now().Add(time.Second)
+	for _, p := range peers {
+		for p.ops.Load() != 2 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if got := p.ops.Load(); got != 2 {
+			t.Errorf("%s got %d operations, want 2", p.c.ID, got)
+		}
+	}
+}
+
+func TestRoomsAreLoadedFromTheStore(t *testing.T) {
+	store := storage.NewMemoryStore()
+	first := NewHub()
+	first.SetStore(store)
+	first, peers, acks := setupHub(t, first, 1, 2)
+	for i := 0; i < snapshotInterval+1; i++ {
+		peers[i%2].edit(first)
+		acks.Wait()
+	}
+
+	_, records, err := store.Load("room0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Op.Version != snapshotInterval+1 || records[0].Author != peers[0].c.ID {
+		t.Errorf("stored records after the snapshot: %+v", records)
+	}
+
+	// A server started over with the same store picks up where it was
+	second := NewHub()
+	second.SetStore(store)
+	second, _, _ = setupHub(t, second, 1, 1)
+	if got, want := second.GetRoomContent("room0"), first.GetRoomContent("room0"); got != want {
+		t.Errorf("reloaded room has %q, want %q", got, want)
+	}
+	if got := second.room("room0").doc.GetVersion(); got != snapshotInterval+1 {
+		t.Errorf("reloaded room is at version %d, want %d", got, snapshotInterval+1)
+	}
+}
+
+func TestRoomsKeepTheBackendTheyWereCreatedWith(t *testing.T) {
+	store := storage.NewMemoryStore()
+	first := NewHub()
+	first.SetStore(store)
+	if _, err := first.ClaimWithBackend("room0", "alice", document.BackendCRDT); err != nil {
+		t.Fatal(err)
+	}
+	first, peers, acks := setupHub(t, first, 1, 1)
+	peers[0].edit(first)
+	acks.Wait()
+	if _, ok := first.room("room0").doc.(*crdt.Document); !ok {
+		t.Fatalf("room0 has a %T, want a CRDT document", first.room("room0").doc)
+	}
+
+	// Opened again by clients asking for another backend, it keeps its own
+	second := NewHub()
+	second.SetStore(store)
+	late := client.NewClient(nil, "room0", "late", user.User{ID: "late"})
+	second.RegisterWithBackend(late, document.BackendOT)
+	t.Cleanup(func() { second.Unregister(late) })
+	if _, ok := second.room("room0").doc.(*crdt.Document); !ok {
+		t.Errorf("reloaded room0 has a %T, want a CRDT document", second.room("room0").doc)
+	}
+	if got := second.GetRoomContent("room0"); got != "x" {
+		t.Errorf("reloaded room0 has %q, want %q", got, "x")
+	}
+	if metadata, err := store.Metadata("room0"); err != nil || metadata.Backend != document.BackendCRDT {
+		t.Errorf("saved metadata = %+v, %v, want the CRDT backend", metadata, err)
+	}
+}
+
+func TestIdleRoomsAreEvictedAndLoadedAgain(t *testing.T) {
+	events := make(chan RoomEvent, 16)
+	h := NewHub()
+	h.SetLifecycle(Lifecycle{
+		IdleTimeout: 10 * time.Millisecond,
+		OnEvent:     func(e RoomEvent) { events <- e },
+	})
+	h, peers, acks := setupHub(t, h, 1, 1)
+	peers[0].edit(h)
+	acks.Wait()
+
+	h.Unregister(peers[0].c)
+	for _, want := range []RoomState{RoomActive, RoomIdle, RoomEvicted} {
+		select {
+		case e := <-events:
+			if e.RoomID != "room0" || e.State != want {
+				t.Fatalf("got %+v, want room0 %s", e, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("room0 did not become %s", want)
+		}
+	}
+	if h.room("room0") != nil {
+		t.Fatal("evicted room is still open")
+	}
+
+	// The next client to join finds the document as it was
+	p := newPeer(h, "room0", 1, acks)
+	t.Cleanup(func() {
+		h.Unregister(p.c)
+		<-p.done
+	})
+	acks.Wait()
+	if e := <-events; e.State != RoomActive || e.Version != 1 {
+		t.Errorf("got %+v, want room0 active at version 1", e)
+	}
+	if got := h.GetRoomContent("room0"); got != "x" {
+		t.Errorf("room0 has %q after being evicted, want %q", got, "x")
+	}
+}
+
+func TestRestoreIsBroadcastLikeAnEdit(t *testing.T) {
+	h, peers, acks := setup(t, 1, 2)
+	for _, p := range peers {
+		p.edit(h)
+		acks.Wait()
+	}
+	if _, err := h.AddCheckpoint("room0", "one x", 1, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := h.Restore("room0", 1, user.User{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 3 || h.GetRoomContent("room0") != "x" {
+		t.Fatalf("restored to version %d with %q, want version 3 with %q", version, h.GetRoomContent("room0"), "x")
+	}
+	deadline := time.Now().Add(time.Second)
+	for _, p := range peers {
+		for p.version.Load() != 3 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if got := p.version.Load(); got != 3 {
+			t.Errorf("%s is at version %d, want 3", p.c.ID, got)
+		}
+	}
+
+	history, err := h.History("room0")
+	if err != nil || len(history) != 3 || history[2].Author != "alice" {
+		t.Errorf("history %+v, %v", history, err)
+	}
+	if text, err := h.TextAt("room0", 2); err != nil || text != "xx" {
+		t.Errorf("text at version 2: %q, %v", text, err)
+	}
+	if checkpoints, err := h.Checkpoints("room0"); err != nil || len(checkpoints) != 1 || checkpoints[0].Version != 1 {
+		t.Errorf("checkpoints %+v, %v", checkpoints, err)
+	}
+}
+
+func TestEditsDroppedByAResyncAreSentBack(t *testing.T) {
+	h, peers, acks := setup(t, 1, 2)
+
+	// A client that reads nothing falls behind the edits of the others
+	u := h.GetUserManager().CreateUser("slow", "slow")
+	slow := client.NewClient(nil, "room0", "slow", u)
+	h.Register(slow)
+	t.Cleanup(func() { h.Unregister(slow) })
+	for i := 0; i < client.OutboxLimit+10; i++ {
+		peers[i%2].edit(h)
+		acks.Wait()
+	}
+	resynced := -1
+	for _, message := range slow.Send.Take() {
+		if env, _ := protocol.Decode(message); env.Type == protocol.TypeResync {
+			var resync protocol.Resync
+			env.DecodePayload(&resync)
+			resynced = resync.Version
+		}
+	}
+	if resynced <= 0 {
+		t.Fatalf("slow client was resynced to version %d", resynced)
+	}
+
+	// next returns what the slow client is told about its own edits next
+	next := func() protocol.Type {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			for _, message := range slow.Send.Take() {
+				env, _ := protocol.Decode(message)
+				if env.Type == protocol.TypeAck {
+					return env.Type
+				}
+				if op, err := env.DecodeOp(); env.Type == protocol.TypeOp && err == nil && op.ClientID == slow.ID {
+					return env.Type
+				}
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return ""
+	}
+	edit := func(version int) {
+		h.Broadcast(client.Message{
+			RoomID:   "room0",
+			ClientID: slow.ID,
+			Content:  protocol.MustEncode(protocol.TypeOp, ot.NewInsertOperation(0, "y", version, slow.ID)),
+		})
+	}
+
+	// An edit made before the resync reaches the room after it. The client
+	// dropped it, so it gets it back as an operation.
+	edit(0)
+	if got := next(); got != protocol.TypeOp {
+		t.Errorf("edit from before the resync: got %q, want an operation", got)
+	}
+	// Edits made since are acknowledged
+	edit(resynced)
+	if got := next(); got != protocol.TypeAck {
+		t.Errorf("edit from after the resync: got %q, want an ack", got)
+	}
+}
+
+// join registers a client without a connection as a new user of room0 and
+// returns it with the init it was sent
+func join(t *testing.T, h *Hub, clientID string) (*client.Client, protocol.Init) {
+	u := h.GetUserManager().CreateUser(clientID, clientID)
+	c := client.NewClient(nil, "room0", clientID, u)
+	h.Register(c)
+	t.Cleanup(func() { h.Unregister(c) })
+	messages := receive(t, c, protocol.TypeInit)
+	var init protocol.Init
+	messages[len(messages)-1].DecodePayload(&init)
+	return c, init
+}
+
+// receive takes what the hub sends a client without a connection up to a
+// message of type last. User lists and presence are left out.
+func receive(t *testing.T, c *client.Client, last protocol.Type) []*protocol.Envelope {
+	t.Helper()
+	var got []*protocol.Envelope
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		for _, message := range c.Send.Take() {
+			env, err := protocol.Decode(message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env.Type == protocol.TypeUserList || env.Type == protocol.TypePresence {
+				continue
+			}
+			got = append(got, env)
+			if env.Type == last {
+				return got
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("client %s got %d messages but no %s", c.ID, len(got), last)
+	return nil
+}
+
+// send hands a message from a client to the hub
+func send(h *Hub, c *client.Client, typ protocol.Type, payload interface{}) {
+	h.Broadcast(client.Message{
+		RoomID:   c.RoomID,
+		ClientID: c.ID,
+		Content:  protocol.MustEncode(typ, payload),
+	})
+}
+
+// resume reconnects the client of a session as if it had seen version
+func resume(t *testing.T, h *Hub, token string, version int) *client.Client {
+	t.Helper()
+	u, prev, ok := h.LookupSession("room0", token)
+	if !ok {
+		t.Fatalf("session %s not found", token)
+	}
+	c := client.NewClient(nil, "room0", prev.ID, u)
+	c.ResumeFrom(version)
+	h.Resume(c)
+	t.Cleanup(func() { h.Unregister(c) })
+	return c
+}
+
+// summary describes replayed messages as type and version, such as "ack 2"
+func summary(messages []*protocol.Envelope) []string {
+	var got []string
+	for _, env := range messages {
+		switch env.Type {
+		case protocol.TypeAck:
+			var ack protocol.Ack
+			env.DecodePayload(&ack)
+			got = append(got, fmt.Sprintf("ack %d", ack.Version))
+		case protocol.TypeOp:
+			op, _ := env.DecodeOp()
+			got = append(got, fmt.Sprintf("op %d by %s", op.Version, op.ClientID))
+		case protocol.TypeInit:
+			var init protocol.Init
+			env.DecodePayload(&init)
+			got = append(got, fmt.Sprintf("init %d resumed %t", init.Version, init.Resumed))
+		default:
+			got = append(got, string(env.Type))
+		}
+	}
+	return got
+}
+
+func TestClientsResumeTheirSessions(t *testing.T) {
+	h, peers, acks := setup(t, 1, 1)
+	a, init := join(t, h, "a")
+	send(h, a, protocol.TypeOp, ot.NewInsertOperation(0, "a", 0, a.ID))
+	receive(t, a, protocol.TypeAck)
+
+	// The connection drops before the client hears its second edit was
+	// committed, and someone else edits meanwhile
+	send(h, a, protocol.TypeOp, ot.NewInsertOperation(1, "b", 1, a.ID))
+	h.Unregister(a)
+	peers[0].edit(h)
+	acks.Wait()
+
+	u, prev, ok := h.LookupSession("room0", init.Session)
+	if !ok || prev != a || u.ID != a.User.ID {
+		t.Fatalf("session %s: got %v, %v, %t", init.Session, u, prev, ok)
+	}
+	resumed := resume(t, h, init.Session, 1)
+	messages := receive(t, resumed, protocol.TypeInit)
+	want := []string{"ack 2", "op 3 by room0-0", "init 3 resumed true"}
+	if got := summary(messages); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+	var again protocol.Init
+	messages[len(messages)-1].DecodePayload(&again)
+	if again.Session != init.Session || again.ClientID != a.ID {
+		t.Errorf("resumed as client %s with session %s, want %s with %s", again.ClientID, again.Session, a.ID, init.Session)
+	}
+}
+
+func TestUndoneEditsAreReplayedAsOperations(t *testing.T) {
+	h := NewHub()
+	setupHub(t, h, 1, 0)
+	a, init := join(t, h, "a")
+	send(h, a, protocol.TypeOp, ot.NewInsertOperation(0, "a", 0, a.ID))
+	receive(t, a, protocol.TypeAck)
+
+	// The client cannot know what its undo does until it gets it back, so
+	// a replay sends it back too
+	send(h, a, protocol.TypeUndo, nil)
+	h.Unregister(a)
+	resumed := resume(t, h, init.Session, 1)
+	want := []string{"op 2 by a", "init 2 resumed true"}
+	if got := summary(receive(t, resumed, protocol.TypeInit)); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+	if got := h.GetRoomContent("room0"); got != "" {
+		t.Errorf("room has %q after the undo", got)
+	}
+}
+
+func TestClientsThatMissedTooMuchStartOver(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		backend document.Backend
+		edits   int
+	}{
+		{"too many operations", document.BackendOT, client.OutboxLimit/2 + 1},
+		{"no history", document.BackendCRDT, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHub()
+			h.SetDefaultBackend(tt.backend)
+			_, peers, acks := setupHub(t, h, 1, 1)
+			a, init := join(t, h, "a")
+			h.Unregister(a)
+			for i := 0; i < tt.edits; i++ {
+				peers[0].edit(h)
+				acks.Wait()
+			}
+
+			resumed := resume(t, h, init.Session, init.Version)
+			want := []string{fmt.Sprintf("init %d resumed false", tt.edits+init.Version)}
+			if got := summary(receive(t, resumed, protocol.TypeInit)); !reflect.DeepEqual(got, want) {
+				t.Errorf("replayed %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestReconnectingBeforeTheOldConnectionDrops(t *testing.T) {
+	h, peers, acks := setup(t, 1, 1)
+	a, init := join(t, h, "a")
+
+	// The client reconnects while the room still has its old connection
+	resumed := resume(t, h, init.Session, init.Version)
+	want := []string{fmt.Sprintf("init %d resumed true", init.Version)}
+	if got := summary(receive(t, resumed, protocol.TypeInit)); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+	select {
+	case <-a.Send.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the old connection was not dropped")
+	}
+
+	// The old socket closing late ends neither the session nor the user's
+	// presence in the room
+	h.Unregister(a)
+	peers[0].edit(h)
+	acks.Wait()
+	want = []string{"op 1 by room0-0"}
+	if got := summary(receive(t, resumed, protocol.TypeOp)); !reflect.DeepEqual(got, want) {
+		t.Errorf("after the takeover got %q, want %q", got, want)
+	}
+	if _, ok := h.GetRoomUsers("room0")[a.User.ID]; !ok {
+		t.Errorf("user %s left the room with the old connection", a.User.ID)
+	}
+	if _, c, ok := h.LookupSession("room0", init.Session); !ok || c != resumed {
+		t.Errorf("session %s belongs to %v, want the new connection", init.Session, c)
+	}
+	r := h.room("room0")
+	r.sessionsMu.Lock()
+	expires := r.clientSessions[a.ID].expires
+	r.sessionsMu.Unlock()
+	if !expires.IsZero() {
+		t.Errorf("session of a connected client expires at %v", expires)
+	}
+}
+
+func TestLegacyClientsResendEditsMadeOffline(t *testing.T) {
+	h, peers, acks := setup(t, 1, 1)
+
+	// The server side of serveWs for legacy browsers in room0
+	first := make(chan *client.Client, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := client.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		var c *client.Client
+		if token := r.URL.Query().Get("session"); token != "" {
+			text, err := client.ReadText(conn)
+			u, prev, ok := h.LookupSession("room0", token)
+			if err != nil || !ok {
+				conn.Close()
+				return
+			}
+			c = client.NewClient(conn, "room0", prev.ID, u)
+			c.Legacy = true
+			c.ResumeLegacy(prev, text)
+			h.Resume(c)
+		} else {
+			u := h.GetUserManager().CreateUser("browser", "browser")
+			c = client.NewClient(conn, "room0", "browser", u)
+			c.Legacy = true
+			h.Register(c)
+			first <- c
+		}
+		go c.WritePump(h)
+		go c.ReadPump(h)
+	}))
+	t.Cleanup(server.Close)
+	dial := func(query string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	// read returns the next frame of a type, "" for plain text
+	read := func(conn *websocket.Conn, typ protocol.Type) []byte {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			env, err := protocol.Decode(message)
+			if (err != nil && typ == "") || (err == nil && env.Type == typ) {
+				return message
+			}
+		}
+	}
+
+	conn := dial("")
+	env, _ := protocol.Decode(read(conn, protocol.TypeInit))
+	var init protocol.Init
+	env.DecodePayload(&init)
+	peers[0].edit(h)
+	acks.Wait()
+	if got := string(read(conn, "")); got != "x" {
+		t.Fatalf("browser shows %q, want %q", got, "x")
+	}
+
+	// The browser goes offline and types while the room moves on
+	conn.Close()
+	<-(<-first).Send.Done()
+	peers[0].edit(h)
+	acks.Wait()
+
+	conn = dial("?session=" + init.Session)
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("xy")); err != nil {
+		t.Fatal(err)
+	}
+	env, _ = protocol.Decode(read(conn, protocol.TypeInit))
+	env.DecodePayload(&init)
+	if !init.Resumed || init.Content != "xxy" {
+		t.Errorf("resumed with %q, resumed %t; want %q", init.Content, init.Resumed, "xxy")
+	}
+	deadline := time.Now().Add(time.Second)
+	for h.GetRoomContent("room0") != "xxy" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := h.GetRoomContent("room0"); got != "xxy" {
+		t.Errorf("room has %q, want the offline edit resent once: %q", got, "xxy")
+	}
+}
+
+func TestRoomsTrackWhoWroteTheirText(t *testing.T) {
+	h, peers, acks := setup(t, 1, 2)
+	deadline := time.Now().Add(time.Second)
+	for i, p := range peers {
+		// Each edit inserts at the start of what the peer has seen
+		for p.version.Load() != int64(i) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		p.edit(h)
+		acks.Wait()
+	}
+	want := []ot.Span{
+		{UserID: "room0-1", Version: 2, Length: 1},
+		{UserID: "room0-0", Version: 1, Length: 1},
+	}
+
+	if got := *peers[0].authors.Load(); got != nil {
+		t.Errorf("init carried authors %+v to a client that did not ask for them", got)
+	}
+	u := h.GetUserManager().CreateUser("room0-2", "room0-2")
+	p := &peer{c: client.NewClient(nil, "room0", u.ID, u), acks: acks, done: make(chan struct{})}
+	p.c.Authorship = true
+	acks.Add(1)
+	go p.drain()
+	h.Register(p.c)
+	t.Cleanup(func() {
+		h.Unregister(p.c)
+		<-p.done
+	})
+	acks.Wait()
+	if got := *p.authors.Load(); !reflect.DeepEqual(got, want) {
+		t.Errorf("init carried authors %+v, want %+v", got, want)
+	}
+
+	text, authorship, err := h.Authorship("room0", -1)
+	if err != nil || text != "xx" || !reflect.DeepEqual(authorship.Spans(), want) {
+		t.Errorf("stored authorship %q, %+v, %v; want %+v", text, authorship, err, want)
+	}
+}
+
+func TestOnlyNewRoomsAreClaimed(t *testing.T) {
+	store := storage.NewMemoryStore()
+	// A room from before rooms had owners, and one whose metadata has none
+	if err := store.Append("old", storage.Record{Op: ot.NewInsertOperation(0, "x", 1, "bob")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveMetadata("unowned", storage.Metadata{ACL: acl.ACL{Link: acl.Editor}}); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHub()
+	h.SetStore(store)
+	setupHub(t, h, 0, 0)
+
+	for _, tt := range []struct {
+		roomID string
+		want   acl.Role
+	}{
+		{"old", acl.Editor},
+		{"unowned", acl.Editor},
+		{"new", acl.Owner},
+	} {
+		if role, err := h.Claim(tt.roomID, "alice"); err != nil || role != tt.want {
+			t.Errorf("claiming %s: got %v, %v; want %v", tt.roomID, role, err, tt.want)
+		}
+	}
+	if a, _ := h.ACL("old"); a.HasOwner() {
+		t.Errorf("old room was claimed: %+v", a)
+	}
+}
+
+func TestRolesDecideWhoMayEdit(t *testing.T) {
+	h, peers, acks := setup(t, 1, 2)
+	owner, other := peers[0], peers[1]
+
+	// Rooms nobody owns yet go to whoever claims them first
+	if role, err := h.Claim("room0", owner.c.User.ID); err != nil || role != acl.Owner {
+		t.Fatalf("first claim: got %v, %v", role, err)
+	}
+	if role, err := h.Claim("room0", other.c.User.ID); err != nil || role != acl.Editor {
+		t.Fatalf("second claim: got %v, %v", role, err)
+	}
+
+	// Viewers are told, and their edits are refused
+	if err := h.SetLinkRole("room0", acl.Viewer); err != nil {
+		t.Fatal(err)
+	}
+	owner.edit(h)
+	acks.Wait()
+	h.Broadcast(client.Message{
+		RoomID:   "room0",
+		ClientID: other.c.ID,
+		Content:  protocol.MustEncode(protocol.TypeOp, ot.NewInsertOperation(0, "y", 1, other.c.ID)),
+	})
+	deadline := time.Now().Add(time.Second)
+	for other.refused.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := h.GetRoomContent("room0"); got != "x" {
+		t.Errorf("room has %q after the owner and a viewer edited it, want %q", got, "x")
+	}
+	if other.refused.Load() != 1 || acl.Role(other.role.Load()) != acl.Viewer {
+		t.Errorf("viewer: %d edits refused, role %v", other.refused.Load(), acl.Role(other.role.Load()))
+	}
+
+	// A grant lets them edit again
+	if err := h.Grant("room0", other.c.User.ID, acl.Editor); err != nil {
+		t.Fatal(err)
+	}
+	other.edit(h)
+	acks.Wait()
+	if got := h.GetRoomContent("room0"); got != "xx" {
+		t.Errorf("room has %q after the editor edited it", got)
+	}
+	if err := h.Revoke("room0", owner.c.User.ID); !errors.Is(err, acl.ErrLastOwner) {
+		t.Errorf("revoking the last owner: got %v, want ErrLastOwner", err)
+	}
+
+	// Users who may no longer see the room are dropped from it
+	h.SetLinkRole("room0", acl.None)
+	h.Revoke("room0", other.c.User.ID)
+	select {
+	case <-other.done:
+	case <-time.After(time.Second):
+		t.Fatal("revoked user is still in the room")
+	}
+	if role := acl.Role(other.role.Load()); role != acl.None {
+		t.Errorf("revoked user was told they are %v", role)
+	}
+	if metadata, err := h.store.Metadata("room0"); err != nil || metadata.ACL.RoleOf(owner.c.User.ID) != acl.Owner || metadata.ACL.Link != acl.None {
+		t.Errorf("saved metadata %+v, %v", metadata, err)
+	}
+}
+
+func TestShareLinksLetGuestsInUntilRevoked(t *testing.T) {
+	h, peers, acks := setup(t, 1, 1)
+	h.Claim("room0", peers[0].c.User.ID)
+	h.SetLinkRole("room0", acl.None)
+	link := acl.ShareLink{ID: "review", Role: acl.Viewer, Expires: time.Now().Add(time.Hour), MaxUses: 1}
+	if err := h.AddShareLink("room0", link); err != nil {
+		t.Fatal(err)
+	}
+
+	// The guest is the first and only user the link lets in
+	if role, err := h.OpenShareLink("room0", "review", "room0-1"); err != nil || role != acl.Viewer {
+		t.Fatalf("guest opening the link: got %v, %v", role, err)
+	}
+	if role, err := h.OpenShareLink("room0", "review", "room0-1"); err != nil || role != acl.Viewer {
+		t.Errorf("guest opening the link again: got %v, %v", role, err)
+	}
+	if _, err := h.OpenShareLink("room0", "review", "someone"); !errors.Is(err, acl.ErrNoShareLink) {
+		t.Errorf("second user of a link for one: got %v, want ErrNoShareLink", err)
+	}
+	guest := newPeer(h, "room0", 1, acks)
+	acks.Wait()
+	if role := acl.Role(guest.role.Load()); role != acl.Viewer {
+		t.Errorf("guest joined as %v, want viewer", role)
+	}
+
+	if err := h.RevokeShareLink("room0", "review"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-guest.done:
+	case <-time.After(time.Second):
+		t.Fatal("guest is still in the room after the link was revoked")
+	}
+	if _, err := h.OpenShareLink("room0", "review", "room0-1"); !errors.Is(err, acl.ErrNoShareLink) {
+		t.Errorf("revoked link: got %v, want ErrNoShareLink", err)
+	}
+}
+
+// benchmarkRooms sends b.N edits spread over rooms of clients and waits for
+// all of them to be acknowledged
+func benchmarkRooms(b *testing.B, rooms, clients int) {
+	h, peers, acks := setup(b, rooms, clients)
+
+	b.ResetTimer()
+	var seed atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(seed.Add(1)))
+		for pb.Next() {
+			peers[r.Intn(len(peers))].edit(h)
+		}
+	})
+	acks.Wait()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "ops/s")
+}
+
+func BenchmarkRooms1000x5(b *testing.B) {
+	benchmarkRooms(b, 1000, 5)
+}
+
+func BenchmarkRooms1x5(b *testing.B) {
+	benchmarkRooms(b, 1, 5)
+}
@@ -0,0 +1,133 @@
+package hub
+
+import (
+	"log"
+	"time"
+
+	"collaborative-markdown-editor/internal/storage"
+)
+
+// DefaultIdleTimeout is how long a room without clients stays in memory by
+// default. It matches SessionTTL, so clients that reconnect to an idle room
+// can still resume.
+const DefaultIdleTimeout = SessionTTL
+
+// RoomState is where a room is in its lifecycle
+type RoomState string
+
+const (
+	// RoomActive rooms have clients connected
+	RoomActive RoomState = "active"
+
+	// RoomIdle rooms have no clients. They are saved to the store and kept
+	// in memory in case someone comes back.
+	RoomIdle RoomState = "idle"
+
+	// RoomEvicted rooms are no longer in memory. The next client to join
+	// loads them from the store again.
+	RoomEvicted RoomState = "evicted"
+)
+
+// RoomEvent reports that a room changed state
+type RoomEvent struct {
+	RoomID  string
+	State   RoomState
+	Version int // Version of the room's document
+	Time    time.Time
+}
+
+// Lifecycle configures what happens to rooms that have no clients
+type Lifecycle struct {
+	// How long an idle room stays in memory before it is evicted
+	IdleTimeout time.Duration
+
+	// Called with every change of state, on the room's goroutine, so it
+	// must not block. May be nil.
+	OnEvent func(RoomEvent)
+}
+
+// evictRequest asks an idle room to leave memory. Requests from idle
+// periods that have since ended are ignored.
+type evictRequest struct {
+	idle int
+}
+
+// setState moves the room to a state and reports it
+func (r *room) setState(state RoomState) {
+	if r.state == state {
+		return
+	}
+	r.state = state
+	log.Printf("Room %s is %s", r.id, state)
+	if r.lifecycle.OnEvent != nil {
+		r.lifecycle.OnEvent(RoomEvent{
+			RoomID:  r.id,
+			State:   state,
+			Version: r.doc.GetVersion(),
+			Time:    time.Now(),
+		})
+	}
+}
+
+// activate brings the room back from idle when a client joins
+func (r *room) activate() {
+	if r.idleTimer != nil {
+		r.idleTimer.Stop()
+		r.idleTimer = nil
+	}
+	r.setState(RoomActive)
+}
+
+// idle saves the room once its last client has left and starts the
+// countdown to its eviction
+func (r *room) idle() {
+	r.flush()
+	r.idlePeriod++
+	r.setState(RoomIdle)
+	r.scheduleEviction()
+}
+
+// scheduleEviction has the room evict itself after the idle timeout
+func (r *room) scheduleEviction() {
+	if r.store == nil {
+		// Without a store the document only lives in memory
+		return
+	}
+	request := evictRequest{idle: r.idlePeriod}
+	r.idleTimer = time.AfterFunc(r.lifecycle.IdleTimeout, func() {
+		r.inbox <- request
+	})
+}
+
+// evict takes an idle room out of memory. It returns whether the room
+// was evicted, in which case its goroutine must stop.
+func (r *room) evict(request evictRequest) bool {
+	if r.state != RoomIdle || request.idle != r.idlePeriod {
+		return false
+	}
+	if !r.hub.closeRoom(r) {
+		// Someone is about to send the room something; if that does not
+		// bring it back, try again later
+		r.scheduleEviction()
+		return false
+	}
+	if err := r.store.Release(r.id); err != nil {
+		log.Printf("Failed to release room %s: %v", r.id, err)
+	}
+	r.setState(RoomEvicted)
+	return true
+}
+
+// flush saves a snapshot of the document if it changed since the last one,
+// so that loading the room again does not replay its log
+func (r *room) flush() {
+	snapshot := r.doc.Snapshot()
+	if r.store == nil || snapshot.Version == r.flushed {
+		return
+	}
+	if err := r.store.SaveSnapshot(r.id, storage.Snapshot{Snapshot: snapshot, Time: time.Now(), Spans: r.authorship.Spans()}); err != nil {
+		log.Printf("Failed to save a snapshot of room %s: %v", r.id, err)
+		return
+	}
+	r.flushed = snapshot.Version
+}
@@ -0,0 +1,516 @@
+package hub
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"collaborative-markdown-editor/internal/acl"
+	"collaborative-markdown-editor/internal/client"
+	"collaborative-markdown-editor/internal/document"
+	"collaborative-markdown-editor/internal/ot"
+	"collaborative-markdown-editor/internal/protocol"
+	"collaborative-markdown-editor/internal/storage"
+	"collaborative-markdown-editor/internal/user"
+)
+
+// roomInboxSize is how many events a room queues before senders block
+const roomInboxSize = 256
+
+// snapshotInterval is how many versions a room's log grows by between
+// snapshots
+const snapshotInterval = 100
+
+// unregisterRequest asks a room to remove a client
+type unregisterRequest struct {
+	client *client.Client
+}
+
+// expireRequest asks a room to forget sessions that ended before now
+type expireRequest struct {
+	now time.Time
+}
+
+// room is an actor owning a room's document and clients. Everything that
+// touches them runs on the room's goroutine, in the order the events
+// arrived in its inbox, so a busy room only slows itself down.
+type room struct {
+	id          string
+	doc         document.Document
+	hub         *Hub
+	userManager *user.UserManager
+
+	// Who wrote each rune of the document, kept up to date by publish
+	authorship *ot.Authorship
+
+	// Store the room saves its operations to, nil if it must not
+	store storage.Store
+
+	// What is known of the room besides its text, such as its ACL.
+	// Requests look the ACL up while the room runs, so it is guarded by
+	// metadataMu.
+	metadata   storage.Metadata
+	metadataMu sync.Mutex
+
+	// The store had nothing of the room when it was opened, so whoever
+	// opens it first may own it
+	claimable bool
+
+	// Version of the document the store can load without replaying the log
+	// past it, as far as the room knows
+	flushed int
+
+	// Lifecycle, only touched by the room's goroutine. idlePeriod counts
+	// the times the room went idle, to tell stale eviction requests apart.
+	lifecycle  Lifecycle
+	state      RoomState
+	idleTimer  *time.Timer
+	idlePeriod int
+
+	// Senders that looked the room up and may not have sent to its inbox
+	// yet. The room is only evicted while there are none.
+	senders atomic.Int32
+
+	// Registered clients and the role they were last told they have, only
+	// touched by the room's goroutine
+	clients map[*client.Client]acl.Role
+
+	// Version of the document each client last started over from, with a
+	// resync or an init that did not resume it. Edits it made before then
+	// are sent back to it as operations, since it dropped them. Only
+	// touched by the room's goroutine.
+	resynced map[*client.Client]int
+
+	// RegisterRequest, unregisterRequest, client.Message, restoreRequest,
+	// accessRequest, expireRequest and evictRequest events. One channel
+	// keeps a client's registration ahead of its messages.
+	inbox chan interface{}
+
+	// Sessions by token and by client ID. Connections look them up before
+	// they register, so they are guarded by sessionsMu.
+	sessions       map[string]*session
+	clientSessions map[string]*session
+	sessionsMu     sync.Mutex
+}
+
+// newRoom creates a room of a hub for a document and metadata loaded from
+// store. Its goroutine is started by run.
+func newRoom(h *Hub, id string, doc document.Document, authorship *ot.Authorship, store storage.Store, metadata storage.Metadata) *room {
+	return &room{
+		id:             id,
+		doc:            doc,
+		hub:            h,
+		authorship:     authorship,
+		userManager:    h.userManager,
+		store:          store,
+		metadata:       metadata,
+		flushed:        doc.GetVersion(),
+		lifecycle:      h.lifecycle,
+		clients:        make(map[*client.Client]acl.Role),
+		resynced:       make(map[*client.Client]int),
+		inbox:          make(chan interface{}, roomInboxSize),
+		sessions:       make(map[string]*session),
+		clientSessions: make(map[string]*session),
+	}
+}
+
+// run handles the room's events until it is evicted. The room first saves
+// the backend its document was opened with, unless it was saved already,
+// so that it opens with the same one next time.
+func (r *room) run(backend document.Backend) {
+	r.saveBackend(backend)
+	for event := range r.inbox {
+		switch event := event.(type) {
+		case RegisterRequest:
+			r.register(event)
+		case unregisterRequest:
+			r.unregister(event.client)
+		case client.Message:
+			r.handleMessage(event)
+		case expireRequest:
+			r.expireSessions(event.now)
+			// Share links may have expired
+			r.reviewRoles()
+		case restoreRequest:
+			version, err := r.restore(event.version, event.author)
+			event.result <- restoreResult{version: version, err: err}
+		case accessRequest:
+			a, err := r.changeACL(event.change)
+			event.result <- accessResult{acl: a, err: err}
+		case evictRequest:
+			if r.evict(event) {
+				return
+			}
+		}
+		if len(r.clients) == 0 && r.state != RoomIdle {
+			r.idle()
+		}
+	}
+}
+
+// saveBackend saves the document backend of a room that has none saved
+func (r *room) saveBackend(backend document.Backend) {
+	r.metadataMu.Lock()
+	metadata := r.metadata
+	r.metadataMu.Unlock()
+	if r.store == nil || metadata.Backend != "" {
+		return
+	}
+	metadata.Backend = backend
+	if err := r.store.SaveMetadata(r.id, metadata); err != nil {
+		log.Printf("Failed to save the backend of room %s: %v", r.id, err)
+		return
+	}
+	r.metadataMu.Lock()
+	r.metadata = metadata
+	r.metadataMu.Unlock()
+}
+
+// register adds a client to the room and starts it off
+func (r *room) register(request RegisterRequest) {
+	r.activate()
+	role := r.roleOf(request.Client)
+	if !role.CanView() {
+		r.reject(request.Client)
+		return
+	}
+
+	// A reconnecting client replaces its old connection
+	r.takeOver(request.Client)
+
+	r.clients[request.Client] = role
+	r.userManager.StartSession(request.Client.ID, r.id, request.Client.User)
+	session := r.startSession(request.Client)
+	if compactor, ok := r.doc.(document.Compactor); ok {
+		compactor.Ack(request.Client.ID, r.doc.GetVersion())
+	}
+	log.Printf("Client registered in room %s. Total clients in room: %d", r.id, len(r.clients))
+
+	// Start the client off with the document, or with what it missed if it
+	// reconnected
+	if request.Resume {
+		r.replay(request.Client, session)
+	} else {
+		r.sendInit(request.Client, session, false)
+	}
+
+	// Broadcast updated user list to all clients in the room
+	r.broadcastUserList()
+}
+
+// unregister removes a client that disconnected
+func (r *room) unregister(c *client.Client) {
+	if _, ok := r.clients[c]; !ok {
+		return
+	}
+	delete(r.clients, c)
+	delete(r.resynced, c)
+	c.Send.Close()
+	// The document keeps the client's state until its session expires, in
+	// case it reconnects
+	r.endSession(c)
+	r.userManager.EndSession(c.ID)
+	log.Printf("Client unregistered from room %s. Remaining clients: %d", r.id, len(r.clients))
+
+	// Broadcast updated user list to all remaining clients in the room
+	r.broadcastUserList()
+}
+
+// handleMessage applies a message from a client to its room's document and
+// tells the room what changed
+func (r *room) handleMessage(message client.Message) {
+	doc := r.doc
+	env, err := protocol.Decode(message.Content)
+	if err != nil {
+		r.sendError(message.ClientID, protocol.CodeInvalidMessage, err.Error())
+		return
+	}
+
+	sender := r.client(message.ClientID)
+	switch env.Type {
+	case protocol.TypeOp, protocol.TypeUndo, protocol.TypeRedo:
+		if sender == nil || !r.roleOf(sender).CanEdit() {
+			// Put the client back where it was before its edit
+			r.sendError(message.ClientID, protocol.CodeForbidden, "you may not edit this room")
+			r.sendResync(message.ClientID)
+			return
+		}
+	}
+
+	var transformedOp *ot.Operation
+	base := 0 // Version the client made its edit against
+	switch env.Type {
+	case protocol.TypePresence:
+		// Presence updates move the sender's selection
+		var presence protocol.Presence
+		if err := env.DecodePayload(&presence); err != nil || presence.Selection == nil {
+			r.sendError(message.ClientID, protocol.CodeInvalidMessage, "invalid presence")
+			return
+		}
+		sel, err := doc.SetSelection(message.ClientID, *presence.Selection, presence.Version)
+		var staleErr *ot.StaleVersionError
+		switch {
+		case errors.As(err, &staleErr):
+			r.sendResync(message.ClientID)
+			return
+		case err != nil:
+			log.Printf("Failed to update selection of client %s: %v", message.ClientID, err)
+			return
+		}
+		r.userManager.UpdateSelection(message.ClientID, sel)
+		r.broadcastPresence()
+		return
+
+	case protocol.TypeAck:
+		var ack protocol.Ack
+		if err := env.DecodePayload(&ack); err != nil {
+			r.sendError(message.ClientID, protocol.CodeInvalidMessage, err.Error())
+			return
+		}
+		if compactor, ok := doc.(document.Compactor); ok {
+			compactor.Ack(message.ClientID, ack.Version)
+		}
+		return
+
+	case protocol.TypeUndo, protocol.TypeRedo:
+		// Undo and redo requests carry no operation, the document produces
+		// one from the client's own history
+		undoer, ok := doc.(document.Undoer)
+		if !ok {
+			r.sendError(message.ClientID, protocol.CodeUnsupported, "this room does not support undo")
+			return
+		}
+		if env.Type == protocol.TypeUndo {
+			transformedOp, err = undoer.Undo(message.ClientID)
+		} else {
+			transformedOp, err = undoer.Redo(message.ClientID)
+		}
+
+	case protocol.TypeOp:
+		operation, decodeErr := env.DecodeOp()
+		if decodeErr != nil {
+			r.sendError(message.ClientID, protocol.CodeInvalidMessage, decodeErr.Error())
+			return
+		}
+		// Operations are attributed to the connection they came from
+		operation.ClientID = message.ClientID
+		base = operation.Version
+
+		// Transform the operation against concurrent edits and apply it
+		transformedOp, err = doc.ApplyOperation(operation)
+
+	default:
+		r.sendError(message.ClientID, protocol.CodeInvalidMessage, "clients cannot send "+string(env.Type)+" messages")
+		return
+	}
+
+	if err != nil {
+		var staleErr *ot.StaleVersionError
+		switch {
+		case errors.Is(err, ot.ErrNothingToUndo), errors.Is(err, ot.ErrNothingToRedo):
+			// Nothing happened, nothing to tell anyone
+		case errors.As(err, &staleErr):
+			// The operation cannot be transformed any more, the client has
+			// to start over from the current document
+			log.Printf("Resyncing client %s: %v", message.ClientID, err)
+			r.sendResync(message.ClientID)
+		default:
+			log.Printf("Failed to apply operation: %v", err)
+			r.sendError(message.ClientID, protocol.CodeRejected, err.Error())
+		}
+		return
+	}
+
+	// The sender of an undo or redo has not seen the result yet, so it gets
+	// it like everyone else, and so does the sender of an edit it dropped
+	// when it started over from a later version. The sender of any other
+	// edit only needs to know which version it became.
+	sendBack := env.Type != protocol.TypeOp || base < r.resynced[sender]
+	if sendBack {
+		r.recordSentBack(message.ClientID, transformedOp.Version)
+	}
+	author, ok := r.userManager.SessionUser(message.ClientID)
+	if !ok {
+		author.ID = message.ClientID
+	}
+	r.publish(transformedOp, author, !sendBack)
+}
+
+// publish saves a committed operation and broadcasts it to the room. With
+// ackSender, the client that made it gets an ack instead.
+func (r *room) publish(op *ot.Operation, author user.User, ackSender bool) {
+	if err := r.authorship.Apply(op, author.ID); err != nil {
+		log.Printf("Lost track of who wrote room %s at version %d: %v", r.id, op.Version, err)
+		r.authorship = ot.Unattributed(r.doc.GetCurrentDocument())
+	}
+	r.persist(op, author)
+
+	opJSON := protocol.MustEncode(protocol.TypeOp, op)
+	ackJSON := protocol.MustEncode(protocol.TypeAck, protocol.Ack{Version: op.Version})
+	for client := range r.clients {
+		data := opJSON
+		if client.ID == op.ClientID && ackSender {
+			data = ackJSON
+		}
+		r.send(client, data)
+	}
+
+	// Everyone's selection may have moved
+	r.broadcastPresence()
+}
+
+// persist appends a committed operation to the room's log, along with who
+// made it and when, and saves a snapshot every snapshotInterval versions
+func (r *room) persist(op *ot.Operation, author user.User) {
+	if r.store == nil {
+		return
+	}
+	record := storage.Record{Op: op, Author: author.Username, UserID: author.ID, Time: time.Now()}
+	if err := r.store.Append(r.id, record); err != nil {
+		log.Printf("Failed to save version %d of room %s: %v", op.Version, r.id, err)
+		return
+	}
+	if op.Version%snapshotInterval == 0 {
+		r.flush()
+	}
+}
+
+// send queues a message for a client. A client too far behind to take it,
+// even once its backlog is coalesced, gets the whole document instead.
+func (r *room) send(c *client.Client, data []byte) {
+	if c.Send.Push(data) {
+		return
+	}
+	dropped := c.Send.Replace(r.resyncMessage(c))
+	log.Printf("Client %s in room %s fell behind, resyncing it (%d messages dropped)", c.ID, r.id, dropped)
+}
+
+// client returns the registered client with the given ID, or nil
+func (r *room) client(clientID string) *client.Client {
+	for client := range r.clients {
+		if client.ID == clientID {
+			return client
+		}
+	}
+	return nil
+}
+
+// sendTo queues a message for the client with the given ID
+func (r *room) sendTo(clientID string, data []byte) {
+	for client := range r.clients {
+		if client.ID == clientID {
+			r.send(client, data)
+		}
+	}
+}
+
+// broadcastRoom queues a message for every client in the room
+func (r *room) broadcastRoom(data []byte) {
+	for client := range r.clients {
+		r.send(client, data)
+	}
+}
+
+// sendError tells a client that one of its messages was rejected
+func (r *room) sendError(clientID, code, message string) {
+	r.sendTo(clientID, protocol.MustEncode(protocol.TypeError, protocol.Error{Code: code, Message: message}))
+}
+
+// roomUsers returns the users in the room as sent to clients, each once
+// however many connections they have
+func (r *room) roomUsers() []protocol.User {
+	users := r.userManager.GetRoomUsers(r.id)
+	userList := make([]protocol.User, 0, len(users))
+	index := make(map[string]int) // userID -> position in userList
+	lastSeen := make(map[string]time.Time)
+	for _, session := range r.userManager.GetRoomSessions(r.id) {
+		user, ok := users[session.UserID]
+		if !ok {
+			continue
+		}
+		i, ok := index[user.ID]
+		if !ok {
+			i = len(userList)
+			index[user.ID] = i
+			userList = append(userList, protocol.User{
+				ID:       user.ID,
+				Username: user.Username,
+				Color:    user.Color,
+			})
+		}
+		userList[i].Clients = append(userList[i].Clients, session.ID)
+		if session.LastSeen.After(lastSeen[user.ID]) {
+			lastSeen[user.ID] = session.LastSeen
+			userList[i].Selection = session.Selection
+		}
+	}
+	return userList
+}
+
+// broadcastUserList sends the current user list to all clients in the room
+func (r *room) broadcastUserList() {
+	r.broadcastRoom(protocol.MustEncode(protocol.TypeUserList, protocol.UserList{Users: r.roomUsers()}))
+}
+
+// broadcastPresence sends the current selection of every client to all
+// clients in the room
+func (r *room) broadcastPresence() {
+	selections := r.doc.Selections()
+	if len(selections) == 0 {
+		return
+	}
+	for clientID, sel := range selections {
+		r.userManager.UpdateSelection(clientID, sel)
+	}
+
+	r.broadcastRoom(protocol.MustEncode(protocol.TypePresence, protocol.Presence{
+		Version:    r.doc.GetVersion(),
+		Selections: selections,
+	}))
+}
+
+// sendInit sends a newly registered client its ID, session, the document
+// and the users in the room
+func (r *room) sendInit(c *client.Client, s *session, resumed bool) {
+	snapshot := r.doc.Snapshot()
+	init := protocol.Init{
+		ClientID: c.ID,
+		UserID:   c.User.ID,
+		Content:  snapshot.Text,
+		Version:  snapshot.Version,
+		Users:    r.roomUsers(),
+		Session:  s.token,
+		Resumed:  resumed,
+		Role:     r.roleOf(c),
+	}
+	if c.Authorship {
+		init.Authors = r.authorship.Spans()
+	}
+	if !resumed {
+		r.resynced[c] = snapshot.Version
+	}
+	r.send(c, protocol.MustEncode(protocol.TypeInit, init))
+}
+
+// sendResync sends the whole document to a client that fell behind the
+// history the room keeps
+func (r *room) sendResync(clientID string) {
+	if c := r.client(clientID); c != nil {
+		r.send(c, r.resyncMessage(c))
+	}
+}
+
+// resyncMessage returns a resync with the current document for a client
+func (r *room) resyncMessage(c *client.Client) []byte {
+	snapshot := r.doc.Snapshot()
+	if compactor, ok := r.doc.(document.Compactor); ok {
+		compactor.Ack(c.ID, snapshot.Version)
+	}
+	r.resynced[c] = snapshot.Version
+	return protocol.MustEncode(protocol.TypeResync, protocol.Resync{
+		Content: snapshot.Text,
+		Version: snapshot.Version,
+	})
+}
@@ -0,0 +1,171 @@
+package hub
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"collaborative-markdown-editor/internal/client"
+	"collaborative-markdown-editor/internal/document"
+	"collaborative-markdown-editor/internal/ot"
+	"collaborative-markdown-editor/internal/protocol"
+	"collaborative-markdown-editor/internal/user"
+)
+
+// SessionTTL is how long a session outlives its last connection
+const SessionTTL = 5 * time.Minute
+
+// session lets a client that lost its connection come back as the same
+// user and pick up where it left off
+type session struct {
+	token string
+	user  user.User
+
+	// Latest connection of the client
+	client *client.Client
+
+	// When the session ends, zero while the client is connected
+	expires time.Time
+
+	// Versions of operations the client made that it was sent as
+	// operations, not acks: answers to undo or redo requests, and edits it
+	// dropped when it started over
+	sentBack map[int]bool
+}
+
+// newSessionToken returns a random session token
+func newSessionToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Failed to generate session token: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// lookupSession returns the user and latest connection of a session
+func (r *room) lookupSession(token string) (user.User, *client.Client, bool) {
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+	s, ok := r.sessions[token]
+	if !ok {
+		return user.User{}, nil, false
+	}
+	return s.user, s.client, true
+}
+
+// startSession attaches a newly registered connection to its client's
+// session, starting one for new clients
+func (r *room) startSession(c *client.Client) *session {
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+	if s, ok := r.clientSessions[c.ID]; ok {
+		s.client = c
+		s.expires = time.Time{}
+		return s
+	}
+	s := &session{
+		token:    newSessionToken(),
+		user:     c.User,
+		client:   c,
+		sentBack: make(map[int]bool),
+	}
+	r.sessions[s.token] = s
+	r.clientSessions[c.ID] = s
+	return s
+}
+
+// endSession starts the countdown on the session of a connection that
+// closed, unless a newer connection took the session over
+func (r *room) endSession(c *client.Client) {
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+	if s, ok := r.clientSessions[c.ID]; ok && s.client == c {
+		s.expires = time.Now().Add(SessionTTL)
+	}
+}
+
+// expireSessions forgets sessions that ended before now, along with the
+// state their documents kept for them
+func (r *room) expireSessions(now time.Time) {
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+	for token, s := range r.sessions {
+		if s.expires.IsZero() || now.Before(s.expires) {
+			continue
+		}
+		delete(r.sessions, token)
+		delete(r.clientSessions, s.client.ID)
+		r.doc.RemoveClient(s.client.ID)
+	}
+}
+
+// recordSentBack notes that a client was sent one of its own operations, so
+// a replay sends it the same way
+func (r *room) recordSentBack(clientID string, version int) {
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+	s, ok := r.clientSessions[clientID]
+	if !ok {
+		return
+	}
+	s.sentBack[version] = true
+	for v := range s.sentBack {
+		if v <= version-ot.DefaultHistorySize {
+			delete(s.sentBack, v)
+		}
+	}
+}
+
+// takeOver removes the connections a client had in the room before the
+// one it reconnected with
+func (r *room) takeOver(c *client.Client) {
+	for old := range r.clients {
+		if old.ID == c.ID && old != c {
+			delete(r.clients, old)
+			delete(r.resynced, old)
+			old.Send.Close()
+		}
+	}
+}
+
+// replay sends a reconnecting client the operations it missed and then a
+// resumed init. A client whose missed operations are no longer known starts
+// over from the current document.
+func (r *room) replay(c *client.Client, s *session) {
+	var ops []*ot.Operation
+	err := errors.New("the document keeps no history")
+	if replayer, ok := r.doc.(document.Replayer); ok {
+		ops, err = replayer.OperationsSince(c.Version())
+	}
+	if err == nil && len(ops) > client.OutboxLimit/2 {
+		// A replay cannot be coalesced into a resync halfway, as the
+		// operations after it would be applied twice
+		err = fmt.Errorf("%d operations missed", len(ops))
+	}
+	if err != nil {
+		log.Printf("Cannot replay to client %s, starting it over: %v", c.ID, err)
+		r.sendInit(c, s, false)
+		return
+	}
+
+	r.sessionsMu.Lock()
+	sentBack := make(map[int]bool, len(s.sentBack))
+	for v := range s.sentBack {
+		sentBack[v] = true
+	}
+	r.sessionsMu.Unlock()
+
+	for _, op := range ops {
+		if op.ClientID == c.ID && !sentBack[op.Version] {
+			// The client made this operation and is waiting to hear it
+			// was committed
+			r.send(c, protocol.MustEncode(protocol.TypeAck, protocol.Ack{Version: op.Version}))
+			continue
+		}
+		r.send(c, protocol.MustEncode(protocol.TypeOp, op))
+	}
+	r.sendInit(c, s, true)
+}
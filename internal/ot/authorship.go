@@ -0,0 +1,145 @@
+package ot
+
+import "unicode/utf8"
+
+// Span is a run of text written by the same user in the same version
+type Span struct {
+	UserID  string `json:"userId"` // Empty when the author is not known
+	Version int    `json:"version"`
+	Length  int    `json:"length"` // In runes
+}
+
+// Authorship tracks who wrote each rune of a document, as spans in document
+// order that are updated by every operation committed to it
+type Authorship struct {
+	spans []Span
+}
+
+// NewAuthorship starts tracking a document whose runes were written as the
+// given spans say
+func NewAuthorship(spans []Span) *Authorship {
+	a := &Authorship{}
+	for _, span := range spans {
+		a.append(span)
+	}
+	return a
+}
+
+// Unattributed returns the authorship of a text nobody is known to have
+// written
+func Unattributed(text string) *Authorship {
+	return NewAuthorship([]Span{{Length: utf8.RuneCountInString(text)}})
+}
+
+// Spans returns the spans in document order
+func (a *Authorship) Spans() []Span {
+	return append([]Span(nil), a.spans...)
+}
+
+// Len returns the length of the document in runes
+func (a *Authorship) Len() int {
+	n := 0
+	for _, span := range a.spans {
+		n += span.Length
+	}
+	return n
+}
+
+// Apply attributes the text a committed operation inserted to the user who
+// made it, at the version it produced, and forgets the text it deleted
+func (a *Authorship) Apply(op *Operation, userID string) error {
+	next := &Authorship{}
+	i, offset := 0, 0 // Span and rune within it the operation is at
+	take := func(n int, keep bool) error {
+		for n > 0 {
+			if i == len(a.spans) {
+				return ErrOutOfRange
+			}
+			span := a.spans[i]
+			k := min(n, span.Length-offset)
+			if keep {
+				next.append(Span{UserID: span.UserID, Version: span.Version, Length: k})
+			}
+			n -= k
+			offset += k
+			if offset == span.Length {
+				i, offset = i+1, 0
+			}
+		}
+		return nil
+	}
+
+	for _, c := range op.Text() {
+		var err error
+		switch {
+		case c.Retain > 0:
+			err = take(c.Retain, true)
+		case c.Insert != "":
+			next.append(Span{UserID: userID, Version: op.Version, Length: utf8.RuneCountInString(c.Insert)})
+		case c.Delete > 0:
+			err = take(c.Delete, false)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Runes past the last component are retained
+	if i < len(a.spans) {
+		next.append(Span{UserID: a.spans[i].UserID, Version: a.spans[i].Version, Length: a.spans[i].Length - offset})
+		for _, span := range a.spans[i+1:] {
+			next.append(span)
+		}
+	}
+	a.spans = next.spans
+	return nil
+}
+
+// Lines returns, for each line of the document's text, the span that wrote
+// most of it, with the length of the whole line. Ties go to the newer span.
+func (a *Authorship) Lines(text string) []Span {
+	var lines []Span
+	written := make(map[Span]int) // Runes of the current line by user and version
+	flush := func(length int) {
+		var best Span
+		for span, n := range written {
+			if n > written[best] || (n == written[best] && span.Version > best.Version) {
+				best = span
+			}
+		}
+		best.Length = length
+		lines = append(lines, best)
+		written = make(map[Span]int)
+	}
+
+	i, offset, length := 0, 0, 0
+	for _, r := range text {
+		if i < len(a.spans) {
+			written[Span{UserID: a.spans[i].UserID, Version: a.spans[i].Version}]++
+			if offset++; offset == a.spans[i].Length {
+				i, offset = i+1, 0
+			}
+		}
+		length++
+		if r == '\n' {
+			flush(length)
+			length = 0
+		}
+	}
+	if length > 0 {
+		flush(length)
+	}
+	return lines
+}
+
+// append adds a span at the end, merging it into the last one if they have
+// the same author and version
+func (a *Authorship) append(span Span) {
+	if span.Length <= 0 {
+		return
+	}
+	if n := len(a.spans); n > 0 && a.spans[n-1].UserID == span.UserID && a.spans[n-1].Version == span.Version {
+		a.spans[n-1].Length += span.Length
+		return
+	}
+	a.spans = append(a.spans, span)
+}
@@ -0,0 +1,59 @@
+package ot
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestAuthorshipFollowsInsertsAndDeletes(t *testing.T) {
+	a := Unattributed("hello")
+	steps := []struct {
+		op   *Operation
+		want []Span
+	}{
+		{NewInsertOperation(5, " world", 1, "alice"), []Span{{"", 0, 5}, {"alice", 1, 6}}},
+		{NewInsertOperation(2, "é", 2, "bob"), []Span{{"", 0, 2}, {"bob", 2, 1}, {"", 0, 3}, {"alice", 1, 6}}},
+		// Deleting the runes between two unattributed spans merges them
+		{NewDeleteOperation(1, 3, 3, "alice"), []Span{{"", 0, 3}, {"alice", 1, 6}}},
+		{NewInsertOperation(0, "h", 4, "bob"), []Span{{"bob", 4, 1}, {"", 0, 3}, {"alice", 1, 6}}},
+	}
+
+	for i, step := range steps {
+		if err := a.Apply(step.op, step.op.ClientID); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if got := a.Spans(); !reflect.DeepEqual(got, step.want) {
+			t.Fatalf("step %d: spans = %+v, want %+v", i, got, step.want)
+		}
+	}
+	if a.Len() != 10 {
+		t.Errorf("length = %d, want 10", a.Len())
+	}
+
+	if err := a.Apply(NewDeleteOperation(9, 2, 5, "alice"), "alice"); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("deleting past the end: got %v, want ErrOutOfRange", err)
+	}
+}
+
+func TestAuthorshipLines(t *testing.T) {
+	text := "title\nbody text\n\nend"
+	a := NewAuthorship([]Span{
+		{"alice", 1, 6}, // "title\n"
+		{"bob", 2, 4},   // "body"
+		{"alice", 3, 6}, // " text\n", most of the line
+		{"bob", 4, 1},   // "\n"
+		{"alice", 5, 1}, // "e"
+		{"carol", 6, 1}, // "n"
+		{"dave", 7, 1},  // "d", ties go to the newest
+	})
+	want := []Span{
+		{"alice", 1, 6},
+		{"alice", 3, 10},
+		{"bob", 4, 1},
+		{"dave", 7, 3},
+	}
+	if got := a.Lines(text); !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %+v, want %+v", got, want)
+	}
+}
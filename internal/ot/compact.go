@@ -0,0 +1,67 @@
+package ot
+
+// Ack records that a client has seen the document at version. History a
+// connected client may still build on is kept until it acknowledges a newer
+// version or leaves.
+func (m *Manager) Ack(clientID string, version int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ack(clientID, version)
+}
+
+// ack ignores versions the history no longer reaches, so a client that fell
+// behind cannot pin it until it has been resynced
+func (m *Manager) ack(clientID string, version int) {
+	if version > m.version || version < m.version-len(m.history) {
+		return
+	}
+	if acked, ok := m.acked[clientID]; !ok || version > acked {
+		m.acked[clientID] = version
+	}
+}
+
+// horizon returns the oldest version the history has to reach back to: the
+// oldest version acknowledged by a connected client, but no further back
+// than the history size allows
+func (m *Manager) horizon() int {
+	horizon := m.version
+	for _, version := range m.acked {
+		horizon = min(horizon, version)
+	}
+	return max(horizon, m.version-m.maxHistory)
+}
+
+// Compact folds the operations every connected client has seen into the
+// base text. Compaction also runs periodically as operations are committed.
+func (m *Manager) Compact() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.compact()
+}
+
+func (m *Manager) compact() {
+	oldest := m.version - len(m.history)
+	n := m.horizon() - oldest
+	if n <= 0 {
+		return
+	}
+	for _, op := range m.history[:n] {
+		base, err := op.Text().ApplyRope(m.base)
+		if err != nil {
+			// Committed operations always apply; rebuild from the document
+			// rather than keep a broken base
+			m.base, m.history = m.doc, nil
+			return
+		}
+		m.base = base
+	}
+	m.history = append(m.history[:0:0], m.history[n:]...)
+}
+
+// Base returns the text the retained history starts from, at the oldest
+// version operations can still be based on
+func (m *Manager) Base() Snapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return Snapshot{Text: m.base.String(), Version: m.version - len(m.history)}
+}
@@ -0,0 +1,98 @@
+package ot
+
+import (
+	"errors"
+	"testing"
+)
+
+// replayHistory rebuilds the document from the base text and the history
+func replayHistory(t *testing.T, m *Manager) string {
+	t.Helper()
+	doc := m.base
+	for _, op := range m.history {
+		var err error
+		if doc, err = op.Text().ApplyRope(doc); err != nil {
+			t.Fatalf("history does not apply to its base: %v", err)
+		}
+	}
+	return doc.String()
+}
+
+func TestCompactionKeepsHistoryConnectedClientsNeed(t *testing.T) {
+	m := NewManager("abc")
+	m.Ack("alice", 0)
+	m.Ack("bob", 0)
+	for i := 0; i < 150; i++ {
+		if _, err := m.ApplyOperation(NewInsertOperation(i%3, "x", i, "alice")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Bob has seen nothing since joining, so nothing can be folded
+	if base := m.Base(); base.Version != 0 || base.Text != "abc" {
+		t.Fatalf("base = %+v while bob is at version 0", base)
+	}
+
+	m.Ack("bob", 120)
+	m.Compact()
+	if base := m.Base(); base.Version != 120 {
+		t.Fatalf("base at version %d after every client saw 120", base.Version)
+	}
+	if got := replayHistory(t, m); got != m.GetCurrentDocument() {
+		t.Fatalf("base and history give %q, document is %q", got, m.GetCurrentDocument())
+	}
+
+	var staleErr *StaleVersionError
+	if _, err := m.ApplyOperation(NewInsertOperation(0, "y", 50, "carol")); !errors.As(err, &staleErr) {
+		t.Fatalf("operation behind the horizon: got %v, want *StaleVersionError", err)
+	}
+	if _, err := m.ApplyOperation(NewInsertOperation(0, "y", 120, "bob")); err != nil {
+		t.Fatalf("operation at the horizon rejected: %v", err)
+	}
+
+	// Alice last built on version 149
+	m.RemoveClient("bob")
+	if base := m.Base(); base.Version != 149 {
+		t.Fatalf("base at version %d after bob left", base.Version)
+	}
+	if got := replayHistory(t, m); got != m.GetCurrentDocument() {
+		t.Fatalf("base and history give %q, document is %q", got, m.GetCurrentDocument())
+	}
+}
+
+func TestOperationsSinceCatchesUpAClient(t *testing.T) {
+	m := NewManager("")
+	m.Ack("bob", 0)
+	for i := 0; i < 5; i++ {
+		if _, err := m.ApplyOperation(NewInsertOperation(i, string(rune('a'+i)), i, "alice")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Bob saw version 2 and missed the rest
+	ops, err := m.OperationsSince(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := "ab"
+	for _, op := range ops {
+		doc = mustApply(t, op, doc)
+	}
+	if len(ops) != 3 || doc != m.GetCurrentDocument() {
+		t.Fatalf("replaying %d operations gives %q, want %q", len(ops), doc, m.GetCurrentDocument())
+	}
+
+	if ops, err := m.OperationsSince(5); err != nil || len(ops) != 0 {
+		t.Errorf("up to date client: %v, %v", ops, err)
+	}
+	if _, err := m.OperationsSince(6); err != ErrFutureVersion {
+		t.Errorf("expected ErrFutureVersion, got %v", err)
+	}
+
+	m.Ack("bob", 4)
+	m.Compact()
+	var staleErr *StaleVersionError
+	if _, err := m.OperationsSince(2); !errors.As(err, &staleErr) {
+		t.Errorf("compacted history: got %v, want *StaleVersionError", err)
+	}
+}
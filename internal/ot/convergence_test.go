@@ -0,0 +1,179 @@
+package ot
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// site simulates one editor talking to a Manager. It keeps at most one
+// operation in flight and composes later local edits into a buffer, the
+// same way a real client has to.
+type site struct {
+	id      string
+	doc     string
+	version int
+
+	pending *Operation    // Sent to the server, not yet acknowledged
+	buffer  TextOperation // Local edits not sent yet
+
+	inbox []*Operation // Committed operations from the server, in order
+}
+
+// edit applies a local change and returns the operation to send, if any
+func (s *site) edit(t *testing.T, text TextOperation) *Operation {
+	doc, err := text.Apply(s.doc)
+	if err != nil {
+		t.Fatalf("site %s: local edit %s on %q: %v", s.id, text, s.doc, err)
+	}
+	s.doc = doc
+	if s.pending != nil {
+		s.buffer = s.buffer.Compose(text)
+		return nil
+	}
+	s.pending = NewOperation(text, s.version, s.id)
+	return s.pending
+}
+
+// receive handles the next committed operation from the server and returns
+// the operation to send next, if any
+func (s *site) receive(t *testing.T) *Operation {
+	committed := s.inbox[0]
+	s.inbox = s.inbox[1:]
+	s.version = committed.Version
+
+	if committed.ClientID == s.id && s.pending != nil {
+		// Acknowledgement of our own operation
+		s.pending = nil
+		if s.buffer.IsNoop() {
+			return nil
+		}
+		s.pending = NewOperation(s.buffer, s.version, s.id)
+		s.buffer = nil
+		return s.pending
+	}
+
+	remote := committed
+	if s.pending != nil {
+		s.pending, remote = s.pending.Transform(remote)
+		buffer := NewOperation(s.buffer, s.version, s.id)
+		buffer, remote = buffer.Transform(remote)
+		s.buffer = buffer.Text()
+	}
+	s.doc = mustApply(t, remote, s.doc)
+	return nil
+}
+
+// simulate runs sites against a Manager with random interleaving of local
+// edits and message delivery, then checks every site ends on the server's
+// document
+func simulate(t *testing.T, r *rand.Rand, sites, steps int, initial string) {
+	m := NewManager(initial)
+	all := make([]*site, sites)
+	for i := range all {
+		all[i] = &site{id: fmt.Sprintf("site%d", i), doc: initial}
+	}
+	var toServer []*Operation
+
+	commit := func(op *Operation) {
+		committed, err := m.ApplyOperation(op)
+		if err != nil {
+			t.Fatalf("apply %s: %v", op, err)
+		}
+		for _, s := range all {
+			s.inbox = append(s.inbox, committed)
+		}
+	}
+
+	for step := 0; step < steps; step++ {
+		s := all[r.Intn(len(all))]
+		switch {
+		case r.Intn(3) == 0:
+			if op := s.edit(t, randomTextOperation(r, s.doc)); op != nil {
+				toServer = append(toServer, op)
+			}
+		case len(s.inbox) > 0:
+			if op := s.receive(t); op != nil {
+				toServer = append(toServer, op)
+			}
+		case len(toServer) > 0:
+			// Deliver the oldest outstanding operation; per-site order is
+			// preserved because each site has at most one in flight
+			commit(toServer[0])
+			toServer = toServer[1:]
+		}
+	}
+
+	// Drain everything
+	for len(toServer) > 0 || hasInbox(all) {
+		for len(toServer) > 0 {
+			commit(toServer[0])
+			toServer = toServer[1:]
+		}
+		for _, s := range all {
+			for len(s.inbox) > 0 {
+				if op := s.receive(t); op != nil {
+					toServer = append(toServer, op)
+				}
+			}
+		}
+	}
+
+	want := m.GetCurrentDocument()
+	for _, s := range all {
+		if s.doc != want {
+			t.Fatalf("site %s diverged:\n got %q\nwant %q", s.id, s.doc, want)
+		}
+		if s.version != m.GetVersion() {
+			t.Fatalf("site %s is at version %d, server at %d", s.id, s.version, m.GetVersion())
+		}
+	}
+}
+
+func hasInbox(sites []*site) bool {
+	for _, s := range sites {
+		if len(s.inbox) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMultiSiteConvergence(t *testing.T) {
+	for _, sites := range []int{2, 3, 5, 8} {
+		t.Run(fmt.Sprintf("%d sites", sites), func(t *testing.T) {
+			r := rand.New(rand.NewSource(int64(sites)))
+			for i := 0; i < 200; i++ {
+				simulate(t, r, sites, 100, randomText(r, r.Intn(20)))
+			}
+		})
+	}
+}
+
+func TestManagerRejectsStaleVersions(t *testing.T) {
+	m := NewManager("")
+	m.maxHistory = 3
+	// Bob stays connected at version 0, so only the size limit trims history
+	m.Ack("bob", 0)
+	for i := 0; i < 5; i++ {
+		if _, err := m.ApplyOperation(NewInsertOperation(0, "x", i, "alice")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := m.ApplyOperation(NewInsertOperation(0, "y", 1, "bob"))
+	staleErr, ok := err.(*StaleVersionError)
+	if !ok {
+		t.Fatalf("expected *StaleVersionError, got %v", err)
+	}
+	if staleErr.Version != 1 || staleErr.Oldest != 2 {
+		t.Errorf("unexpected error fields: %+v", staleErr)
+	}
+
+	if _, err := m.ApplyOperation(NewInsertOperation(0, "y", 2, "bob")); err != nil {
+		t.Errorf("oldest retained version rejected: %v", err)
+	}
+	if _, err := m.ApplyOperation(NewInsertOperation(0, "y", 99, "bob")); err != ErrFutureVersion {
+		t.Errorf("expected ErrFutureVersion, got %v", err)
+	}
+}
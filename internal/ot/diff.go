@@ -0,0 +1,21 @@
+package ot
+
+import "collaborative-markdown-editor/internal/diff"
+
+// Diff returns an operation that turns old into new, keeping as much of old
+// as possible so that it transforms well against concurrent edits
+func Diff(old, new string) TextOperation {
+	oldRunes, newRunes := []rune(old), []rune(new)
+	op := NewTextOperation()
+	for _, e := range diff.Diff(oldRunes, newRunes) {
+		switch e.Kind {
+		case diff.Equal:
+			op.Retain(e.Len)
+		case diff.Insert:
+			op.Insert(string(newRunes[e.B : e.B+e.Len]))
+		case diff.Delete:
+			op.Delete(e.Len)
+		}
+	}
+	return op.trimmed()
+}
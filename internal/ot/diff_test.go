@@ -0,0 +1,32 @@
+package ot
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	r := rand.New(rand.NewSource(9))
+	for i := 0; i < 2000; i++ {
+		old := randomText(r, r.Intn(30))
+		new, _ := randomTextOperation(r, old).Apply(old)
+		if got, err := Diff(old, new).Apply(old); err != nil || got != new {
+			t.Fatalf("Diff(%q, %q) applies to %q (%v)", old, new, got, err)
+		}
+	}
+
+	// Typing only inserts what was typed, counted in runes
+	for _, tt := range []struct {
+		old, new string
+		want     *TextOperation
+	}{
+		{"hello world", "hello big world", NewTextOperation().Retain(6).Insert("big ")},
+		{"día 😀", "días 😀", NewTextOperation().Retain(3).Insert("s")},
+		{"día 😀!", "día !", NewTextOperation().Retain(4).Delete(1)},
+		{"same", "same", NewTextOperation()},
+	} {
+		if got := Diff(tt.old, tt.new); got.String() != tt.want.String() {
+			t.Errorf("Diff(%q, %q) = %s, want %s", tt.old, tt.new, got, tt.want)
+		}
+	}
+}
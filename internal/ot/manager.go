@@ -1,60 +1,209 @@
 package ot
 
 import (
+	"errors"
+	"fmt"
 	"sync"
 )
 
+// DefaultHistorySize is the most committed operations a manager keeps for
+// transforming operations that arrive late, however far behind a client is
+const DefaultHistorySize = 1000
+
+// DefaultCompactInterval is the number of commits between compactions
+const DefaultCompactInterval = 100
+
+// ErrFutureVersion is returned when an operation claims a version the
+// document has not reached yet
+var ErrFutureVersion = errors.New("operation version is ahead of the document")
+
+// Snapshot is the text of a document at a version
+type Snapshot struct {
+	Text    string `json:"text"`
+	Version int    `json:"version"`
+}
+
+// StaleVersionError is returned when an operation is based on a version that
+// is older than the retained operation history
+type StaleVersionError struct {
+	Version int // Version the operation was based on
+	Oldest  int // Oldest version the manager can still transform from
+}
+
+func (e *StaleVersionError) Error() string {
+	return fmt.Sprintf("operation version %d is older than retained history (oldest %d)", e.Version, e.Oldest)
+}
+
 // Manager handles operational transformation for a document
 type Manager struct {
-	mu         sync.RWMutex
-	currentDoc string
-	version    int
+	mu      sync.RWMutex
+	doc     *Rope
+	version int
+
+	// Committed operations, oldest first. history[i] produced version
+	// version-len(history)+i+1. base is the text before the oldest of them.
+	history    []*Operation
+	base       *Rope
+	maxHistory int
+
+	// Newest version each connected client is known to have seen
+	acked map[string]int
+
+	// Undo and redo stacks by client ID
+	undo map[string]*undoStacks
+
+	// Selections by client ID, kept up to date with the document
+	selections map[string]Selection
 }
 
 // NewManager creates a new OT manager
 func NewManager(initialDoc string) *Manager {
+	return NewManagerAt(Snapshot{Text: initialDoc})
+}
+
+// NewManagerAt creates an OT manager for a document that was saved at a
+// version. Operations based on older versions are stale.
+func NewManagerAt(snapshot Snapshot) *Manager {
+	doc := NewRope(snapshot.Text)
 	return &Manager{
-		currentDoc: initialDoc,
-		version:    0,
+		doc:        doc,
+		version:    snapshot.Version,
+		base:       doc,
+		maxHistory: DefaultHistorySize,
+		acked:      make(map[string]int),
+		undo:       make(map[string]*undoStacks),
+		selections: make(map[string]Selection),
 	}
 }
 
-// ApplyOperation applies a new operation to the document
+// ApplyOperation transforms an operation against every operation committed
+// after the version it was based on, applies it to the document and returns
+// the transformed operation for broadcast. An operation whose edits were
+// entirely undone by concurrent edits is still committed, as a no-op.
 func (m *Manager) ApplyOperation(op *Operation) (*Operation, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// For now, just apply the operation directly without transformation
-	// since we're using simple content replacement
 	if op == nil {
 		return op, nil
 	}
 
+	m.ack(op.ClientID, op.Version)
+	op, err := m.transformSince(op)
+	if err != nil {
+		return nil, err
+	}
+
+	inverse, err := m.commit(op)
+	if err != nil {
+		return nil, err
+	}
+
+	// A new edit starts a new branch of redo history
+	stacks := m.undoStacksFor(op.ClientID)
+	stacks.pushUndo(inverse)
+	stacks.redo = nil
+
+	return op, nil
+}
+
+// transformSince brings an operation based on op.Version up to date with
+// everything committed after it
+func (m *Manager) transformSince(op *Operation) (*Operation, error) {
+	if op.Version > m.version {
+		return nil, ErrFutureVersion
+	}
+	oldest := m.version - len(m.history)
+	if op.Version < oldest {
+		return nil, &StaleVersionError{Version: op.Version, Oldest: oldest}
+	}
+
+	for _, committed := range m.history[op.Version-oldest:] {
+		op, _ = op.Transform(committed)
+	}
+	return op, nil
+}
+
+// OperationsSince returns the operations committed after version, oldest
+// first, for a client catching up
+func (m *Manager) OperationsSince(version int) ([]*Operation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if version > m.version {
+		return nil, ErrFutureVersion
+	}
+	oldest := m.version - len(m.history)
+	if version < oldest {
+		return nil, &StaleVersionError{Version: version, Oldest: oldest}
+	}
+	return append([]*Operation(nil), m.history[version-oldest:]...), nil
+}
+
+// Replay commits an operation that was committed before, as version
+// op.Version, when the document is rebuilt from storage. Unlike
+// ApplyOperation it neither transforms the operation nor gives its author
+// anything to undo.
+func (m *Manager) Replay(op *Operation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if op.Version != m.version+1 {
+		return fmt.Errorf("replaying version %d onto version %d", op.Version, m.version)
+	}
+	_, err := m.commit(op)
+	return err
+}
+
+// commit applies an up to date operation, records it in the history and
+// returns its inverse, or nil for a no-op
+func (m *Manager) commit(op *Operation) (TextOperation, error) {
+	text := op.Text()
+	inverse, err := text.InvertRope(m.doc)
+	if err != nil {
+		return nil, err
+	}
+
 	// Update the document
-	m.applyToDocument(op)
+	if err := m.applyToDocument(op); err != nil {
+		return nil, err
+	}
 
 	// Update version
 	m.version++
 	op.Version = m.version
 
-	return op, nil
-}
+	m.history = append(m.history, op)
+	if len(m.history) > m.maxHistory || m.version%DefaultCompactInterval == 0 {
+		m.compact()
+	}
 
+	m.transformUndoStacks(op)
+	m.transformSelections(op)
 
+	if text.IsNoop() {
+		return nil, nil
+	}
+	return inverse, nil
+}
 
 // GetCurrentDocument returns the current document state
 func (m *Manager) GetCurrentDocument() string {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	return m.currentDoc
+	return m.doc.String()
 }
 
 // SetCurrentDocument sets the current document state (for simple content replacement)
 func (m *Manager) SetCurrentDocument(content string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.currentDoc = content
+	m.doc = NewRope(content)
 	m.version = 0
+	m.history = nil
+	m.base = m.doc
+	m.acked = make(map[string]int)
+	m.undo = make(map[string]*undoStacks)
+	m.selections = make(map[string]Selection)
 }
 
 // GetVersion returns the current version
@@ -64,36 +213,27 @@ func (m *Manager) GetVersion() int {
 	return m.version
 }
 
-// applyToDocument applies an operation to the current document
-func (m *Manager) applyToDocument(op *Operation) {
-	runes := []rune(m.currentDoc)
-
-	switch op.Type {
-	case Insert:
-		if op.Position > len(runes) {
-			op.Position = len(runes)
-		}
-		newRunes := make([]rune, 0, len(runes)+1)
-		newRunes = append(newRunes, runes[:op.Position]...)
-		newRunes = append(newRunes, []rune(op.Character)...)
-		newRunes = append(newRunes, runes[op.Position:]...)
-		m.currentDoc = string(newRunes)
-
-	case Delete:
-		if op.Position >= len(runes) {
-			return
-		}
-		end := op.Position + op.Length
-		if end > len(runes) {
-			end = len(runes)
-		}
-		newRunes := make([]rune, 0, len(runes)-op.Length)
-		newRunes = append(newRunes, runes[:op.Position]...)
-		newRunes = append(newRunes, runes[end:]...)
-		m.currentDoc = string(newRunes)
-	}
+// Rope returns the current document. Ropes are immutable, so the result is
+// a snapshot that later operations do not change.
+func (m *Manager) Rope() *Rope {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.doc
 }
 
+// Snapshot returns the current text and version together
+func (m *Manager) Snapshot() Snapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return Snapshot{Text: m.doc.String(), Version: m.version}
+}
 
-
-
+// applyToDocument applies an operation to the current document
+func (m *Manager) applyToDocument(op *Operation) error {
+	doc, err := op.Text().ApplyRope(m.doc)
+	if err != nil {
+		return err
+	}
+	m.doc = doc
+	return nil
+}
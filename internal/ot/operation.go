@@ -9,8 +9,9 @@ import (
 type OperationType string
 
 const (
-	Insert OperationType = "insert"
-	Delete OperationType = "delete"
+	Insert   OperationType = "insert"
+	Delete   OperationType = "delete"
+	Compound OperationType = "compound"
 )
 
 // Operation represents a single edit operation
@@ -19,127 +20,77 @@ type Operation struct {
 	Position  int           `json:"position"`
 	Character string        `json:"character,omitempty"` // Only for Insert operations
 	Length    int           `json:"length,omitempty"`    // Only for Delete operations
+	Ops       TextOperation `json:"ops,omitempty"`       // Only for Compound operations
 	Version   int           `json:"version"`
 	ClientID  string        `json:"clientId"`
 }
 
-// NewInsertOperation creates a new insert operation
-func NewInsertOperation(position int, character string, version int, clientID string) *Operation {
-	return &Operation{
-		Type:      Insert,
-		Position:  position,
-		Character: character,
-		Version:   version,
-		ClientID:  clientID,
-	}
-}
-
-// NewDeleteOperation creates a new delete operation
-func NewDeleteOperation(position, length, version int, clientID string) *Operation {
-	return &Operation{
-		Type:     Delete,
-		Position: position,
-		Length:   length,
+// NewOperation wraps a text operation. Text operations made of a single
+// insert or delete keep the simple Insert/Delete form on the wire.
+func NewOperation(text TextOperation, version int, clientID string) *Operation {
+	op := &Operation{
+		Type:     Compound,
 		Version:  version,
 		ClientID: clientID,
 	}
-}
 
-// Transform transforms this operation against another concurrent operation
-// Returns the transformed operations for both this and the other operation
-func (op *Operation) Transform(other *Operation) (*Operation, *Operation) {
-	if op.Version < other.Version {
-		// This operation is older, transform it against the newer one
-		transformedOp, transformedOther := op.transformAgainst(other)
-		return transformedOp, transformedOther
-	} else if op.Version > other.Version {
-		// Other operation is older, transform it against this one
-		transformedOp, transformedOther := other.transformAgainst(op)
-		return transformedOp, transformedOther
+	text = text.trimmed()
+	position := 0
+	if len(text) > 0 && text[0].Retain > 0 {
+		position = text[0].Retain
+		text = text[1:]
 	}
-
-	// Same version, no transformation needed
-	return op, other
+	switch {
+	case len(text) == 1 && text[0].Insert != "":
+		op.Type, op.Position, op.Character = Insert, position, text[0].Insert
+	case len(text) == 1 && text[0].Delete > 0:
+		op.Type, op.Position, op.Length = Delete, position, text[0].Delete
+	case len(text) > 0:
+		op.Ops = text
+		if position > 0 {
+			op.Ops = append(TextOperation{{Retain: position}}, text...)
+		}
+	}
+	return op
 }
 
-// transformAgainst transforms this operation against another operation
-func (op *Operation) transformAgainst(other *Operation) (*Operation, *Operation) {
-	var transformedOp *Operation
-
-	switch op.Type {
-	case Insert:
-		transformedOp = op.transformInsert(other)
-	case Delete:
-		transformedOp = op.transformDelete(other)
-	default:
-		transformedOp = op
-	}
+// NewInsertOperation creates a new insert operation
+func NewInsertOperation(position int, character string, version int, clientID string) *Operation {
+	return NewOperation(*NewTextOperation().Retain(position).Insert(character), version, clientID)
+}
 
-	// For now, just return the transformed operation and the original other
-	// In a more sophisticated implementation, both operations would be transformed
-	return transformedOp, other
+// NewDeleteOperation creates a new delete operation
+func NewDeleteOperation(position, length, version int, clientID string) *Operation {
+	return NewOperation(*NewTextOperation().Retain(position).Delete(length), version, clientID)
 }
 
-// transformInsert transforms an insert operation
-func (op *Operation) transformInsert(other *Operation) *Operation {
-	switch other.Type {
+// Text returns the operation as a text operation
+func (op *Operation) Text() TextOperation {
+	switch op.Type {
 	case Insert:
-		// If other insert is before this insert, shift position right
-		if other.Position <= op.Position {
-			return NewInsertOperation(op.Position+1, op.Character, op.Version, op.ClientID)
-		}
-		return op
+		return *NewTextOperation().Retain(op.Position).Insert(op.Character)
 	case Delete:
-		// If delete is before insert, shift position left
-		if other.Position < op.Position {
-			newPos := op.Position - other.Length
-			if newPos < other.Position {
-				newPos = other.Position
-			}
-			return NewInsertOperation(newPos, op.Character, op.Version, op.ClientID)
-		}
-		return op
+		return *NewTextOperation().Retain(op.Position).Delete(op.Length)
+	case Compound:
+		return op.Ops.normalized()
 	}
-	return op
+	return nil
 }
 
-// transformDelete transforms a delete operation
-func (op *Operation) transformDelete(other *Operation) *Operation {
-	switch other.Type {
-	case Insert:
-		// If insert is before delete, shift position right
-		if other.Position <= op.Position {
-			return NewDeleteOperation(op.Position+1, op.Length, op.Version, op.ClientID)
-		}
-		return op
-	case Delete:
-		// Handle overlapping deletes
-		if other.Position < op.Position {
-			// Other delete starts before this delete
-			if other.Position+other.Length <= op.Position {
-				// No overlap, shift left
-				return NewDeleteOperation(op.Position-other.Length, op.Length, op.Version, op.ClientID)
-			} else {
-				// Overlap, adjust position and length
-				newPos := other.Position
-				newLen := op.Position + op.Length - (other.Position + other.Length)
-				if newLen <= 0 {
-					// Complete overlap, delete becomes no-op
-					return nil
-				}
-				return NewDeleteOperation(newPos, newLen, op.Version, op.ClientID)
-			}
-		} else if other.Position < op.Position+op.Length {
-			// Overlap, reduce length
-			newLen := op.Length - (op.Position + op.Length - other.Position)
-			if newLen <= 0 {
-				return nil
-			}
-			return NewDeleteOperation(op.Position, newLen, op.Version, op.ClientID)
-		}
-		return op
+// Transform transforms this operation against another concurrent operation
+// based on the same document. It returns op' and other' such that applying op
+// then other' gives the same document as applying other then op'. When both
+// insert at the same position, the text of the operation with the smaller
+// ClientID is placed first.
+func (op *Operation) Transform(other *Operation) (*Operation, *Operation) {
+	var transformedOp, transformedOther TextOperation
+	if other.ClientID < op.ClientID {
+		transformedOther, transformedOp = Transform(other.Text(), op.Text())
+	} else {
+		transformedOp, transformedOther = Transform(op.Text(), other.Text())
 	}
-	return op
+	return NewOperation(transformedOp, op.Version, op.ClientID),
+		NewOperation(transformedOther, other.Version, other.ClientID)
 }
 
 // ToJSON converts the operation to JSON
@@ -161,6 +112,8 @@ func (op *Operation) String() string {
 		return fmt.Sprintf("Insert('%s', %d) v%d", op.Character, op.Position, op.Version)
 	case Delete:
 		return fmt.Sprintf("Delete(%d, %d) v%d", op.Position, op.Length, op.Version)
+	case Compound:
+		return fmt.Sprintf("Compound(%s) v%d", op.Ops, op.Version)
 	}
 	return "Unknown operation"
 }
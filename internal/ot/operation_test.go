@@ -0,0 +1,232 @@
+package ot
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// alphabet mixes ASCII, multi-byte runes, astral runes and newlines so that
+// byte/rune confusion shows up quickly
+var alphabet = []rune("ab ç€😀\n")
+
+func randomText(r *rand.Rand, n int) string {
+	runes := make([]rune, n)
+	for i := range runes {
+		runes[i] = alphabet[r.Intn(len(alphabet))]
+	}
+	return string(runes)
+}
+
+// randomTextOperation generates a random multi-component operation that
+// applies to doc
+func randomTextOperation(r *rand.Rand, doc string) TextOperation {
+	remaining := len([]rune(doc))
+	op := NewTextOperation()
+	for remaining > 0 && r.Intn(5) > 0 {
+		n := r.Intn(remaining) + 1
+		switch r.Intn(3) {
+		case 0:
+			op.Retain(n)
+			remaining -= n
+		case 1:
+			op.Insert(randomText(r, r.Intn(4)+1))
+		case 2:
+			op.Delete(n)
+			remaining -= n
+		}
+	}
+	if r.Intn(3) == 0 {
+		op.Insert(randomText(r, r.Intn(3)+1))
+	}
+	return *op
+}
+
+// randomOperation generates a random operation that applies to doc, using
+// the legacy insert/delete forms about half of the time
+func randomOperation(r *rand.Rand, doc string, version int, clientID string) *Operation {
+	length := len([]rune(doc))
+	switch r.Intn(4) {
+	case 0:
+		return NewInsertOperation(r.Intn(length+1), randomText(r, r.Intn(3)+1), version, clientID)
+	case 1:
+		if length > 0 {
+			position := r.Intn(length)
+			return NewDeleteOperation(position, r.Intn(length-position)+1, version, clientID)
+		}
+	}
+	return NewOperation(randomTextOperation(r, doc), version, clientID)
+}
+
+func mustApply(t *testing.T, op *Operation, doc string) string {
+	t.Helper()
+	result, err := op.Text().Apply(doc)
+	if err != nil {
+		t.Fatalf("apply %s to %q: %v", op, doc, err)
+	}
+	return result
+}
+
+// checkConvergence asserts TP1 for a pair of concurrent operations
+func checkConvergence(t *testing.T, doc string, a, b *Operation) {
+	t.Helper()
+	aPrime, bPrime := a.Transform(b)
+	left := mustApply(t, bPrime, mustApply(t, a, doc))
+	right := mustApply(t, aPrime, mustApply(t, b, doc))
+	if left != right {
+		t.Fatalf("diverged on %q\na=%s b=%s\na'=%s b'=%s\n%q != %q", doc, a, b, aPrime, bPrime, left, right)
+	}
+
+	// Transforming in the other direction must agree
+	bOther, aOther := b.Transform(a)
+	if !reflect.DeepEqual(aOther.Text(), aPrime.Text()) || !reflect.DeepEqual(bOther.Text(), bPrime.Text()) {
+		t.Fatalf("transform is not symmetric for a=%s b=%s: %s/%s vs %s/%s", a, b, aPrime, bPrime, aOther, bOther)
+	}
+}
+
+func TestTransformConvergence(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		doc := randomText(r, r.Intn(12))
+		a := randomOperation(r, doc, 0, "alice")
+		b := randomOperation(r, doc, 0, "bob")
+		checkConvergence(t, doc, a, b)
+	}
+}
+
+func TestTransformKnownCases(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		a, b *Operation
+		want string
+	}{
+		{
+			name: "equal position inserts ordered by client",
+			doc:  "ab",
+			a:    NewInsertOperation(1, "X", 0, "bob"),
+			b:    NewInsertOperation(1, "Y", 0, "alice"),
+			want: "aYXb",
+		},
+		{
+			name: "insert shifts by rune length",
+			doc:  "ab",
+			a:    NewInsertOperation(0, "😀😀", 0, "alice"),
+			b:    NewInsertOperation(1, "x", 0, "bob"),
+			want: "😀😀axb",
+		},
+		{
+			name: "overlapping deletes",
+			doc:  "abcdef",
+			a:    NewDeleteOperation(1, 3, 0, "alice"),
+			b:    NewDeleteOperation(2, 3, 0, "bob"),
+			want: "af",
+		},
+		{
+			name: "delete containing another delete",
+			doc:  "abcdef",
+			a:    NewDeleteOperation(0, 6, 0, "alice"),
+			b:    NewDeleteOperation(2, 2, 0, "bob"),
+			want: "",
+		},
+		{
+			name: "insert inside concurrently deleted range",
+			doc:  "abcdef",
+			a:    NewDeleteOperation(1, 4, 0, "alice"),
+			b:    NewInsertOperation(3, "X", 0, "bob"),
+			want: "aXf",
+		},
+		{
+			name: "multi-byte delete and insert",
+			doc:  "ç€😀ç",
+			a:    NewDeleteOperation(1, 2, 0, "alice"),
+			b:    NewInsertOperation(2, "é", 0, "bob"),
+			want: "çéç",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkConvergence(t, tt.doc, tt.a, tt.b)
+			_, bPrime := tt.a.Transform(tt.b)
+			if got := mustApply(t, bPrime, mustApply(t, tt.a, tt.doc)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComposeAndInvert(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 10000; i++ {
+		doc := randomText(r, r.Intn(12))
+		a := randomTextOperation(r, doc)
+		afterA, err := a.Apply(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := randomTextOperation(r, afterA)
+		afterB, err := b.Apply(afterA)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		composed, err := a.Compose(b).Apply(doc)
+		if err != nil || composed != afterB {
+			t.Fatalf("compose of %s and %s on %q: got %q (%v), want %q", a, b, doc, composed, err, afterB)
+		}
+
+		inverse, err := a.Invert(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restored, err := inverse.Apply(afterA); err != nil || restored != doc {
+			t.Fatalf("invert of %s on %q: got %q (%v)", a, doc, restored, err)
+		}
+	}
+}
+
+func TestOperationJSONRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < 2000; i++ {
+		doc := randomText(r, r.Intn(12))
+		op := randomOperation(r, doc, r.Intn(100), "client-ç")
+
+		data, err := op.ToJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := OperationFromJSON(data)
+		if err != nil {
+			t.Fatalf("decode %s: %v", data, err)
+		}
+		if !reflect.DeepEqual(decoded, op) {
+			t.Fatalf("round trip changed %s into %s (%s)", op, decoded, data)
+		}
+		if mustApply(t, decoded, doc) != mustApply(t, op, doc) {
+			t.Fatalf("decoded %s applies differently", data)
+		}
+	}
+}
+
+func TestApplyOutOfRange(t *testing.T) {
+	tests := []*Operation{
+		NewInsertOperation(10, "x", 0, "alice"),
+		NewDeleteOperation(2, 10, 0, "alice"),
+		NewDeleteOperation(10, 1, 0, "alice"),
+		{Type: Insert, Position: -5, Character: "x"},
+		{Type: Delete, Position: -1, Length: -3},
+		{Type: Compound, Ops: TextOperation{{Retain: -2}, {Delete: 99}}},
+		{Type: Compound, Ops: TextOperation{{Retain: 1, Insert: "x", Delete: 1}, {}}},
+		{Type: "bogus", Position: 1},
+	}
+
+	for _, op := range tests {
+		m := NewManager("abc")
+		if _, err := m.ApplyOperation(op); err != nil {
+			if m.GetCurrentDocument() != "abc" || m.GetVersion() != 0 {
+				t.Errorf("rejected %s but the document changed to %q", op, m.GetCurrentDocument())
+			}
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package ot
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// maxLeafBytes is the largest chunk of text kept in a single rope leaf
+const maxLeafBytes = 1024
+
+// Rope is an immutable text buffer stored as a balanced tree of text chunks.
+// Inserting, deleting and looking up positions take O(log n) in the number
+// of runes. Edits return a new rope that shares unchanged chunks with the
+// old one, so keeping an old rope around is a free snapshot. The nil *Rope
+// is a valid empty rope.
+type Rope struct {
+	root *ropeNode
+}
+
+// ropeNode is either a leaf holding text or a branch with two children
+type ropeNode struct {
+	left, right *ropeNode
+	text        string // Only for leaves
+	runes       int    // Runes in the subtree
+	lines       int    // Newlines in the subtree
+	height      int
+}
+
+// NewRope creates a rope holding s
+func NewRope(s string) *Rope {
+	return &Rope{root: buildRope(s)}
+}
+
+// buildRope builds a balanced tree from s, cutting it into leaves on rune
+// boundaries
+func buildRope(s string) *ropeNode {
+	if len(s) <= maxLeafBytes {
+		return newLeaf(s)
+	}
+	mid := len(s) / 2
+	for mid > 0 && !utf8.RuneStart(s[mid]) {
+		mid--
+	}
+	return newBranch(buildRope(s[:mid]), buildRope(s[mid:]))
+}
+
+func newLeaf(s string) *ropeNode {
+	if s == "" {
+		return nil
+	}
+	return &ropeNode{
+		text:   s,
+		runes:  utf8.RuneCountInString(s),
+		lines:  strings.Count(s, "\n"),
+		height: 1,
+	}
+}
+
+func newBranch(left, right *ropeNode) *ropeNode {
+	return &ropeNode{
+		left:   left,
+		right:  right,
+		runes:  left.runes + right.runes,
+		lines:  left.lines + right.lines,
+		height: max(left.height, right.height) + 1,
+	}
+}
+
+func (n *ropeNode) isLeaf() bool {
+	return n.left == nil
+}
+
+func height(n *ropeNode) int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+// join concatenates two trees, keeping the result balanced
+func join(left, right *ropeNode) *ropeNode {
+	switch {
+	case left == nil:
+		return right
+	case right == nil:
+		return left
+	case left.isLeaf() && right.isLeaf() && len(left.text)+len(right.text) <= maxLeafBytes:
+		// Keep small edits from fragmenting the tree into tiny leaves
+		return newLeaf(left.text + right.text)
+	case left.height > right.height+1:
+		return rebalance(newBranch(left.left, join(left.right, right)))
+	case right.height > left.height+1:
+		return rebalance(newBranch(join(left, right.left), right.right))
+	}
+	return newBranch(left, right)
+}
+
+// rebalance restores the AVL invariant at n after one of its children grew
+// by at most one level
+func rebalance(n *ropeNode) *ropeNode {
+	switch balance := height(n.left) - height(n.right); {
+	case balance > 1:
+		left := n.left
+		if height(left.left) < height(left.right) {
+			left = rotateLeft(left)
+		}
+		return rotateRight(newBranch(left, n.right))
+	case balance < -1:
+		right := n.right
+		if height(right.right) < height(right.left) {
+			right = rotateRight(right)
+		}
+		return rotateLeft(newBranch(n.left, right))
+	}
+	return n
+}
+
+func rotateLeft(n *ropeNode) *ropeNode {
+	return newBranch(newBranch(n.left, n.right.left), n.right.right)
+}
+
+func rotateRight(n *ropeNode) *ropeNode {
+	return newBranch(n.left.left, newBranch(n.left.right, n.right))
+}
+
+// split cuts a tree into the first pos runes and the rest
+func split(n *ropeNode, pos int) (*ropeNode, *ropeNode) {
+	switch {
+	case n == nil:
+		return nil, nil
+	case pos <= 0:
+		return nil, n
+	case pos >= n.runes:
+		return n, nil
+	case n.isLeaf():
+		cut := byteOffset(n.text, pos)
+		return newLeaf(n.text[:cut]), newLeaf(n.text[cut:])
+	case pos <= n.left.runes:
+		left, right := split(n.left, pos)
+		return left, join(right, n.right)
+	}
+	left, right := split(n.right, pos-n.left.runes)
+	return join(n.left, left), right
+}
+
+// byteOffset returns the byte offset of the rune at index pos in s
+func byteOffset(s string, pos int) int {
+	for i := range s {
+		if pos == 0 {
+			return i
+		}
+		pos--
+	}
+	return len(s)
+}
+
+// Len returns the number of runes in the rope
+func (r *Rope) Len() int {
+	if r == nil || r.root == nil {
+		return 0
+	}
+	return r.root.runes
+}
+
+// LineCount returns the number of lines in the rope
+func (r *Rope) LineCount() int {
+	if r == nil || r.root == nil {
+		return 1
+	}
+	return r.root.lines + 1
+}
+
+// Insert returns a rope with s inserted before the rune at pos
+func (r *Rope) Insert(pos int, s string) *Rope {
+	root := r.node()
+	left, right := split(root, pos)
+	return &Rope{root: join(join(left, buildRope(s)), right)}
+}
+
+// Delete returns a rope without the n runes starting at pos
+func (r *Rope) Delete(pos, n int) *Rope {
+	left, rest := split(r.node(), pos)
+	_, right := split(rest, n)
+	return &Rope{root: join(left, right)}
+}
+
+// Slice returns the text between rune offsets start and end
+func (r *Rope) Slice(start, end int) string {
+	var b strings.Builder
+	appendRange(&b, r.node(), start, end)
+	return b.String()
+}
+
+// String returns the whole text
+func (r *Rope) String() string {
+	return r.Slice(0, r.Len())
+}
+
+// appendRange writes the runes of n between start and end to b
+func appendRange(b *strings.Builder, n *ropeNode, start, end int) {
+	if n == nil || start >= end || end <= 0 || start >= n.runes {
+		return
+	}
+	if n.isLeaf() {
+		from, to := 0, len(n.text)
+		if start > 0 {
+			from = byteOffset(n.text, start)
+		}
+		if end < n.runes {
+			to = byteOffset(n.text, end)
+		}
+		b.WriteString(n.text[from:to])
+		return
+	}
+	appendRange(b, n.left, start, end)
+	appendRange(b, n.right, start-n.left.runes, end-n.left.runes)
+}
+
+// LineCol returns the zero-based line and column (in runes) of a rune offset
+func (r *Rope) LineCol(offset int) (line, col int) {
+	offset = max(0, min(offset, r.Len()))
+	line = newlinesBefore(r.node(), offset)
+	return line, offset - r.lineStart(line)
+}
+
+// Offset returns the rune offset of a zero-based line and column. Positions
+// past the end of the line or text are clamped.
+func (r *Rope) Offset(line, col int) int {
+	line = max(0, min(line, r.LineCount()-1))
+	start := r.lineStart(line)
+	end := r.Len()
+	if line < r.LineCount()-1 {
+		end = r.lineStart(line+1) - 1
+	}
+	return start + max(0, min(col, end-start))
+}
+
+// lineStart returns the rune offset at which a line begins
+func (r *Rope) lineStart(line int) int {
+	if line == 0 {
+		return 0
+	}
+	offset := 0
+	n := r.node()
+	for !n.isLeaf() {
+		if line <= n.left.lines {
+			n = n.left
+			continue
+		}
+		line -= n.left.lines
+		offset += n.left.runes
+		n = n.right
+	}
+	for i, c := range []rune(n.text) {
+		if c == '\n' {
+			if line--; line == 0 {
+				return offset + i + 1
+			}
+		}
+	}
+	return offset + n.runes
+}
+
+// newlinesBefore counts the newlines among the first offset runes of n
+func newlinesBefore(n *ropeNode, offset int) int {
+	lines := 0
+	for n != nil && offset > 0 {
+		if n.isLeaf() {
+			for _, c := range []rune(n.text)[:min(offset, n.runes)] {
+				if c == '\n' {
+					lines++
+				}
+			}
+			break
+		}
+		if offset <= n.left.runes {
+			n = n.left
+			continue
+		}
+		lines += n.left.lines
+		offset -= n.left.runes
+		n = n.right
+	}
+	return lines
+}
+
+func (r *Rope) node() *ropeNode {
+	if r == nil {
+		return nil
+	}
+	return r.root
+}
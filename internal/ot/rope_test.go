@@ -0,0 +1,199 @@
+package ot
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// checkBalanced asserts the AVL invariant and cached metrics of every node
+func checkBalanced(t *testing.T, n *ropeNode) {
+	t.Helper()
+	if n == nil || n.isLeaf() {
+		return
+	}
+	if d := height(n.left) - height(n.right); d < -1 || d > 1 {
+		t.Fatalf("unbalanced node: heights %d and %d", height(n.left), height(n.right))
+	}
+	if n.runes != n.left.runes+n.right.runes || n.lines != n.left.lines+n.right.lines {
+		t.Fatal("stale node metrics")
+	}
+	checkBalanced(t, n.left)
+	checkBalanced(t, n.right)
+}
+
+func TestRopeMatchesString(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	for i := 0; i < 200; i++ {
+		want := []rune(randomText(r, r.Intn(3000)))
+		rope := NewRope(string(want))
+		snapshot, snapshotText := rope, string(want)
+
+		for j := 0; j < 50; j++ {
+			pos := r.Intn(len(want) + 1)
+			if r.Intn(2) == 0 {
+				insert := randomText(r, r.Intn(700))
+				rope = rope.Insert(pos, insert)
+				want = append(want[:pos], append([]rune(insert), want[pos:]...)...)
+			} else {
+				n := r.Intn(len(want) - pos + 1)
+				rope = rope.Delete(pos, n)
+				want = append(want[:pos], want[pos+n:]...)
+			}
+
+			if rope.Len() != len(want) {
+				t.Fatalf("Len() = %d, want %d", rope.Len(), len(want))
+			}
+			start := r.Intn(len(want) + 1)
+			end := start + r.Intn(len(want)-start+1)
+			if got := rope.Slice(start, end); got != string(want[start:end]) {
+				t.Fatalf("Slice(%d, %d) = %q, want %q", start, end, got, string(want[start:end]))
+			}
+		}
+
+		if rope.String() != string(want) {
+			t.Fatal("rope diverged from string")
+		}
+		if snapshot.String() != snapshotText {
+			t.Fatal("edits changed an earlier rope")
+		}
+		checkBalanced(t, rope.root)
+	}
+}
+
+func TestRopeLineCol(t *testing.T) {
+	r := rand.New(rand.NewSource(6))
+	for i := 0; i < 100; i++ {
+		text := randomText(r, r.Intn(5000))
+		rope := NewRope("").Insert(0, text)
+		lines := strings.Split(text, "\n")
+		if rope.LineCount() != len(lines) {
+			t.Fatalf("LineCount() = %d, want %d", rope.LineCount(), len(lines))
+		}
+
+		offset := 0
+		for line, content := range lines {
+			length := len([]rune(content))
+			for _, col := range []int{0, length / 2, length} {
+				if gotLine, gotCol := rope.LineCol(offset + col); gotLine != line || gotCol != col {
+					t.Fatalf("LineCol(%d) = %d:%d, want %d:%d", offset+col, gotLine, gotCol, line, col)
+				}
+				if got := rope.Offset(line, col); got != offset+col {
+					t.Fatalf("Offset(%d, %d) = %d, want %d", line, col, got, offset+col)
+				}
+			}
+			if got := rope.Offset(line, length+10); got != offset+length {
+				t.Fatalf("Offset past end of line %d = %d, want %d", line, got, offset+length)
+			}
+			offset += length + 1
+		}
+	}
+}
+
+func TestApplyRopeMatchesApply(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	for i := 0; i < 5000; i++ {
+		doc := randomText(r, r.Intn(40))
+		op := randomTextOperation(r, doc)
+		want, _ := op.Apply(doc)
+		got, err := op.ApplyRope(NewRope(doc))
+		if err != nil || got.String() != want {
+			t.Fatalf("%s on %q: got %q (%v), want %q", op, doc, got, err, want)
+		}
+		wantInverse, _ := op.Invert(doc)
+		gotInverse, err := op.InvertRope(NewRope(doc))
+		if err != nil || gotInverse.String() != wantInverse.String() {
+			t.Fatalf("inverse of %s on %q: got %s, want %s", op, doc, gotInverse, wantInverse)
+		}
+	}
+}
+
+// applyRunes is how documents were edited before ropes: convert to runes,
+// copy and convert back on every operation
+func applyRunes(doc string, op *Operation) string {
+	runes := []rune(doc)
+	switch op.Type {
+	case Insert:
+		newRunes := make([]rune, 0, len(runes)+1)
+		newRunes = append(newRunes, runes[:op.Position]...)
+		newRunes = append(newRunes, []rune(op.Character)...)
+		newRunes = append(newRunes, runes[op.Position:]...)
+		return string(newRunes)
+	case Delete:
+		newRunes := make([]rune, 0, len(runes)-op.Length)
+		newRunes = append(newRunes, runes[:op.Position]...)
+		newRunes = append(newRunes, runes[op.Position+op.Length:]...)
+		return string(newRunes)
+	}
+	return doc
+}
+
+// benchmarkSizes are the document sizes compared, in bytes of ASCII text
+var benchmarkSizes = []struct {
+	name string
+	size int
+}{
+	{"10KB", 10 << 10},
+	{"1MB", 1 << 20},
+	{"10MB", 10 << 20},
+}
+
+// keystrokes returns alternating single-character inserts and deletes at
+// random positions, like a user typing and correcting
+func keystrokes(size int) []*Operation {
+	r := rand.New(rand.NewSource(8))
+	ops := make([]*Operation, 1024)
+	for i := range ops {
+		if i%2 == 0 {
+			ops[i] = NewInsertOperation(r.Intn(size), "x", 0, "bench")
+		} else {
+			ops[i] = NewDeleteOperation(ops[i-1].Position, 1, 0, "bench")
+		}
+	}
+	return ops
+}
+
+func BenchmarkKeystroke(b *testing.B) {
+	for _, bs := range benchmarkSizes {
+		doc := strings.Repeat("lorem ipsum\n", bs.size/12)
+		ops := keystrokes(len(doc))
+
+		b.Run(fmt.Sprintf("runes/%s", bs.name), func(b *testing.B) {
+			current := doc
+			for i := 0; i < b.N; i++ {
+				current = applyRunes(current, ops[i%len(ops)])
+			}
+		})
+
+		b.Run(fmt.Sprintf("rope/%s", bs.name), func(b *testing.B) {
+			current := NewRope(doc)
+			for i := 0; i < b.N; i++ {
+				current, _ = ops[i%len(ops)].Text().ApplyRope(current)
+			}
+		})
+
+		b.Run(fmt.Sprintf("manager/%s", bs.name), func(b *testing.B) {
+			m := NewManager(doc)
+			for i := 0; i < b.N; i++ {
+				op := *ops[i%len(ops)]
+				op.Version = m.GetVersion()
+				if _, err := m.ApplyOperation(&op); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkLineCol(b *testing.B) {
+	for _, bs := range benchmarkSizes {
+		rope := NewRope(strings.Repeat("lorem ipsum\n", bs.size/12))
+		b.Run(bs.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				line, col := rope.LineCol((i * 7919) % rope.Len())
+				_ = rope.Offset(line, col)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package ot
+
+import "unicode/utf8"
+
+// Selection is the selected range of a client, in rune offsets. Anchor is
+// where the selection started and Head is where the cursor is; they are
+// equal when nothing is selected.
+type Selection struct {
+	Anchor int `json:"anchor"`
+	Head   int `json:"head"`
+}
+
+// Cursor returns an empty selection at position
+func Cursor(position int) Selection {
+	return Selection{Anchor: position, Head: position}
+}
+
+// Transform moves the selection through an operation. own tells whether the
+// operation was made by the owner of the selection: text a client types at
+// its own cursor lands before the cursor, while text others insert at that
+// position lands after it.
+func (s Selection) Transform(op TextOperation, own bool) Selection {
+	return Selection{
+		Anchor: transformIndex(s.Anchor, op, own),
+		Head:   transformIndex(s.Head, op, own),
+	}
+}
+
+// transformIndex moves a single offset through an operation
+func transformIndex(index int, op TextOperation, own bool) int {
+	newIndex := index
+	pos := 0 // Offset in the document before the operation
+	for _, c := range op {
+		switch {
+		case c.Retain > 0:
+			pos += c.Retain
+		case c.Insert != "":
+			if pos < index || (pos == index && own) {
+				newIndex += utf8.RuneCountInString(c.Insert)
+			}
+		case c.Delete > 0:
+			if pos < index {
+				newIndex -= min(c.Delete, index-pos)
+			}
+			pos += c.Delete
+		}
+		if pos > index {
+			break
+		}
+	}
+	return newIndex
+}
+
+// clamp keeps the selection inside a document of length runes
+func (s Selection) clamp(length int) Selection {
+	return Selection{
+		Anchor: max(0, min(s.Anchor, length)),
+		Head:   max(0, min(s.Head, length)),
+	}
+}
+
+// SetSelection records the selection a client made against version and
+// returns it transformed to the current version
+func (m *Manager) SetSelection(clientID string, sel Selection, version int) (Selection, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if version > m.version {
+		return Selection{}, ErrFutureVersion
+	}
+	m.ack(clientID, version)
+	oldest := m.version - len(m.history)
+	if version < oldest {
+		return Selection{}, &StaleVersionError{Version: version, Oldest: oldest}
+	}
+
+	for _, committed := range m.history[version-oldest:] {
+		sel = sel.Transform(committed.Text(), committed.ClientID == clientID)
+	}
+	sel = sel.clamp(m.doc.Len())
+	m.selections[clientID] = sel
+	return sel, nil
+}
+
+// Selections returns the current selection of every client that set one
+func (m *Manager) Selections() map[string]Selection {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	selections := make(map[string]Selection, len(m.selections))
+	for clientID, sel := range m.selections {
+		selections[clientID] = sel
+	}
+	return selections
+}
+
+// transformSelections moves every selection past a newly committed
+// operation
+func (m *Manager) transformSelections(op *Operation) {
+	text := op.Text()
+	for clientID, sel := range m.selections {
+		m.selections[clientID] = sel.Transform(text, clientID == op.ClientID)
+	}
+}
@@ -0,0 +1,51 @@
+package ot
+
+import "testing"
+
+func TestSelectionTransform(t *testing.T) {
+	tests := []struct {
+		name string
+		sel  Selection
+		op   TextOperation
+		own  bool
+		want Selection
+	}{
+		{"insert before", Cursor(3), *NewTextOperation().Insert("ab"), false, Cursor(5)},
+		{"insert after", Cursor(3), *NewTextOperation().Retain(4).Insert("ab"), false, Cursor(3)},
+		{"other's insert at cursor", Cursor(3), *NewTextOperation().Retain(3).Insert("ab"), false, Cursor(3)},
+		{"own insert at cursor", Cursor(3), *NewTextOperation().Retain(3).Insert("ab"), true, Cursor(5)},
+		{"multi-byte insert", Cursor(1), *NewTextOperation().Insert("😀€"), false, Cursor(3)},
+		{"delete before", Cursor(5), *NewTextOperation().Retain(1).Delete(2), false, Cursor(3)},
+		{"delete around", Cursor(3), *NewTextOperation().Retain(1).Delete(4), false, Cursor(1)},
+		{"delete after", Cursor(3), *NewTextOperation().Retain(3).Delete(4), false, Cursor(3)},
+		{"range shrinks", Selection{Anchor: 2, Head: 6}, *NewTextOperation().Retain(3).Delete(2), false, Selection{Anchor: 2, Head: 4}},
+		{"backwards range", Selection{Anchor: 6, Head: 2}, *NewTextOperation().Insert("x").Retain(4).Insert("yy"), false, Selection{Anchor: 9, Head: 3}},
+	}
+	for _, tt := range tests {
+		if got := tt.sel.Transform(tt.op, tt.own); got != tt.want {
+			t.Errorf("%s: %+v through %s = %+v, want %+v", tt.name, tt.sel, tt.op, got, tt.want)
+		}
+	}
+}
+
+func TestManagerTransformsSelections(t *testing.T) {
+	m := NewManager("one\ntwo\nthree")
+	m.SetSelection("alice", Selection{Anchor: 8, Head: 13}, 0)
+	m.ApplyOperation(NewInsertOperation(0, "zero\n", 0, "bob"))
+
+	// Carol placed a cursor on "two" before Bob's edit arrived
+	carol, err := m.SetSelection("carol", Cursor(4), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := Cursor(9); carol != want {
+		t.Errorf("carol's cursor = %+v, want %+v", carol, want)
+	}
+	if got, want := m.Selections()["alice"], (Selection{Anchor: 13, Head: 18}); got != want {
+		t.Errorf("alice's selection = %+v, want %+v", got, want)
+	}
+
+	if _, err := m.SetSelection("carol", Cursor(0), 2); err != ErrFutureVersion {
+		t.Errorf("selection at a future version: got %v, want ErrFutureVersion", err)
+	}
+}
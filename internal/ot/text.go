@@ -0,0 +1,395 @@
+package ot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrOutOfRange is returned when a text operation reaches past the end of
+// the document it is applied to
+var ErrOutOfRange = errors.New("operation extends past the end of the document")
+
+// Component is a single step of a text operation. Exactly one field is set:
+// Retain skips runes, Insert adds text and Delete removes runes.
+type Component struct {
+	Retain int    `json:"retain,omitempty"`
+	Insert string `json:"insert,omitempty"`
+	Delete int    `json:"delete,omitempty"`
+}
+
+// TextOperation is a sequence of retain, insert and delete components walked
+// from the start of the document. Runes past the last component are retained,
+// so the same operation can be applied to documents of any sufficient length.
+// All lengths are counted in runes.
+type TextOperation []Component
+
+// NewTextOperation creates an empty text operation
+func NewTextOperation() *TextOperation {
+	return &TextOperation{}
+}
+
+// Retain skips n runes
+func (t *TextOperation) Retain(n int) *TextOperation {
+	if n <= 0 {
+		return t
+	}
+	if last := len(*t) - 1; last >= 0 && (*t)[last].Retain > 0 {
+		(*t)[last].Retain += n
+		return t
+	}
+	*t = append(*t, Component{Retain: n})
+	return t
+}
+
+// Insert inserts s at the current position
+func (t *TextOperation) Insert(s string) *TextOperation {
+	if s == "" {
+		return t
+	}
+	ops := *t
+	last := len(ops) - 1
+	switch {
+	case last >= 0 && ops[last].Insert != "":
+		ops[last].Insert += s
+	case last >= 0 && ops[last].Delete > 0:
+		// Keep inserts ahead of adjacent deletes so equivalent operations
+		// always have the same components
+		if last > 0 && ops[last-1].Insert != "" {
+			ops[last-1].Insert += s
+		} else {
+			ops = append(ops, ops[last])
+			ops[last] = Component{Insert: s}
+		}
+	default:
+		ops = append(ops, Component{Insert: s})
+	}
+	*t = ops
+	return t
+}
+
+// Delete removes n runes at the current position
+func (t *TextOperation) Delete(n int) *TextOperation {
+	if n <= 0 {
+		return t
+	}
+	if last := len(*t) - 1; last >= 0 && (*t)[last].Delete > 0 {
+		(*t)[last].Delete += n
+		return t
+	}
+	*t = append(*t, Component{Delete: n})
+	return t
+}
+
+// append adds a component, merging it with the previous one where possible
+func (t *TextOperation) append(c Component) *TextOperation {
+	switch {
+	case c.Retain > 0:
+		return t.Retain(c.Retain)
+	case c.Insert != "":
+		return t.Insert(c.Insert)
+	default:
+		return t.Delete(c.Delete)
+	}
+}
+
+// normalized rebuilds the operation from its components, dropping empty ones
+// and merging neighbours. Operations decoded from JSON are normalized before
+// use.
+func (t TextOperation) normalized() TextOperation {
+	n := NewTextOperation()
+	for _, c := range t {
+		n.append(c)
+	}
+	return *n
+}
+
+// trimmed drops trailing retains, which are implied
+func (t TextOperation) trimmed() TextOperation {
+	for len(t) > 0 && t[len(t)-1].Retain > 0 {
+		t = t[:len(t)-1]
+	}
+	return t
+}
+
+// BaseLen returns the number of runes the operation walks over in the
+// document it is applied to
+func (t TextOperation) BaseLen() int {
+	n := 0
+	for _, c := range t {
+		n += c.Retain + c.Delete
+	}
+	return n
+}
+
+// IsNoop reports whether the operation leaves every document unchanged
+func (t TextOperation) IsNoop() bool {
+	for _, c := range t {
+		if c.Insert != "" || c.Delete > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply applies the operation to doc
+func (t TextOperation) Apply(doc string) (string, error) {
+	runes := []rune(doc)
+	var b strings.Builder
+	b.Grow(len(doc))
+	pos := 0
+	for _, c := range t {
+		switch {
+		case c.Retain > 0:
+			if c.Retain > len(runes)-pos {
+				return "", ErrOutOfRange
+			}
+			b.WriteString(string(runes[pos : pos+c.Retain]))
+			pos += c.Retain
+		case c.Insert != "":
+			b.WriteString(c.Insert)
+		case c.Delete > 0:
+			if c.Delete > len(runes)-pos {
+				return "", ErrOutOfRange
+			}
+			pos += c.Delete
+		}
+	}
+	b.WriteString(string(runes[pos:]))
+	return b.String(), nil
+}
+
+// Invert returns the operation that undoes t, given the document t was
+// applied to
+func (t TextOperation) Invert(doc string) (TextOperation, error) {
+	runes := []rune(doc)
+	inverse := NewTextOperation()
+	pos := 0
+	for _, c := range t {
+		switch {
+		case c.Retain > 0:
+			if c.Retain > len(runes)-pos {
+				return nil, ErrOutOfRange
+			}
+			inverse.Retain(c.Retain)
+			pos += c.Retain
+		case c.Insert != "":
+			inverse.Delete(utf8.RuneCountInString(c.Insert))
+		case c.Delete > 0:
+			if c.Delete > len(runes)-pos {
+				return nil, ErrOutOfRange
+			}
+			inverse.Insert(string(runes[pos : pos+c.Delete]))
+			pos += c.Delete
+		}
+	}
+	return inverse.trimmed(), nil
+}
+
+// ApplyRope applies the operation to a rope in O(k log n) for k components
+func (t TextOperation) ApplyRope(doc *Rope) (*Rope, error) {
+	remaining := doc.Len()
+	pos := 0
+	for _, c := range t {
+		switch {
+		case c.Retain > 0:
+			if c.Retain > remaining {
+				return nil, ErrOutOfRange
+			}
+			pos += c.Retain
+			remaining -= c.Retain
+		case c.Insert != "":
+			doc = doc.Insert(pos, c.Insert)
+			pos += utf8.RuneCountInString(c.Insert)
+		case c.Delete > 0:
+			if c.Delete > remaining {
+				return nil, ErrOutOfRange
+			}
+			doc = doc.Delete(pos, c.Delete)
+			remaining -= c.Delete
+		}
+	}
+	return doc, nil
+}
+
+// InvertRope is Invert for an operation applied to a rope
+func (t TextOperation) InvertRope(doc *Rope) (TextOperation, error) {
+	inverse := NewTextOperation()
+	pos := 0
+	for _, c := range t {
+		switch {
+		case c.Retain > 0:
+			if c.Retain > doc.Len()-pos {
+				return nil, ErrOutOfRange
+			}
+			inverse.Retain(c.Retain)
+			pos += c.Retain
+		case c.Insert != "":
+			inverse.Delete(utf8.RuneCountInString(c.Insert))
+		case c.Delete > 0:
+			if c.Delete > doc.Len()-pos {
+				return nil, ErrOutOfRange
+			}
+			inverse.Insert(doc.Slice(pos, pos+c.Delete))
+			pos += c.Delete
+		}
+	}
+	return inverse.trimmed(), nil
+}
+
+// Compose returns a single operation with the same effect as applying t and
+// then other
+func (t TextOperation) Compose(other TextOperation) TextOperation {
+	composed := NewTextOperation()
+	a, b := newComponentIter(t), newComponentIter(other)
+
+	for a.more() || b.more() {
+		switch {
+		case a.more() && a.cur.Delete > 0:
+			composed.Delete(a.cur.Delete)
+			a.next()
+		case b.more() && b.cur.Insert != "":
+			composed.Insert(b.cur.Insert)
+			b.next()
+		case !a.more():
+			composed.append(b.cur)
+			b.next()
+		case !b.more():
+			composed.append(a.cur)
+			a.next()
+		default:
+			n := min(a.len(), b.len())
+			switch {
+			case a.cur.Retain > 0 && b.cur.Retain > 0:
+				composed.Retain(n)
+			case a.cur.Retain > 0:
+				composed.Delete(n)
+			case b.cur.Retain > 0:
+				composed.Insert(a.peekInsert(n))
+			}
+			// An insert followed by a delete of the same text cancels out
+			a.consume(n)
+			b.consume(n)
+		}
+	}
+	return composed.trimmed()
+}
+
+// Transform takes two operations a and b that apply to the same document and
+// returns a' and b' such that applying a then b' gives the same document as
+// applying b then a'. When both insert at the same position, a's text is
+// placed first.
+func Transform(a, b TextOperation) (TextOperation, TextOperation) {
+	aPrime, bPrime := NewTextOperation(), NewTextOperation()
+	ia, ib := newComponentIter(a), newComponentIter(b)
+
+	for ia.more() || ib.more() {
+		switch {
+		case ia.more() && ia.cur.Insert != "":
+			aPrime.Insert(ia.cur.Insert)
+			bPrime.Retain(ia.len())
+			ia.next()
+		case ib.more() && ib.cur.Insert != "":
+			aPrime.Retain(ib.len())
+			bPrime.Insert(ib.cur.Insert)
+			ib.next()
+		case !ia.more():
+			// a leaves the rest of the document alone
+			bPrime.append(ib.cur)
+			ib.next()
+		case !ib.more():
+			aPrime.append(ia.cur)
+			ia.next()
+		default:
+			n := min(ia.len(), ib.len())
+			switch {
+			case ia.cur.Retain > 0 && ib.cur.Retain > 0:
+				aPrime.Retain(n)
+				bPrime.Retain(n)
+			case ia.cur.Delete > 0 && ib.cur.Retain > 0:
+				aPrime.Delete(n)
+			case ia.cur.Retain > 0 && ib.cur.Delete > 0:
+				bPrime.Delete(n)
+			}
+			// Runes deleted by both operations need no further deletion
+			ia.consume(n)
+			ib.consume(n)
+		}
+	}
+	return aPrime.trimmed(), bPrime.trimmed()
+}
+
+// String returns a string representation of the text operation
+func (t TextOperation) String() string {
+	parts := make([]string, len(t))
+	for i, c := range t {
+		switch {
+		case c.Retain > 0:
+			parts[i] = fmt.Sprintf("retain(%d)", c.Retain)
+		case c.Insert != "":
+			parts[i] = fmt.Sprintf("insert(%q)", c.Insert)
+		default:
+			parts[i] = fmt.Sprintf("delete(%d)", c.Delete)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// componentIter walks the components of a text operation, allowing the
+// current component to be consumed partially
+type componentIter struct {
+	ops TextOperation
+	i   int
+	cur Component
+}
+
+func newComponentIter(ops TextOperation) *componentIter {
+	it := &componentIter{ops: ops, i: -1}
+	it.next()
+	return it
+}
+
+// more reports whether there is a current component
+func (it *componentIter) more() bool {
+	return it.i < len(it.ops)
+}
+
+// next moves to the following non-empty component
+func (it *componentIter) next() {
+	for it.i++; it.i < len(it.ops); it.i++ {
+		it.cur = it.ops[it.i]
+		if it.len() > 0 {
+			return
+		}
+	}
+}
+
+// len returns the length in runes of what is left of the current component
+func (it *componentIter) len() int {
+	if it.cur.Insert != "" {
+		return utf8.RuneCountInString(it.cur.Insert)
+	}
+	return it.cur.Retain + it.cur.Delete
+}
+
+// peekInsert returns the first n runes of the current insert
+func (it *componentIter) peekInsert(n int) string {
+	return string([]rune(it.cur.Insert)[:n])
+}
+
+// consume removes n runes from the current component
+func (it *componentIter) consume(n int) {
+	if n >= it.len() {
+		it.next()
+		return
+	}
+	switch {
+	case it.cur.Retain > 0:
+		it.cur.Retain -= n
+	case it.cur.Insert != "":
+		it.cur.Insert = string([]rune(it.cur.Insert)[n:])
+	default:
+		it.cur.Delete -= n
+	}
+}
@@ -0,0 +1,129 @@
+package ot
+
+import "errors"
+
+// DefaultUndoDepth is the number of operations each client can undo
+const DefaultUndoDepth = 100
+
+var (
+	// ErrNothingToUndo is returned when a client has no operation left to undo
+	ErrNothingToUndo = errors.New("nothing to undo")
+
+	// ErrNothingToRedo is returned when a client has no undone operation to redo
+	ErrNothingToRedo = errors.New("nothing to redo")
+)
+
+// undoStacks holds one client's undo and redo history. Each stack holds
+// inverse operations, newest last: the newest entry applies to the current
+// document and every older entry applies to the document left by undoing the
+// entries above it. Entries are transformed against other clients' edits as
+// they are committed, so they always stay valid.
+type undoStacks struct {
+	undo []TextOperation
+	redo []TextOperation
+}
+
+func (s *undoStacks) pushUndo(inverse TextOperation) {
+	if inverse == nil {
+		return
+	}
+	s.undo = append(s.undo, inverse)
+	if len(s.undo) > DefaultUndoDepth {
+		s.undo = append(s.undo[:0:0], s.undo[len(s.undo)-DefaultUndoDepth:]...)
+	}
+}
+
+func (s *undoStacks) pushRedo(inverse TextOperation) {
+	if inverse == nil {
+		return
+	}
+	s.redo = append(s.redo, inverse)
+}
+
+// undoStacksFor returns the stacks of a client, creating them if needed
+func (m *Manager) undoStacksFor(clientID string) *undoStacks {
+	stacks, ok := m.undo[clientID]
+	if !ok {
+		stacks = &undoStacks{}
+		m.undo[clientID] = stacks
+	}
+	return stacks
+}
+
+// transformUndoStacks moves every other client's undo and redo entries past
+// a newly committed operation
+func (m *Manager) transformUndoStacks(op *Operation) {
+	for clientID, stacks := range m.undo {
+		if clientID == op.ClientID {
+			continue
+		}
+		transformStack(stacks.undo, clientID, op)
+		transformStack(stacks.redo, clientID, op)
+	}
+}
+
+// transformStack transforms the entries of a stack, newest first, against
+// an operation that applies to the current document
+func transformStack(stack []TextOperation, clientID string, op *Operation) {
+	for i := len(stack) - 1; i >= 0; i-- {
+		entry, transformed := NewOperation(stack[i], 0, clientID).Transform(op)
+		stack[i] = entry.Text()
+		op = transformed
+	}
+}
+
+// Undo reverts the last operation committed by a client. Its inverse has
+// been transformed against everything committed since, so edits made by
+// other clients in the meantime are kept. The committed undo operation is
+// returned for broadcast.
+func (m *Manager) Undo(clientID string) (*Operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stacks := m.undoStacksFor(clientID)
+	if len(stacks.undo) == 0 {
+		return nil, ErrNothingToUndo
+	}
+	entry := stacks.undo[len(stacks.undo)-1]
+	stacks.undo = stacks.undo[:len(stacks.undo)-1]
+
+	op := NewOperation(entry, m.version, clientID)
+	inverse, err := m.commit(op)
+	if err != nil {
+		return nil, err
+	}
+	stacks.pushRedo(inverse)
+	return op, nil
+}
+
+// Redo reapplies the last operation a client undid, as long as the client
+// has not made another edit since
+func (m *Manager) Redo(clientID string) (*Operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stacks := m.undoStacksFor(clientID)
+	if len(stacks.redo) == 0 {
+		return nil, ErrNothingToRedo
+	}
+	entry := stacks.redo[len(stacks.redo)-1]
+	stacks.redo = stacks.redo[:len(stacks.redo)-1]
+
+	op := NewOperation(entry, m.version, clientID)
+	inverse, err := m.commit(op)
+	if err != nil {
+		return nil, err
+	}
+	stacks.pushUndo(inverse)
+	return op, nil
+}
+
+// RemoveClient drops the per-client state kept for a client that has left
+func (m *Manager) RemoveClient(clientID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.undo, clientID)
+	delete(m.selections, clientID)
+	delete(m.acked, clientID)
+	m.compact()
+}
@@ -0,0 +1,86 @@
+package ot
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestUndoKeepsOtherClientsEdits(t *testing.T) {
+	m := NewManager("hello world")
+
+	apply := func(op *Operation) {
+		t.Helper()
+		if _, err := m.ApplyOperation(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	apply(NewInsertOperation(5, ",", 0, "alice"))  // "hello, world"
+	apply(NewInsertOperation(0, ">> ", 1, "bob"))  // ">> hello, world"
+	apply(NewDeleteOperation(6, 6, 1, "bob"))      // concurrent with bob's insert: ">> hello,"
+	apply(NewInsertOperation(12, "!", 1, "alice")) // ">> hello,!"
+
+	steps := []struct {
+		do   func(string) (*Operation, error)
+		want string
+	}{
+		{m.Undo, ">> hello,"},
+		{m.Undo, ">> hello"},
+		{m.Redo, ">> hello,"},
+		{m.Redo, ">> hello,!"},
+	}
+	for i, step := range steps {
+		if _, err := step.do("alice"); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if got := m.GetCurrentDocument(); got != step.want {
+			t.Fatalf("step %d: got %q, want %q", i, got, step.want)
+		}
+	}
+
+	if _, err := m.Redo("alice"); err != ErrNothingToRedo {
+		t.Errorf("expected ErrNothingToRedo, got %v", err)
+	}
+	if _, err := m.Undo("carol"); err != ErrNothingToUndo {
+		t.Errorf("expected ErrNothingToUndo, got %v", err)
+	}
+}
+
+func TestUndoEverythingRestoresOthersText(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	for i := 0; i < 500; i++ {
+		m := NewManager("")
+
+		// Alice and Bob take turns; Bob only ever appends, so after Alice
+		// undoes everything the document must be exactly Bob's text
+		bob := ""
+		for j := 0; j < 10; j++ {
+			doc := m.GetCurrentDocument()
+			if r.Intn(2) == 0 {
+				insert := randomText(r, r.Intn(3)+1)
+				if _, err := m.ApplyOperation(NewInsertOperation(len([]rune(doc)), insert, m.GetVersion(), "bob")); err != nil {
+					t.Fatal(err)
+				}
+				bob += insert
+				continue
+			}
+			// Alice edits only in front of Bob's text
+			prefix := len([]rune(doc)) - len([]rune(bob))
+			op := randomTextOperation(r, string([]rune(doc)[:prefix]))
+			if _, err := m.ApplyOperation(NewOperation(op, m.GetVersion(), "alice")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for {
+			if _, err := m.Undo("alice"); err == ErrNothingToUndo {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := m.GetCurrentDocument(); got != bob {
+			t.Fatalf("after undoing alice: got %q, want %q", got, bob)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Package otclient implements the client side of the OT protocol. A client
+// keeps at most one operation in flight, composes the edits made while it
+// waits for the server's acknowledgement, and transforms operations from
+// other clients against its unacknowledged edits.
+//
+// It only tracks operations; applying them to a copy of the document is up
+// to the caller. Both the server-side proxy for legacy browsers and Go
+// programs talking to the server use it.
+package otclient
+
+import (
+	"errors"
+
+	"collaborative-markdown-editor/internal/ot"
+)
+
+// State tells which unacknowledged edits a client has
+type State int
+
+const (
+	// Synchronized clients have no unacknowledged edits
+	Synchronized State = iota
+	// AwaitingConfirm clients have sent an operation and wait for the
+	// server to acknowledge it
+	AwaitingConfirm
+	// AwaitingWithBuffer clients wait for an acknowledgement and have made
+	// more edits since
+	AwaitingWithBuffer
+)
+
+func (s State) String() string {
+	switch s {
+	case Synchronized:
+		return "synchronized"
+	case AwaitingConfirm:
+		return "awaiting confirm"
+	case AwaitingWithBuffer:
+		return "awaiting with buffer"
+	}
+	return "unknown"
+}
+
+// ErrNothingPending is returned for an acknowledgement when no operation is
+// in flight
+var ErrNothingPending = errors.New("otclient: acknowledgement without a pending operation")
+
+// Client tracks the OT state of one client. It is not safe for concurrent
+// use.
+type Client struct {
+	id      string
+	version int
+
+	// Operation sent to the server and not acknowledged yet, and edits made
+	// since then, composed. Both are nil when there is nothing to track.
+	pending ot.TextOperation
+	buffer  ot.TextOperation
+}
+
+// New creates a synchronized client whose document is at version
+func New(clientID string, version int) *Client {
+	return &Client{id: clientID, version: version}
+}
+
+// ID returns the client ID operations are sent with
+func (c *Client) ID() string {
+	return c.id
+}
+
+// Version returns the last server version the client has seen
+func (c *Client) Version() int {
+	return c.version
+}
+
+// State returns the state the client is in
+func (c *Client) State() State {
+	switch {
+	case c.pending == nil:
+		return Synchronized
+	case c.buffer == nil:
+		return AwaitingConfirm
+	}
+	return AwaitingWithBuffer
+}
+
+// Pending returns the operation in flight, or nil
+func (c *Client) Pending() *ot.Operation {
+	if c.pending == nil {
+		return nil
+	}
+	return ot.NewOperation(c.pending, c.version, c.id)
+}
+
+// ApplyLocal records an edit made to the local document and returns the
+// operation to send to the server, or nil if it has to wait for the
+// operation in flight to be acknowledged
+func (c *Client) ApplyLocal(edit ot.TextOperation) *ot.Operation {
+	if edit.IsNoop() {
+		return nil
+	}
+	switch c.State() {
+	case Synchronized:
+		c.pending = edit
+		return c.Pending()
+	case AwaitingConfirm:
+		c.buffer = edit
+	default:
+		c.buffer = c.buffer.Compose(edit)
+	}
+	return nil
+}
+
+// ApplyRemote takes an operation another client committed and returns it
+// transformed to apply to the local document, on top of the unacknowledged
+// edits
+func (c *Client) ApplyRemote(op *ot.Operation) *ot.Operation {
+	// The operation does not know about our unacknowledged edits, and they
+	// do not know about it
+	if c.pending != nil {
+		var pending *ot.Operation
+		pending, op = ot.NewOperation(c.pending, c.version, c.id).Transform(op)
+		c.pending = pending.Text()
+	}
+	if c.buffer != nil {
+		var buffer *ot.Operation
+		buffer, op = ot.NewOperation(c.buffer, c.version, c.id).Transform(op)
+		c.buffer = buffer.Text()
+	}
+	c.version = op.Version
+	return op
+}
+
+// Ack marks the operation in flight as committed as version and returns the
+// buffered edits to send next, or nil if there are none
+func (c *Client) Ack(version int) (*ot.Operation, error) {
+	if c.pending == nil {
+		return nil, ErrNothingPending
+	}
+	c.version = version
+	c.pending, c.buffer = c.buffer, nil
+	return c.Pending(), nil
+}
+
+// Reset drops the unacknowledged edits of a client that started over from
+// the server's document at version
+func (c *Client) Reset(version int) {
+	c.version = version
+	c.pending, c.buffer = nil, nil
+}
+
+// TransformSelection moves a selection made at the client's version, such
+// as another client's selection sent by the server, to the local document
+func (c *Client) TransformSelection(sel ot.Selection) ot.Selection {
+	if c.pending != nil {
+		sel = sel.Transform(c.pending, false)
+	}
+	if c.buffer != nil {
+		sel = sel.Transform(c.buffer, false)
+	}
+	return sel
+}
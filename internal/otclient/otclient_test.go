@@ -0,0 +1,174 @@
+package otclient
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"collaborative-markdown-editor/internal/ot"
+)
+
+func TestStates(t *testing.T) {
+	c := New("bob", 3)
+	if c.State() != Synchronized {
+		t.Fatalf("new client is %s", c.State())
+	}
+
+	op := c.ApplyLocal(*ot.NewTextOperation().Insert("a"))
+	if op == nil || op.Version != 3 || op.ClientID != "bob" {
+		t.Fatalf("first edit not sent: %v", op)
+	}
+	if c.State() != AwaitingConfirm {
+		t.Fatalf("after sending: %s", c.State())
+	}
+
+	if op := c.ApplyLocal(*ot.NewTextOperation().Retain(1).Insert("b")); op != nil {
+		t.Fatalf("second edit sent while awaiting confirm: %v", op)
+	}
+	if op := c.ApplyLocal(*ot.NewTextOperation().Retain(2).Insert("c")); op != nil {
+		t.Fatalf("third edit sent while awaiting confirm: %v", op)
+	}
+	if c.State() != AwaitingWithBuffer {
+		t.Fatalf("after buffering: %s", c.State())
+	}
+
+	// Alice's insert at the start moves the buffered edits
+	remote := c.ApplyRemote(ot.NewInsertOperation(0, "xy", 4, "alice"))
+	if remote.Position != 0 || c.Version() != 4 {
+		t.Fatalf("remote operation %v at version %d", remote, c.Version())
+	}
+
+	op, err := c.Ack(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op == nil || op.Version != 5 {
+		t.Fatalf("buffer not sent after ack: %v", op)
+	}
+	if got, err := op.Text().Apply("xya"); err != nil || got != "xyabc" {
+		t.Fatalf("buffer applies as %q, %v", got, err)
+	}
+	if c.State() != AwaitingConfirm {
+		t.Fatalf("after first ack: %s", c.State())
+	}
+
+	if op, err := c.Ack(6); err != nil || op != nil {
+		t.Fatalf("second ack: %v, %v", op, err)
+	}
+	if c.State() != Synchronized || c.Version() != 6 {
+		t.Fatalf("after second ack: %s at version %d", c.State(), c.Version())
+	}
+	if _, err := c.Ack(7); err != ErrNothingPending {
+		t.Fatalf("expected ErrNothingPending, got %v", err)
+	}
+}
+
+func TestTransformSelection(t *testing.T) {
+	c := New("alice", 0)
+	c.ApplyLocal(*ot.NewTextOperation().Insert("ab"))          // In flight
+	c.ApplyLocal(*ot.NewTextOperation().Retain(5).Insert("!")) // Buffered
+
+	// Bob's cursor sits after "hel" in "hel|lo" at version 0
+	got := c.TransformSelection(ot.Cursor(3))
+	if want := ot.Cursor(5); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+// peer is a document edited through a Client
+type peer struct {
+	client *Client
+	doc    string
+	inbox  []*ot.Operation // Committed operations, in order
+}
+
+func (p *peer) edit(r *rand.Rand) *ot.Operation {
+	text := []rune(p.doc)
+	pos := r.Intn(len(text) + 1)
+	end := pos + r.Intn(len(text)-pos+1)
+	if r.Intn(2) == 0 {
+		end = pos
+	}
+	next := string(text[:pos]) + string(rune('a'+r.Intn(26))) + string(text[end:])
+	op := p.client.ApplyLocal(ot.Diff(p.doc, next))
+	p.doc = next
+	return op
+}
+
+func (p *peer) receive(t *testing.T) *ot.Operation {
+	committed := p.inbox[0]
+	p.inbox = p.inbox[1:]
+	if committed.ClientID == p.client.ID() {
+		op, err := p.client.Ack(committed.Version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return op
+	}
+	doc, err := p.client.ApplyRemote(committed).Text().Apply(p.doc)
+	if err != nil {
+		t.Fatalf("peer %s: %v", p.client.ID(), err)
+	}
+	p.doc = doc
+	return nil
+}
+
+func TestConvergence(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		m := ot.NewManager("hello")
+		peers := make([]*peer, 3)
+		for j := range peers {
+			peers[j] = &peer{client: New(fmt.Sprintf("peer%d", j), 0), doc: "hello"}
+		}
+
+		var toServer []*ot.Operation
+		commit := func() {
+			committed, err := m.ApplyOperation(toServer[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			toServer = toServer[1:]
+			for _, p := range peers {
+				p.inbox = append(p.inbox, committed)
+			}
+		}
+		send := func(op *ot.Operation) {
+			if op != nil {
+				toServer = append(toServer, op)
+			}
+		}
+
+		for step := 0; step < 100; step++ {
+			p := peers[r.Intn(len(peers))]
+			switch {
+			case r.Intn(3) == 0:
+				send(p.edit(r))
+			case len(p.inbox) > 0:
+				send(p.receive(t))
+			case len(toServer) > 0:
+				commit()
+			}
+		}
+		for busy := true; busy; {
+			busy = len(toServer) > 0
+			for len(toServer) > 0 {
+				commit()
+			}
+			for _, p := range peers {
+				for len(p.inbox) > 0 {
+					busy = true
+					send(p.receive(t))
+				}
+			}
+		}
+
+		want := m.GetCurrentDocument()
+		for _, p := range peers {
+			if p.doc != want || p.client.State() != Synchronized || p.client.Version() != m.GetVersion() {
+				t.Fatalf("peer %s diverged: %q (%s, version %d), server %q at version %d",
+					p.client.ID(), p.doc, p.client.State(), p.client.Version(), want, m.GetVersion())
+			}
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Package protocol defines the messages exchanged over the WebSocket
+// channel. Every message is an envelope naming its type and protocol
+// version, with a type-specific payload.
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"collaborative-markdown-editor/internal/acl"
+	"collaborative-markdown-editor/internal/ot"
+)
+
+// Version is the protocol version spoken by this package
+const Version = 1
+
+// Type names the kind of message an envelope carries
+type Type string
+
+const (
+	TypeOp       Type = "op"       // An operation, payload *ot.Operation
+	TypeAck      Type = "ack"      // A client's operation was committed, payload Ack
+	TypeInit     Type = "init"     // First message to a client, payload Init
+	TypePresence Type = "presence" // Selections, payload Presence
+	TypeUserList Type = "userList" // Users in the room, payload UserList
+	TypeError    Type = "error"    // A message was rejected, payload Error
+	TypeResync   Type = "resync"   // Whole document for a client that fell behind, payload Resync
+	TypeUndo     Type = "undo"     // Undo the client's last edit, no payload
+	TypeRedo     Type = "redo"     // Redo the client's last undone edit, no payload
+	TypeAccess   Type = "access"   // What the client may do in the room changed, payload Access
+)
+
+var (
+	// ErrNotEnvelope is returned when a frame is not an envelope at all, such
+	// as the plain-text frames legacy clients send
+	ErrNotEnvelope = errors.New("not a protocol envelope")
+
+	// ErrUnsupportedVersion is returned for envelopes of another protocol
+	// version
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+)
+
+// Envelope wraps every message
+type Envelope struct {
+	Type    Type            `json:"type"`
+	V       int             `json:"v"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Ack tells a client which version its operation became
+type Ack struct {
+	Version int `json:"version"`
+}
+
+// Init starts a client off with its ID, the user it connected as, the
+// document and the users in the room. Session is the token to reconnect
+// with.
+//
+// A client that reconnects with its token and the last version it saw is
+// first sent the operations it missed, its own as acks. Resumed init then
+// tells it the replay is over: it keeps its unacknowledged edits and sends
+// the one it had in flight again if that was not acknowledged. When the
+// missed operations are no longer known, Resumed is false and the client
+// starts over from Content like a new one.
+type Init struct {
+	ClientID string `json:"clientId"`
+	UserID   string `json:"userId,omitempty"`
+	Content  string `json:"content"`
+	Version  int    `json:"version"`
+	Users    []User `json:"users"`
+	Session  string `json:"session,omitempty"`
+	Resumed  bool   `json:"resumed,omitempty"`
+
+	// What the client may do in the room. Clients that may not edit it
+	// have their edits rejected with CodeForbidden.
+	Role acl.Role `json:"role"`
+
+	// Who wrote each run of Content, in order, for clients that asked for
+	// it. Authors are user IDs, so users in the room can be told apart by
+	// their color.
+	Authors []ot.Span `json:"authors,omitempty"`
+}
+
+// User describes a user in a room. Someone with the room open in several
+// tabs is one user with a client ID for each; Selection is the one they
+// moved last.
+type User struct {
+	ID        string       `json:"id"`
+	Username  string       `json:"username"`
+	Color     string       `json:"color"`
+	Selection ot.Selection `json:"selection"`
+	Clients   []string     `json:"clients,omitempty"`
+}
+
+// UserList carries the users in a room
+type UserList struct {
+	Users []User `json:"users"`
+}
+
+// Presence carries selections. Clients send their own Selection, made
+// against Version; the server sends the Selections of everyone in the room
+// at Version.
+type Presence struct {
+	Version    int                     `json:"version"`
+	Selection  *ot.Selection           `json:"selection,omitempty"`
+	Selections map[string]ot.Selection `json:"selections,omitempty"`
+}
+
+// Error codes
+const (
+	CodeInvalidMessage = "invalid_message" // The message could not be decoded or failed validation
+	CodeUnsupported    = "unsupported"     // The room cannot do what was asked
+	CodeRejected       = "rejected"        // The operation does not apply to the document
+	CodeForbidden      = "forbidden"       // The client's role does not allow it
+)
+
+// Error tells a client that one of its messages was rejected
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Access tells a client that what it may do in the room changed. Clients
+// that may no longer open the room get None before they are dropped.
+type Access struct {
+	Role acl.Role `json:"role"`
+}
+
+// Resync carries the whole document to a client that fell behind the
+// history the server keeps
+type Resync struct {
+	Content string `json:"content"`
+	Version int    `json:"version"`
+}
+
+// Encode wraps a payload in an envelope of the given type. A nil payload
+// leaves the payload out.
+func Encode(t Type, payload interface{}) ([]byte, error) {
+	env := Envelope{Type: t, V: Version}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		env.Payload = data
+	}
+	return json.Marshal(env)
+}
+
+// MustEncode is like Encode for payloads that always marshal
+func MustEncode(t Type, payload interface{}) []byte {
+	data, err := Encode(t, payload)
+	if err != nil {
+		panic(fmt.Sprintf("protocol: encode %s: %v", t, err))
+	}
+	return data
+}
+
+// Decode parses and validates an envelope. Its payload is validated when
+// it is decoded with DecodePayload.
+func Decode(frame []byte) (*Envelope, error) {
+	frame = bytes.TrimSpace(frame)
+	if len(frame) == 0 || frame[0] != '{' {
+		return nil, ErrNotEnvelope
+	}
+	var raw struct {
+		Type    Type            `json:"type"`
+		V       *int            `json:"v"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(frame, &raw); err != nil || raw.V == nil {
+		return nil, ErrNotEnvelope
+	}
+	if *raw.V != Version {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedVersion, *raw.V)
+	}
+	needsPayload, ok := payloadTypes[raw.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown message type %q", raw.Type)
+	}
+	if needsPayload && (len(raw.Payload) == 0 || string(raw.Payload) == "null") {
+		return nil, fmt.Errorf("%s message without payload", raw.Type)
+	}
+	return &Envelope{Type: raw.Type, V: *raw.V, Payload: raw.Payload}, nil
+}
+
+// payloadTypes lists the known message types and whether they need a
+// payload
+var payloadTypes = map[Type]bool{
+	TypeOp:       true,
+	TypeAck:      true,
+	TypeInit:     true,
+	TypePresence: true,
+	TypeUserList: true,
+	TypeError:    true,
+	TypeResync:   true,
+	TypeAccess:   true,
+	TypeUndo:     false,
+	TypeRedo:     false,
+}
+
+// DecodePayload decodes the payload of an envelope into v and validates it
+func (e *Envelope) DecodePayload(v interface{}) error {
+	if err := json.Unmarshal(e.Payload, v); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", e.Type, err)
+	}
+	if err := validate(v); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", e.Type, err)
+	}
+	return nil
+}
+
+// DecodeOp decodes the operation carried by an op message
+func (e *Envelope) DecodeOp() (*ot.Operation, error) {
+	if e.Type != TypeOp {
+		return nil, fmt.Errorf("%s message is not an operation", e.Type)
+	}
+	var op ot.Operation
+	if err := e.DecodePayload(&op); err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
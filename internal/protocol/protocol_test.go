@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"collaborative-markdown-editor/internal/acl"
+	"collaborative-markdown-editor/internal/ot"
+)
+
+func TestRoundTrip(t *testing.T) {
+	sel := ot.Selection{Anchor: 1, Head: 4}
+	for _, tt := range []struct {
+		t       Type
+		payload interface{}
+		decoded interface{}
+	}{
+		{TypeOp, ot.NewInsertOperation(2, "ç😀", 3, "alice"), &ot.Operation{}},
+		{TypeOp, ot.NewOperation(*ot.NewTextOperation().Retain(1).Insert("x").Delete(2), 0, "bob"), &ot.Operation{}},
+		{TypeAck, &Ack{Version: 7}, &Ack{}},
+		{TypeInit, &Init{ClientID: "c1", Content: "# Title\n", Version: 2, Users: []User{{ID: "c1", Username: "Fox", Color: "#FFF", Selection: sel}}, Role: acl.Editor}, &Init{}},
+		{TypePresence, &Presence{Version: 3, Selection: &sel}, &Presence{}},
+		{TypePresence, &Presence{Version: 3, Selections: map[string]ot.Selection{"c1": sel}}, &Presence{}},
+		{TypeUserList, &UserList{Users: []User{{ID: "c2", Username: "Owl"}}}, &UserList{}},
+		{TypeError, &Error{Code: CodeRejected, Message: "out of range"}, &Error{}},
+		{TypeResync, &Resync{Content: "text", Version: 9}, &Resync{}},
+		{TypeAccess, &Access{Role: acl.Viewer}, &Access{}},
+	} {
+		frame, err := Encode(tt.t, tt.payload)
+		if err != nil {
+			t.Fatalf("encode %s: %v", tt.t, err)
+		}
+		env, err := Decode(frame)
+		if err != nil {
+			t.Fatalf("decode %s: %v", frame, err)
+		}
+		if env.Type != tt.t || env.V != Version {
+			t.Fatalf("decoded %s as %s v%d", frame, env.Type, env.V)
+		}
+		if err := env.DecodePayload(tt.decoded); err != nil {
+			t.Fatalf("decode payload of %s: %v", frame, err)
+		}
+		if !reflect.DeepEqual(tt.decoded, tt.payload) {
+			t.Errorf("%s: got %+v, want %+v", tt.t, tt.decoded, tt.payload)
+		}
+	}
+
+	frame := MustEncode(TypeUndo, nil)
+	if env, err := Decode(frame); err != nil || env.Type != TypeUndo || len(env.Payload) != 0 {
+		t.Errorf("undo %s decoded as %+v, %v", frame, env, err)
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	for _, tt := range []struct {
+		frame string
+		want  error
+	}{
+		{"plain text", ErrNotEnvelope},
+		{"", ErrNotEnvelope},
+		{`{"type":"op","position":0}`, ErrNotEnvelope}, // Bare operation, no version
+		{`{"title": "a JSON document"`, ErrNotEnvelope},
+		{`{"type":"ack","v":2,"payload":{"version":1}}`, ErrUnsupportedVersion},
+		{`{"type":"shout","v":1,"payload":{}}`, nil},
+		{`{"type":"ack","v":1}`, nil},
+		{`{"type":"resync","v":1,"payload":null}`, nil},
+	} {
+		_, err := Decode([]byte(tt.frame))
+		if err == nil {
+			t.Errorf("%s accepted", tt.frame)
+			continue
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.frame, err, tt.want)
+		}
+		if tt.want == nil && errors.Is(err, ErrNotEnvelope) {
+			t.Errorf("%s: an envelope was taken for plain text", tt.frame)
+		}
+	}
+}
+
+func TestValidation(t *testing.T) {
+	for _, frame := range []string{
+		`{"type":"op","v":1,"payload":{"type":"insert","position":-1,"character":"x","version":0}}`,
+		`{"type":"op","v":1,"payload":{"type":"insert","position":0,"version":0}}`,
+		`{"type":"op","v":1,"payload":{"type":"delete","position":0,"length":0,"version":0}}`,
+		`{"type":"op","v":1,"payload":{"type":"insert","position":0,"character":"x","version":-1}}`,
+		`{"type":"op","v":1,"payload":{"type":"compound","ops":[{"retain":1,"insert":"x"}],"version":0}}`,
+		`{"type":"op","v":1,"payload":{"type":"compound","ops":[{"delete":-2}],"version":0}}`,
+		`{"type":"op","v":1,"payload":{"type":"move","version":0}}`,
+		`{"type":"op","v":1,"payload":"insert"}`,
+		`{"type":"ack","v":1,"payload":{"version":-3}}`,
+		`{"type":"presence","v":1,"payload":{"version":0,"selection":{"anchor":-1,"head":0}}}`,
+		`{"type":"init","v":1,"payload":{"content":"","version":0}}`,
+		`{"type":"error","v":1,"payload":{"message":"no code"}}`,
+	} {
+		env, err := Decode([]byte(frame))
+		if err != nil {
+			t.Errorf("%s: envelope rejected: %v", frame, err)
+			continue
+		}
+		var payload interface{}
+		switch env.Type {
+		case TypeOp:
+			_, err = env.DecodeOp()
+		case TypeAck:
+			payload = &Ack{}
+		case TypePresence:
+			payload = &Presence{}
+		case TypeInit:
+			payload = &Init{}
+		case TypeError:
+			payload = &Error{}
+		}
+		if payload != nil {
+			err = env.DecodePayload(payload)
+		}
+		if err == nil {
+			t.Errorf("%s: invalid payload accepted", frame)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+
+	"collaborative-markdown-editor/internal/ot"
+)
+
+// validate checks the invariants JSON decoding cannot express
+func validate(v interface{}) error {
+	switch p := v.(type) {
+	case *ot.Operation:
+		return validateOperation(p)
+	case *Ack:
+		return validateVersion(p.Version)
+	case *Init:
+		if p.ClientID == "" {
+			return errors.New("missing client ID")
+		}
+		return validateVersion(p.Version)
+	case *Presence:
+		if p.Selection != nil {
+			if err := validateSelection(*p.Selection); err != nil {
+				return err
+			}
+		}
+		for _, sel := range p.Selections {
+			if err := validateSelection(sel); err != nil {
+				return err
+			}
+		}
+		return validateVersion(p.Version)
+	case *Error:
+		if p.Code == "" {
+			return errors.New("missing error code")
+		}
+	case *Resync:
+		return validateVersion(p.Version)
+	}
+	return nil
+}
+
+func validateVersion(version int) error {
+	if version < 0 {
+		return fmt.Errorf("negative version %d", version)
+	}
+	return nil
+}
+
+func validateSelection(sel ot.Selection) error {
+	if sel.Anchor < 0 || sel.Head < 0 {
+		return fmt.Errorf("negative selection %+v", sel)
+	}
+	return nil
+}
+
+// validateOperation checks that an operation is well formed. Whether it
+// fits the document is up to the document.
+func validateOperation(op *ot.Operation) error {
+	if err := validateVersion(op.Version); err != nil {
+		return err
+	}
+	switch op.Type {
+	case ot.Insert:
+		if op.Position < 0 || op.Character == "" {
+			return errors.New("insert needs a position and text")
+		}
+	case ot.Delete:
+		if op.Position < 0 || op.Length <= 0 {
+			return errors.New("delete needs a position and a positive length")
+		}
+	case ot.Compound:
+		for _, c := range op.Ops {
+			set := 0
+			if c.Retain != 0 {
+				set++
+			}
+			if c.Insert != "" {
+				set++
+			}
+			if c.Delete != 0 {
+				set++
+			}
+			if set != 1 || c.Retain < 0 || c.Delete < 0 {
+				return fmt.Errorf("invalid component %+v", c)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown operation type %q", op.Type)
+	}
+	return nil
+}
@@ -0,0 +1,483 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	logFile         = "ops.log"
+	snapshotFile    = "snapshot.json"
+	checkpointsFile = "checkpoints.json"
+	metadataFile    = "metadata.json"
+)
+
+// errDeleted is returned when writing to a room while it is deleted
+var errDeleted = errors.New("room was deleted")
+
+// fileSnapshot is a snapshot as saved, with where the records after it start
+// in the log
+type fileSnapshot struct {
+	Snapshot
+	Offset int64 `json:"offset"`
+}
+
+// fileRoom is a room's directory. Its log stays open once it is written to.
+type fileRoom struct {
+	mu      sync.Mutex
+	dir     string
+	log     *os.File
+	last    int   // Version of the last record in the log
+	size    int64 // Length of the log up to the end of that record
+	deleted bool
+}
+
+// FileStore keeps each room in a directory of its own: an append-only log
+// of records, one JSON object per line, the latest snapshot, the
+// checkpoints and the room's metadata. Appends are
+// synced before they return and snapshots are replaced by renaming, so a
+// crash loses at most the record being written, which is cut off the log
+// when the room is next opened.
+type FileStore struct {
+	dir   string
+	mu    sync.Mutex
+	rooms map[string]*fileRoom
+}
+
+// NewFileStore opens the store in dir, creating the directory if needed
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir, rooms: make(map[string]*fileRoom)}, nil
+}
+
+// Load returns the latest snapshot of a room and the records after it
+func (s *FileStore) Load(roomID string) (Snapshot, []Record, error) {
+	room := s.room(roomID)
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if _, err := os.Stat(room.dir); errors.Is(err, fs.ErrNotExist) {
+		return Snapshot{}, nil, ErrNotFound
+	}
+	snapshot, records, _, err := room.scan()
+	if err != nil {
+		return Snapshot{}, nil, err
+	}
+	return snapshot.Snapshot, records, nil
+}
+
+// Append adds records to the end of a room's log and syncs it
+func (s *FileStore) Append(roomID string, records ...Record) error {
+	room := s.room(roomID)
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if err := room.open(); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	last := room.last
+	for _, record := range records {
+		if record.Op.Version != last+1 {
+			return fmt.Errorf("appending version %d after version %d", record.Op.Version, last)
+		}
+		last++
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	if _, err := room.log.Write(buf.Bytes()); err != nil {
+		// Do not leave half a record for the next one to follow
+		room.log.Truncate(room.size)
+		room.log.Seek(room.size, io.SeekStart)
+		return err
+	}
+	if err := room.log.Sync(); err != nil {
+		return err
+	}
+	room.last = last
+	room.size += int64(buf.Len())
+	return nil
+}
+
+// History reads a room's whole log
+func (s *FileStore) History(roomID string) ([]Record, error) {
+	room := s.room(roomID)
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	data, err := os.ReadFile(filepath.Join(room.dir, logFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		if _, err := os.Stat(room.dir); errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	records, _, err := readRecords(data, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("log of %s: %w", filepath.Base(room.dir), err)
+	}
+	return records, nil
+}
+
+// SaveSnapshot replaces a room's snapshot
+func (s *FileStore) SaveSnapshot(roomID string, snapshot Snapshot) error {
+	room := s.room(roomID)
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if err := room.open(); err != nil {
+		return err
+	}
+	if snapshot.Version > room.last {
+		return fmt.Errorf("snapshot at version %d is ahead of the log at version %d", snapshot.Version, room.last)
+	}
+
+	saved := fileSnapshot{Snapshot: snapshot}
+	if snapshot.Version == room.last {
+		// Loading can skip the log up to here; older snapshots leave the
+		// offset at 0 and have the log scanned from the start
+		saved.Offset = room.size
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(room.dir, snapshotFile), data)
+}
+
+// AddCheckpoint names a version of a room, rewriting its checkpoints file
+func (s *FileStore) AddCheckpoint(roomID string, checkpoint Checkpoint) error {
+	room := s.room(roomID)
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if err := room.open(); err != nil {
+		return err
+	}
+	if checkpoint.Version < 0 || checkpoint.Version > room.last {
+		return ErrNoVersion
+	}
+	checkpoints, err := room.readCheckpoints()
+	if err != nil {
+		return err
+	}
+	for _, existing := range checkpoints {
+		if existing.Name == checkpoint.Name {
+			return ErrCheckpointExists
+		}
+	}
+	data, err := json.Marshal(append(checkpoints, checkpoint))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(room.dir, checkpointsFile), data)
+}
+
+// Checkpoints reads a room's checkpoints file
+func (s *FileStore) Checkpoints(roomID string) ([]Checkpoint, error) {
+	room := s.room(roomID)
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if _, err := os.Stat(room.dir); errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return room.readCheckpoints()
+}
+
+// Metadata reads a room's metadata file
+func (s *FileStore) Metadata(roomID string) (Metadata, error) {
+	room := s.room(roomID)
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	var metadata Metadata
+	data, err := os.ReadFile(filepath.Join(room.dir, metadataFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return metadata, ErrNotFound
+	}
+	if err != nil {
+		return metadata, err
+	}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return metadata, fmt.Errorf("metadata of %s: %w", filepath.Base(room.dir), err)
+	}
+	return metadata, nil
+}
+
+// SaveMetadata replaces a room's metadata file
+func (s *FileStore) SaveMetadata(roomID string, metadata Metadata) error {
+	room := s.room(roomID)
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if err := room.open(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(room.dir, metadataFile), data)
+}
+
+// Rooms returns the IDs of the stored rooms, sorted
+func (s *FileStore) Rooms() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		id, err := base64.RawURLEncoding.DecodeString(entry.Name())
+		if err != nil || !entry.IsDir() {
+			// Not one of ours
+			continue
+		}
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Delete removes a room's directory
+func (s *FileStore) Delete(roomID string) error {
+	s.mu.Lock()
+	room := s.roomLocked(roomID)
+	delete(s.rooms, roomID)
+	s.mu.Unlock()
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	room.deleted = true
+	if room.log != nil {
+		room.log.Close()
+		room.log = nil
+	}
+	if err := os.RemoveAll(room.dir); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// Release closes a room's log
+func (s *FileStore) Release(roomID string) error {
+	room := s.room(roomID)
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if room.log == nil {
+		return nil
+	}
+	err := room.log.Close()
+	room.log = nil
+	return err
+}
+
+// Close closes the logs of every room
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, room := range s.rooms {
+		room.mu.Lock()
+		if room.log != nil {
+			errs = append(errs, room.log.Close())
+			room.log = nil
+		}
+		room.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// room returns the room with the given ID
+func (s *FileStore) room(roomID string) *fileRoom {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.roomLocked(roomID)
+}
+
+func (s *FileStore) roomLocked(roomID string) *fileRoom {
+	room, ok := s.rooms[roomID]
+	if !ok {
+		room = &fileRoom{dir: filepath.Join(s.dir, base64.RawURLEncoding.EncodeToString([]byte(roomID)))}
+		s.rooms[roomID] = room
+	}
+	return room
+}
+
+// open creates the room's directory if needed and opens its log for
+// appending, cutting off a record a crash left unfinished
+func (r *fileRoom) open() error {
+	if r.deleted {
+		return errDeleted
+	}
+	if r.log != nil {
+		return nil
+	}
+	if _, err := os.Stat(r.dir); errors.Is(err, fs.ErrNotExist) {
+		if err := os.Mkdir(r.dir, 0o755); err != nil {
+			return err
+		}
+		if err := syncDir(filepath.Dir(r.dir)); err != nil {
+			return err
+		}
+	}
+
+	snapshot, records, size, err := r.scan()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(r.dir, logFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	r.log, r.size, r.last = f, size, snapshot.Version
+	if len(records) > 0 {
+		r.last = records[len(records)-1].Op.Version
+	}
+	return nil
+}
+
+// scan reads the room's snapshot and the records after it. It also returns
+// the length of the log up to its last complete record.
+func (r *fileRoom) scan() (fileSnapshot, []Record, int64, error) {
+	snapshot, err := r.readSnapshot()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fileSnapshot{}, nil, 0, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(r.dir, logFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fileSnapshot{}, nil, 0, err
+	}
+
+	start := snapshot.Offset
+	if start > int64(len(data)) {
+		start = 0
+	}
+	records, size, err := readRecords(data, start, snapshot.Version)
+	if err != nil && start > 0 {
+		// The offset does not point where it should; read the whole log
+		records, size, err = readRecords(data, 0, snapshot.Version)
+	}
+	if err != nil {
+		return fileSnapshot{}, nil, 0, fmt.Errorf("log of %s: %w", filepath.Base(r.dir), err)
+	}
+	return snapshot, records, size, nil
+}
+
+// readCheckpoints reads the room's checkpoints file, if it has one
+func (r *fileRoom) readCheckpoints() ([]Checkpoint, error) {
+	var checkpoints []Checkpoint
+	data, err := os.ReadFile(filepath.Join(r.dir, checkpointsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &checkpoints); err != nil {
+		return nil, fmt.Errorf("checkpoints of %s: %w", filepath.Base(r.dir), err)
+	}
+	return checkpoints, nil
+}
+
+// readSnapshot reads the room's snapshot file
+func (r *fileRoom) readSnapshot() (fileSnapshot, error) {
+	var snapshot fileSnapshot
+	data, err := os.ReadFile(filepath.Join(r.dir, snapshotFile))
+	if err != nil {
+		return snapshot, err
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("snapshot of %s: %w", filepath.Base(r.dir), err)
+	}
+	return snapshot, nil
+}
+
+// readRecords parses the log from offset, keeping the records after version,
+// which have to follow on from it.
+// It stops at a last line without a newline, which a crash cut short, and
+// returns where the complete records end.
+func readRecords(data []byte, offset int64, version int) ([]Record, int64, error) {
+	var records []Record
+	reader := bufio.NewReader(bytes.NewReader(data[offset:]))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// io.EOF; anything read without a newline is a torn write
+			return records, offset, nil
+		}
+		var record Record
+		if err := json.Unmarshal(line, &record); err != nil || record.Op == nil {
+			return nil, 0, fmt.Errorf("bad record at offset %d", offset)
+		}
+		offset += int64(len(line))
+		if record.Op.Version <= version {
+			continue
+		}
+		if record.Op.Version != version+1 {
+			return nil, 0, fmt.Errorf("version %d follows version %d", record.Op.Version, version)
+		}
+		records = append(records, record)
+		version++
+	}
+}
+
+// writeFileAtomic replaces a file so that it holds either its old or its new
+// contents, even after a crash
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes the creation, renaming and removal of entries in a directory
+// durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
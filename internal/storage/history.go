@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"sort"
+	"unicode/utf8"
+
+	"collaborative-markdown-editor/internal/diff"
+	"collaborative-markdown-editor/internal/ot"
+)
+
+// TextAt rebuilds the text of a room at a version from its snapshot, or
+// from the start of its log for versions before the snapshot
+func TextAt(store Store, roomID string, version int) (string, error) {
+	base, records, err := recordsFrom(store, roomID, version)
+	if err != nil {
+		return "", err
+	}
+	text, err := replay(ot.NewRope(base.Text), records[:version-base.Version])
+	if err != nil {
+		return "", err
+	}
+	return text.String(), nil
+}
+
+// AuthorshipAt rebuilds the text of a room at a version along with who
+// wrote each rune of it
+func AuthorshipAt(store Store, roomID string, version int) (string, *ot.Authorship, error) {
+	base, records, err := recordsFrom(store, roomID, version)
+	if err != nil {
+		return "", nil, err
+	}
+	records = records[:version-base.Version]
+	text, err := replay(ot.NewRope(base.Text), records)
+	if err != nil {
+		return "", nil, err
+	}
+	authorship := base.Authorship()
+	for _, record := range records {
+		if err := authorship.Apply(record.Op, record.AuthorID()); err != nil {
+			return "", nil, err
+		}
+	}
+	return text.String(), authorship, nil
+}
+
+// replay applies records to a text
+func replay(text *ot.Rope, records []Record) (*ot.Rope, error) {
+	for _, record := range records {
+		var err error
+		if text, err = record.Op.Text().ApplyRope(text); err != nil {
+			return nil, err
+		}
+	}
+	return text, nil
+}
+
+// Changes is what happened to a room between two versions: its text at
+// both and who changed which runes
+type Changes struct {
+	From, To string
+
+	// Who inserted the runes of To, "" for runes that were already in From
+	Inserted []diff.Run
+
+	// Who deleted the runes of From, "" for runes still in To
+	Deleted []diff.Run
+}
+
+// ChangesBetween replays a room's log from one version to another, keeping
+// track of who inserted and deleted each run of text. For a from after to,
+// the changes that undo the ones in between are returned.
+func ChangesBetween(store Store, roomID string, from, to int) (*Changes, error) {
+	if from > to {
+		changes, err := ChangesBetween(store, roomID, to, from)
+		if err != nil {
+			return nil, err
+		}
+		return &Changes{
+			From:     changes.To,
+			To:       changes.From,
+			Inserted: changes.Deleted,
+			Deleted:  changes.Inserted,
+		}, nil
+	}
+
+	base, records, err := recordsFrom(store, roomID, from)
+	if err != nil {
+		return nil, err
+	}
+	if to > base.Version+len(records) {
+		return nil, ErrNoVersion
+	}
+	fromText, err := replay(ot.NewRope(base.Text), records[:from-base.Version])
+	if err != nil {
+		return nil, err
+	}
+
+	text := fromText
+	inserted := ot.Unattributed(fromText.String())
+	origins := &origins{pieces: []piece{{old: 0, length: fromText.Len()}}}
+	for _, record := range records[from-base.Version : to-base.Version] {
+		author := record.Author
+		if author == "" {
+			author = record.Op.ClientID
+		}
+		if text, err = record.Op.Text().ApplyRope(text); err != nil {
+			return nil, err
+		}
+		if err := inserted.Apply(record.Op, author); err != nil {
+			return nil, err
+		}
+		if err := origins.apply(record.Op, author); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Changes{
+		From:     fromText.String(),
+		To:       text.String(),
+		Inserted: runs(inserted.Spans()),
+		Deleted:  origins.deletedRuns(fromText.Len()),
+	}, nil
+}
+
+// piece is a run of the text being replayed: runes of the text replay
+// started from, or runes inserted since
+type piece struct {
+	old    int // Offset in the text replay started from, -1 for inserted runes
+	length int
+}
+
+// deletion is a run of the text replay started from that an operation
+// deleted
+type deletion struct {
+	old    int
+	author string
+	length int
+}
+
+// origins tracks where the runes of a text being replayed came from, and
+// who deleted the runes of the text it started from, a run at a time
+type origins struct {
+	pieces  []piece
+	deleted []deletion
+}
+
+// apply follows the runes of the text through a committed operation
+func (o *origins) apply(op *ot.Operation, author string) error {
+	next := make([]piece, 0, len(o.pieces)+2)
+	add := func(p piece) {
+		if n := len(next); n > 0 {
+			last := &next[n-1]
+			if (last.old < 0 && p.old < 0) || (last.old >= 0 && last.old+last.length == p.old) {
+				last.length += p.length
+				return
+			}
+		}
+		next = append(next, p)
+	}
+	i, offset := 0, 0 // Piece and rune within it the operation is at
+	take := func(n int, keep bool) error {
+		for n > 0 {
+			if i == len(o.pieces) {
+				return ot.ErrOutOfRange
+			}
+			p := o.pieces[i]
+			k := min(n, p.length-offset)
+			part := piece{old: -1, length: k}
+			if p.old >= 0 {
+				part.old = p.old + offset
+			}
+			switch {
+			case keep:
+				add(part)
+			case part.old >= 0:
+				o.deleted = append(o.deleted, deletion{old: part.old, author: author, length: k})
+			}
+			n -= k
+			offset += k
+			if offset == p.length {
+				i, offset = i+1, 0
+			}
+		}
+		return nil
+	}
+
+	for _, c := range op.Text() {
+		var err error
+		switch {
+		case c.Retain > 0:
+			err = take(c.Retain, true)
+		case c.Insert != "":
+			add(piece{old: -1, length: utf8.RuneCountInString(c.Insert)})
+		case c.Delete > 0:
+			err = take(c.Delete, false)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Runes past the last component are retained
+	for ; i < len(o.pieces); i, offset = i+1, 0 {
+		p := o.pieces[i]
+		if p.old >= 0 {
+			p.old += offset
+		}
+		p.length -= offset
+		add(p)
+	}
+	o.pieces = next
+	return nil
+}
+
+// deletedRuns returns who deleted the runes of the text replay started
+// from, which has length runes, "" for runes still there
+func (o *origins) deletedRuns(length int) []diff.Run {
+	sort.Slice(o.deleted, func(i, j int) bool { return o.deleted[i].old < o.deleted[j].old })
+	var spans []ot.Span
+	at := 0
+	for _, d := range o.deleted {
+		spans = append(spans, ot.Span{Length: d.old - at}, ot.Span{UserID: d.author, Length: d.length})
+		at = d.old + d.length
+	}
+	spans = append(spans, ot.Span{Length: length - at})
+	return runs(ot.NewAuthorship(spans).Spans())
+}
+
+// runs returns spans as runs of text by their authors, merging runs by the
+// same author
+func runs(spans []ot.Span) []diff.Run {
+	var runs []diff.Run
+	for _, span := range spans {
+		if n := len(runs); n > 0 && runs[n-1].Author == span.UserID {
+			runs[n-1].Length += span.Length
+			continue
+		}
+		runs = append(runs, diff.Run{Author: span.UserID, Length: span.Length})
+	}
+	return runs
+}
+
+// recordsFrom returns the latest snapshot a version can be rebuilt from and
+// the records after it
+func recordsFrom(store Store, roomID string, version int) (Snapshot, []Record, error) {
+	snapshot, records, err := store.Load(roomID)
+	if err != nil {
+		return Snapshot{}, nil, err
+	}
+	if version < snapshot.Version {
+		snapshot = Snapshot{}
+		if records, err = store.History(roomID); err != nil {
+			return Snapshot{}, nil, err
+		}
+	}
+	if version < 0 || version > snapshot.Version+len(records) {
+		return Snapshot{}, nil, ErrNoVersion
+	}
+	return snapshot, records, nil
+}
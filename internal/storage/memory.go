@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// memoryRoom is what a MemoryStore keeps for a room
+type memoryRoom struct {
+	snapshot    Snapshot
+	records     []Record // Every record since version 0
+	checkpoints []Checkpoint
+	metadata    *Metadata
+}
+
+// lastVersion returns the version the room's log reaches
+func (r *memoryRoom) lastVersion() int {
+	if len(r.records) == 0 {
+		return 0
+	}
+	return r.records[len(r.records)-1].Op.Version
+}
+
+// MemoryStore keeps rooms in memory, for tests and servers that do not need
+// to survive a restart
+type MemoryStore struct {
+	mu    sync.Mutex
+	rooms map[string]*memoryRoom
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{rooms: make(map[string]*memoryRoom)}
+}
+
+// Load returns the latest snapshot of a room and the records after it
+func (s *MemoryStore) Load(roomID string) (Snapshot, []Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room, ok := s.rooms[roomID]
+	if !ok {
+		return Snapshot{}, nil, ErrNotFound
+	}
+	var records []Record
+	for _, record := range room.records {
+		if record.Op.Version > room.snapshot.Version {
+			records = append(records, record)
+		}
+	}
+	return room.snapshot, records, nil
+}
+
+// Append adds records to the end of a room's log
+func (s *MemoryStore) Append(roomID string, records ...Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room := s.room(roomID)
+	last := room.lastVersion()
+	for _, record := range records {
+		if record.Op.Version != last+1 {
+			return fmt.Errorf("appending version %d after version %d", record.Op.Version, last)
+		}
+		last++
+	}
+	room.records = append(room.records, records...)
+	return nil
+}
+
+// History returns every record of a room
+func (s *MemoryStore) History(roomID string) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room, ok := s.rooms[roomID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]Record(nil), room.records...), nil
+}
+
+// SaveSnapshot records the text of a room at a version
+func (s *MemoryStore) SaveSnapshot(roomID string, snapshot Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room := s.room(roomID)
+	if last := room.lastVersion(); snapshot.Version > last {
+		return fmt.Errorf("snapshot at version %d is ahead of the log at version %d", snapshot.Version, last)
+	}
+	room.snapshot = snapshot
+	return nil
+}
+
+// AddCheckpoint names a version of a room
+func (s *MemoryStore) AddCheckpoint(roomID string, checkpoint Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room := s.room(roomID)
+	if checkpoint.Version < 0 || checkpoint.Version > room.lastVersion() {
+		return ErrNoVersion
+	}
+	for _, existing := range room.checkpoints {
+		if existing.Name == checkpoint.Name {
+			return ErrCheckpointExists
+		}
+	}
+	room.checkpoints = append(room.checkpoints, checkpoint)
+	return nil
+}
+
+// Checkpoints returns the checkpoints of a room
+func (s *MemoryStore) Checkpoints(roomID string) ([]Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room, ok := s.rooms[roomID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]Checkpoint(nil), room.checkpoints...), nil
+}
+
+// Metadata returns what was saved of a room besides its text
+func (s *MemoryStore) Metadata(roomID string) (Metadata, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room, ok := s.rooms[roomID]
+	if !ok || room.metadata == nil {
+		return Metadata{}, ErrNotFound
+	}
+	metadata := *room.metadata
+	metadata.ACL = metadata.ACL.Clone()
+	return metadata, nil
+}
+
+// SaveMetadata replaces what is saved of a room besides its text
+func (s *MemoryStore) SaveMetadata(roomID string, metadata Metadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metadata.ACL = metadata.ACL.Clone()
+	s.room(roomID).metadata = &metadata
+	return nil
+}
+
+// Rooms returns the IDs of the stored rooms, sorted
+func (s *MemoryStore) Rooms() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.rooms))
+	for id := range s.rooms {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Delete forgets a room
+func (s *MemoryStore) Delete(roomID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.rooms, roomID)
+	return nil
+}
+
+// Release does nothing, the store holds nothing open
+func (s *MemoryStore) Release(roomID string) error {
+	return nil
+}
+
+// room returns the stored room with the given ID, creating it if needed
+func (s *MemoryStore) room(roomID string) *memoryRoom {
+	room, ok := s.rooms[roomID]
+	if !ok {
+		room = &memoryRoom{}
+		s.rooms[roomID] = room
+	}
+	return room
+}
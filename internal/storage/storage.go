@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"collaborative-markdown-editor/internal/acl"
+	"collaborative-markdown-editor/internal/document"
+	"collaborative-markdown-editor/internal/ot"
+)
+
+var (
+	// ErrNotFound is returned when loading a room that was never stored
+	ErrNotFound = errors.New("room not found")
+
+	// ErrNoVersion is returned for versions a room has not reached
+	ErrNoVersion = errors.New("version not found")
+
+	// ErrCheckpointExists is returned when a room already has a checkpoint
+	// with the name given to a new one
+	ErrCheckpointExists = errors.New("checkpoint already exists")
+)
+
+// Record is a committed operation, in the form it was broadcast in. Its
+// Version is the version it produced and its ClientID the connection that
+// made it.
+type Record struct {
+	Op     *ot.Operation `json:"op"`
+	Author string        `json:"author,omitempty"` // Name of the user who made it
+	UserID string        `json:"userId,omitempty"` // ID of the user who made it
+	Time   time.Time     `json:"time"`
+}
+
+// AuthorID returns the ID of the user who made the record. Records saved
+// before users and their connections were told apart only have the ID of
+// the connection.
+func (r Record) AuthorID() string {
+	if r.UserID != "" {
+		return r.UserID
+	}
+	return r.Op.ClientID
+}
+
+// Snapshot is the text of a room at a version
+type Snapshot struct {
+	ot.Snapshot
+	Time time.Time `json:"time"`
+
+	// Who wrote the text. Snapshots saved before authorship was tracked
+	// have none.
+	Spans []ot.Span `json:"spans,omitempty"`
+}
+
+// Authorship returns who wrote the text of the snapshot. Text of snapshots
+// without spans, or whose spans do not cover it, is attributed to nobody.
+func (s Snapshot) Authorship() *ot.Authorship {
+	authorship := ot.NewAuthorship(s.Spans)
+	if authorship.Len() != utf8.RuneCountInString(s.Text) {
+		return ot.Unattributed(s.Text)
+	}
+	return authorship
+}
+
+// Checkpoint is a named version of a room
+type Checkpoint struct {
+	Name    string    `json:"name"`
+	Version int       `json:"version"`
+	Author  string    `json:"author,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Metadata is what is known of a room besides its text
+type Metadata struct {
+	ACL acl.ACL `json:"acl"`
+
+	// Document backend the room was created with. Rooms from before it was
+	// saved have none and use the hub's default.
+	Backend document.Backend `json:"backend,omitempty"`
+}
+
+// Store keeps rooms across restarts: every committed operation is appended
+// to the room's log, and snapshots spare loading from replaying all of it.
+// Stores are safe for concurrent use.
+type Store interface {
+	// Load returns the latest snapshot of a room and the records committed
+	// after it, oldest first. Rooms without a snapshot start from an empty
+	// text at version 0.
+	Load(roomID string) (Snapshot, []Record, error)
+
+	// Append adds records to the end of a room's log. Their versions must
+	// follow on from the records before them.
+	Append(roomID string, records ...Record) error
+
+	// History returns every record of a room, oldest first
+	History(roomID string) ([]Record, error)
+
+	// SaveSnapshot records the text of a room at a version the log already
+	// reaches
+	SaveSnapshot(roomID string, snapshot Snapshot) error
+
+	// AddCheckpoint names a version the log already reaches. Names are
+	// unique within a room.
+	AddCheckpoint(roomID string, checkpoint Checkpoint) error
+
+	// Checkpoints returns the checkpoints of a room, oldest first
+	Checkpoints(roomID string) ([]Checkpoint, error)
+
+	// Metadata returns what was saved of a room besides its text, or
+	// ErrNotFound if nothing was
+	Metadata(roomID string) (Metadata, error)
+
+	// SaveMetadata replaces what is saved of a room besides its text
+	SaveMetadata(roomID string, metadata Metadata) error
+
+	// Rooms returns the IDs of the stored rooms
+	Rooms() ([]string, error)
+
+	// Delete forgets a room. Deleting a room that is not stored is not an
+	// error.
+	Delete(roomID string) error
+
+	// Release frees what the store holds open for a room until it is next
+	// used, once the room is no longer in memory
+	Release(roomID string) error
+}
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"collaborative-markdown-editor/internal/acl"
+	"collaborative-markdown-editor/internal/diff"
+	"collaborative-markdown-editor/internal/ot"
+)
+
+func record(version int, text string) Record {
+	return Record{
+		Op:     ot.NewInsertOperation(version-1, text, version, "alice"),
+		Author: "Alice",
+		Time:   time.Date(2024, 1, 1, 0, 0, version, 0, time.UTC),
+	}
+}
+
+func versions(records []Record) []int {
+	var versions []int
+	for _, record := range records {
+		versions = append(versions, record.Op.Version)
+	}
+	return versions
+}
+
+// testStore runs the behaviour every store shares
+func testStore(t *testing.T, store Store) {
+	if _, _, err := store.Load("notes"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("loading a new room: got %v, want ErrNotFound", err)
+	}
+
+	if err := store.Append("notes", record(1, "a"), record(2, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append("notes", record(4, "d")); err == nil {
+		t.Fatal("appended version 4 after version 2")
+	}
+	if err := store.SaveSnapshot("notes", Snapshot{Snapshot: ot.Snapshot{Text: "ab", Version: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveSnapshot("notes", Snapshot{Snapshot: ot.Snapshot{Text: "abc", Version: 3}}); err == nil {
+		t.Fatal("saved a snapshot ahead of the log")
+	}
+	if err := store.Append("notes", record(3, "c")); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, records, err := store.Load("notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Text != "ab" || snapshot.Version != 2 {
+		t.Errorf("snapshot %+v, want \"ab\" at version 2", snapshot)
+	}
+	if got := versions(records); !reflect.DeepEqual(got, []int{3}) {
+		t.Errorf("loaded versions %v after the snapshot, want [3]", got)
+	}
+	if records[0].Author != "Alice" || !records[0].Time.Equal(record(3, "c").Time) {
+		t.Errorf("loaded %+v", records[0])
+	}
+	if history, err := store.History("notes"); err != nil || !reflect.DeepEqual(versions(history), []int{1, 2, 3}) {
+		t.Errorf("history versions %v, %v; want [1 2 3]", versions(history), err)
+	}
+
+	if err := store.AddCheckpoint("notes", Checkpoint{Name: "draft", Version: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddCheckpoint("notes", Checkpoint{Name: "draft", Version: 3}); !errors.Is(err, ErrCheckpointExists) {
+		t.Errorf("adding a checkpoint twice: got %v, want ErrCheckpointExists", err)
+	}
+	if err := store.AddCheckpoint("notes", Checkpoint{Name: "future", Version: 4}); !errors.Is(err, ErrNoVersion) {
+		t.Errorf("adding a checkpoint ahead of the log: got %v, want ErrNoVersion", err)
+	}
+	if checkpoints, err := store.Checkpoints("notes"); err != nil || len(checkpoints) != 1 || checkpoints[0].Name != "draft" {
+		t.Errorf("checkpoints %+v, %v", checkpoints, err)
+	}
+
+	if _, err := store.Metadata("notes"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("metadata of a room without any: got %v, want ErrNotFound", err)
+	}
+	metadata := Metadata{ACL: acl.ACL{Roles: map[string]acl.Role{"alice": acl.Owner}, Link: acl.Viewer}}
+	if err := store.SaveMetadata("notes", metadata); err != nil {
+		t.Fatal(err)
+	}
+	metadata.ACL.Roles["bob"] = acl.Editor
+	if got, err := store.Metadata("notes"); err != nil || !reflect.DeepEqual(got.ACL.Roles, map[string]acl.Role{"alice": acl.Owner}) || got.ACL.Link != acl.Viewer {
+		t.Errorf("metadata %+v, %v", got, err)
+	}
+
+	if err := store.Append("todo", record(1, "x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Release("todo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append("todo", record(2, "y")); err != nil {
+		t.Errorf("appending to a released room: %v", err)
+	}
+	if rooms, err := store.Rooms(); err != nil || !reflect.DeepEqual(rooms, []string{"notes", "todo"}) {
+		t.Errorf("rooms %v, %v", rooms, err)
+	}
+
+	if err := store.Delete("notes"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Load("notes"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("loading a deleted room: got %v, want ErrNotFound", err)
+	}
+	if err := store.Delete("notes"); err != nil {
+		t.Errorf("deleting a deleted room: %v", err)
+	}
+	if err := store.Append("notes", record(1, "a")); err != nil {
+		t.Errorf("a deleted room cannot start over: %v", err)
+	}
+}
+
+func TestTextAt(t *testing.T) {
+	store := NewMemoryStore()
+	store.Append("notes", record(1, "a"), record(2, "b"), record(3, "c"))
+	store.SaveSnapshot("notes", Snapshot{Snapshot: ot.Snapshot{Text: "ab", Version: 2}})
+
+	for version, want := range []string{"", "a", "ab", "abc"} {
+		if got, err := TextAt(store, "notes", version); err != nil || got != want {
+			t.Errorf("text at version %d: got %q, %v; want %q", version, got, err, want)
+		}
+	}
+	if _, err := TextAt(store, "notes", 4); !errors.Is(err, ErrNoVersion) {
+		t.Errorf("text at version 4: got %v, want ErrNoVersion", err)
+	}
+}
+
+func TestAuthorshipAt(t *testing.T) {
+	store := NewMemoryStore()
+	store.Append("notes", record(1, "a"), record(2, "b"), record(3, "c"))
+	store.SaveSnapshot("notes", Snapshot{
+		Snapshot: ot.Snapshot{Text: "ab", Version: 2},
+		Spans:    []ot.Span{{UserID: "bob", Version: 1, Length: 2}},
+	})
+
+	// Versions before the snapshot are replayed from the start of the log,
+	// later ones from the spans saved with it
+	want := map[int][]ot.Span{
+		1: {{UserID: "alice", Version: 1, Length: 1}},
+		3: {{UserID: "bob", Version: 1, Length: 2}, {UserID: "alice", Version: 3, Length: 1}},
+	}
+	for version, spans := range want {
+		_, authorship, err := AuthorshipAt(store, "notes", version)
+		if err != nil || !reflect.DeepEqual(authorship.Spans(), spans) {
+			t.Errorf("authorship at version %d: got %+v, %v; want %+v", version, authorship, err, spans)
+		}
+	}
+
+	// Snapshots without spans are attributed to nobody
+	store.SaveSnapshot("notes", Snapshot{Snapshot: ot.Snapshot{Text: "abc", Version: 3}})
+	if text, authorship, err := AuthorshipAt(store, "notes", 3); err != nil || text != "abc" ||
+		!reflect.DeepEqual(authorship.Spans(), []ot.Span{{Length: 3}}) {
+		t.Errorf("authorship without spans: got %q, %+v, %v", text, authorship, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	testStore(t, store)
+}
+
+func TestFileStoreSurvivesRestarts(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewFileStore(dir)
+	store.Append("notes", record(1, "a"), record(2, "b"))
+	store.SaveSnapshot("notes", Snapshot{Snapshot: ot.Snapshot{Text: "ab", Version: 2}})
+	store.Append("notes", record(3, "c"))
+	store.Close()
+
+	// A crash in the middle of an append leaves half a record behind
+	log := filepath.Join(store.room("notes").dir, logFile)
+	f, err := os.OpenFile(log, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":{"type":"ins`)
+	f.Close()
+
+	store, _ = NewFileStore(dir)
+	defer store.Close()
+	snapshot, records, err := store.Load("notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Text != "ab" || !reflect.DeepEqual(versions(records), []int{3}) {
+		t.Fatalf("loaded %+v and versions %v", snapshot, versions(records))
+	}
+
+	// The next append replaces the torn record
+	if err := store.Append("notes", record(4, "d")); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	store, _ = NewFileStore(dir)
+	if _, records, err = store.Load("notes"); err != nil || !reflect.DeepEqual(versions(records), []int{3, 4}) {
+		t.Errorf("after appending past a torn record: versions %v, %v", versions(records), err)
+	}
+}
+
+func TestFileStoreReadsTheWholeLogForOlderSnapshots(t *testing.T) {
+	store, _ := NewFileStore(t.TempDir())
+	defer store.Close()
+	store.Append("notes", record(1, "a"), record(2, "b"), record(3, "c"))
+	if err := store.SaveSnapshot("notes", Snapshot{Snapshot: ot.Snapshot{Text: "a", Version: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, records, err := store.Load("notes"); err != nil || !reflect.DeepEqual(versions(records), []int{2, 3}) {
+		t.Errorf("versions %v, %v; want [2 3]", versions(records), err)
+	}
+}
+
+func TestChangesBetween(t *testing.T) {
+	store := NewMemoryStore()
+	store.Append("notes",
+		Record{Op: ot.NewInsertOperation(0, "hello world", 1, "a"), Author: "Alice"},
+		Record{Op: ot.NewDeleteOperation(0, 6, 2, "b"), Author: "Bob"},
+		Record{Op: ot.NewInsertOperation(5, "!", 3, "c"), Author: "Carol"},
+		Record{Op: ot.NewInsertOperation(0, "oh ", 4, "b"), Author: "Bob"},
+	)
+
+	changes, err := ChangesBetween(store, "notes", 1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes.From != "hello world" || changes.To != "oh world!" {
+		t.Fatalf("changes from %q to %q", changes.From, changes.To)
+	}
+	wantInserted := []diff.Run{{Author: "Bob", Length: 3}, {Author: "", Length: 5}, {Author: "Carol", Length: 1}}
+	if !reflect.DeepEqual(changes.Inserted, wantInserted) {
+		t.Errorf("inserted by %+v, want %+v", changes.Inserted, wantInserted)
+	}
+	wantDeleted := []diff.Run{{Author: "Bob", Length: 6}, {Author: "", Length: 5}}
+	if !reflect.DeepEqual(changes.Deleted, wantDeleted) {
+		t.Errorf("deleted by %+v, want %+v", changes.Deleted, wantDeleted)
+	}
+
+	// Going back swaps who inserted and who deleted
+	back, err := ChangesBetween(store, "notes", 4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.From != changes.To || !reflect.DeepEqual(back.Deleted, changes.Inserted) {
+		t.Errorf("changes back: %+v", back)
+	}
+	if _, err := ChangesBetween(store, "notes", 1, 5); !errors.Is(err, ErrNoVersion) {
+		t.Errorf("changes past the log: got %v, want ErrNoVersion", err)
+	}
+}
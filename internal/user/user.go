@@ -2,111 +2,246 @@ package user
 
 import (
 	"fmt"
+	"hash/fnv"
 	"math/rand"
+	"sort"
+	"sync"
 	"time"
+
+	"collaborative-markdown-editor/internal/ot"
 )
 
-// User represents a user in the collaborative editor
+// User is a person using the collaborative editor, however many
+// connections they have open. Users are values; the manager hands out
+// copies.
 type User struct {
-	ID        string    `json:"id"`
-	Username  string    `json:"username"`
-	Color     string    `json:"color"`
-	CursorPos int       `json:"cursorPos"`
-	LastSeen  time.Time `json:"lastSeen"`
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Color    string `json:"color"`
+}
+
+// Session is a connection of a user to a room, such as a browser tab. Its ID
+// is the client ID of the connection.
+type Session struct {
+	ID        string       `json:"id"`
+	UserID    string       `json:"userId"`
+	RoomID    string       `json:"roomId"`
+	Selection ot.Selection `json:"selection"`
+	LastSeen  time.Time    `json:"lastSeen"`
 }
 
-// UserManager manages users across all rooms
+// UserManager manages users and their sessions across all rooms. It is safe
+// for concurrent use; rooms run on their own goroutines and HTTP handlers
+// read it too.
 type UserManager struct {
-	users map[string]*User // userID -> User
-	rooms map[string]map[string]*User // roomID -> userID -> User
+	mu       sync.RWMutex
+	users    map[string]*User               // userID -> User
+	sessions map[string]*Session            // sessionID -> Session
+	rooms    map[string]map[string]*Session // roomID -> sessionID -> Session
+	open     map[string]int                 // userID -> number of sessions
 }
 
 // NewUserManager creates a new user manager
 func NewUserManager() *UserManager {
 	return &UserManager{
-		users: make(map[string]*User),
-		rooms: make(map[string]map[string]*User),
+		users:    make(map[string]*User),
+		sessions: make(map[string]*Session),
+		rooms:    make(map[string]map[string]*Session),
+		open:     make(map[string]int),
 	}
 }
 
-// CreateUser creates a new user with a random color
-func (um *UserManager) CreateUser(userID, username string) *User {
-	// Generate random color
-	colors := []string{
-		"#FF6B6B", "#4ECDC4", "#45B7D1", "#96CEB4", "#FFEAA7",
-		"#DDA0DD", "#98D8C8", "#F7DC6F", "#BB8FCE", "#F8C471",
-		"#85C1E9", "#F9E79F", "#A9DFBF", "#F5B7B1", "#C8B2DB",
-	}
-	color := colors[rand.Intn(len(colors))]
+// colors are the colors users are told apart by
+var colors = []string{
+	"#FF6B6B", "#4ECDC4", "#45B7D1", "#96CEB4", "#FFEAA7",
+	"#DDA0DD", "#98D8C8", "#F7DC6F", "#BB8FCE", "#F8C471",
+	"#85C1E9", "#F9E79F", "#A9DFBF", "#F5B7B1", "#C8B2DB",
+}
 
-	user := &User{
-		ID:        userID,
-		Username:  username,
-		Color:     color,
-		CursorPos: 0,
-		LastSeen:  time.Now(),
+// ColorFor returns the color of a user whose identity lasts, the same one
+// every time
+func ColorFor(userID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return colors[h.Sum32()%uint32(len(colors))]
+}
+
+// newUser returns a user with a random color
+func newUser(userID, username string) *User {
+	return &User{
+		ID:       userID,
+		Username: username,
+		Color:    colors[rand.Intn(len(colors))],
 	}
+}
 
+// CreateUser creates a new user with a random color
+func (um *UserManager) CreateUser(userID, username string) User {
+	user := newUser(userID, username)
+
+	um.mu.Lock()
 	um.users[userID] = user
-	return user
+	um.mu.Unlock()
+	return *user
+}
+
+// LoadOrCreateUser gets a user by ID, creating them with a username and a
+// random color if there is no such user
+func (um *UserManager) LoadOrCreateUser(userID, username string) User {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	user, exists := um.users[userID]
+	if !exists {
+		user = newUser(userID, username)
+		um.users[userID] = user
+	}
+	return *user
+}
+
+// SetUser records who a user is, such as after they signed in, replacing
+// what was known about them
+func (um *UserManager) SetUser(user User) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	um.users[user.ID] = &user
 }
 
 // GetUser gets a user by ID
-func (um *UserManager) GetUser(userID string) (*User, bool) {
+func (um *UserManager) GetUser(userID string) (User, bool) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
 	user, exists := um.users[userID]
-	return user, exists
+	if !exists {
+		return User{}, false
+	}
+	return *user, true
 }
 
-// AddUserToRoom adds a user to a room
-func (um *UserManager) AddUserToRoom(userID, roomID string) {
+// StartSession records a connection of a user to a room. A user the
+// manager forgot, such as one coming back after closing every connection,
+// is added again. Starting a session again, such as when a client reconnects
+// before its old connection is gone, replaces it.
+func (um *UserManager) StartSession(sessionID, roomID string, user User) Session {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	// Removing the old session first, so that a user whose only session it
+	// was is added back below rather than forgotten
+	um.removeSession(sessionID)
+	if _, exists := um.users[user.ID]; !exists {
+		um.users[user.ID] = &user
+	}
+	session := &Session{
+		ID:       sessionID,
+		UserID:   user.ID,
+		RoomID:   roomID,
+		LastSeen: time.Now(),
+	}
+	um.sessions[sessionID] = session
 	if um.rooms[roomID] == nil {
-		um.rooms[roomID] = make(map[string]*User)
+		um.rooms[roomID] = make(map[string]*Session)
 	}
-	if user, exists := um.users[userID]; exists {
-		um.rooms[roomID][userID] = user
-		user.LastSeen = time.Now()
+	um.rooms[roomID][sessionID] = session
+	um.open[user.ID]++
+	return *session
+}
+
+// EndSession removes a connection. Its user is removed along with their
+// last session.
+func (um *UserManager) EndSession(sessionID string) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	um.removeSession(sessionID)
+}
+
+// removeSession removes a session, and its user if it was their last one.
+// um.mu must be held.
+func (um *UserManager) removeSession(sessionID string) {
+	session, exists := um.sessions[sessionID]
+	if !exists {
+		return
+	}
+	delete(um.sessions, sessionID)
+	if roomSessions := um.rooms[session.RoomID]; roomSessions != nil {
+		delete(roomSessions, sessionID)
+		if len(roomSessions) == 0 {
+			delete(um.rooms, session.RoomID)
+		}
+	}
+	if um.open[session.UserID]--; um.open[session.UserID] == 0 {
+		delete(um.open, session.UserID)
+		delete(um.users, session.UserID)
 	}
 }
 
-// RemoveUserFromRoom removes a user from a room
-func (um *UserManager) RemoveUserFromRoom(userID, roomID string) {
-	if roomUsers, exists := um.rooms[roomID]; exists {
-		delete(roomUsers, userID)
+// GetSession gets a session by ID
+func (um *UserManager) GetSession(sessionID string) (Session, bool) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	session, exists := um.sessions[sessionID]
+	if !exists {
+		return Session{}, false
 	}
+	return *session, true
 }
 
-// GetRoomUsers gets all users in a room
-func (um *UserManager) GetRoomUsers(roomID string) map[string]*User {
-	roomUsers := make(map[string]*User)
-	if users, exists := um.rooms[roomID]; exists {
-		for userID, user := range users {
-			// Create a copy to avoid race conditions
-			roomUsers[userID] = &User{
-				ID:        user.ID,
-				Username:  user.Username,
-				Color:     user.Color,
-				CursorPos: user.CursorPos,
-				LastSeen:  user.LastSeen,
-			}
-		}
+// SessionUser gets the user a session belongs to
+func (um *UserManager) SessionUser(sessionID string) (User, bool) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	session, exists := um.sessions[sessionID]
+	if !exists {
+		return User{}, false
 	}
-	return roomUsers
+	user, exists := um.users[session.UserID]
+	if !exists {
+		return User{}, false
+	}
+	return *user, true
 }
 
-// UpdateUserCursor updates a user's cursor position
-func (um *UserManager) UpdateUserCursor(userID string, position int) {
-	if user, exists := um.users[userID]; exists {
-		user.CursorPos = position
-		user.LastSeen = time.Now()
+// UpdateSelection updates the selection of a session
+func (um *UserManager) UpdateSelection(sessionID string, sel ot.Selection) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if session, exists := um.sessions[sessionID]; exists {
+		session.Selection = sel
+		session.LastSeen = time.Now()
 	}
 }
 
-// RemoveUser removes a user completely
-func (um *UserManager) RemoveUser(userID string) {
-	delete(um.users, userID)
-	for roomID := range um.rooms {
-		delete(um.rooms[roomID], userID)
+// GetRoomSessions gets the sessions in a room, ordered by ID
+func (um *UserManager) GetRoomSessions(roomID string) []Session {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	sessions := make([]Session, 0, len(um.rooms[roomID]))
+	for _, session := range um.rooms[roomID] {
+		sessions = append(sessions, *session)
 	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions
+}
+
+// GetRoomUsers gets the users with at least one session in a room
+func (um *UserManager) GetRoomUsers(roomID string) map[string]User {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	roomUsers := make(map[string]User)
+	for _, session := range um.rooms[roomID] {
+		if user, exists := um.users[session.UserID]; exists {
+			roomUsers[user.ID] = *user
+		}
+	}
+	return roomUsers
 }
 
 // GenerateUsername generates a random username
@@ -0,0 +1,92 @@
+package user
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"collaborative-markdown-editor/internal/ot"
+)
+
+func TestUsersOutliveTheirSessions(t *testing.T) {
+	um := NewUserManager()
+	alice := um.CreateUser("alice", "Alice")
+
+	// Two tabs of the same browser
+	um.StartSession("tab1", "notes", alice)
+	um.StartSession("tab2", "notes", alice)
+	um.UpdateSelection("tab2", ot.Selection{Anchor: 1, Head: 3})
+	if users := um.GetRoomUsers("notes"); len(users) != 1 || users["alice"] != alice {
+		t.Fatalf("room users = %+v, want alice once", users)
+	}
+	if sessions := um.GetRoomSessions("notes"); len(sessions) != 2 || sessions[1].Selection.Head != 3 {
+		t.Fatalf("room sessions = %+v", sessions)
+	}
+
+	// Closing one tab keeps the user
+	um.EndSession("tab1")
+	if u, ok := um.SessionUser("tab2"); !ok || u != alice {
+		t.Fatalf("user of tab2 = %+v, %v after closing tab1", u, ok)
+	}
+
+	// Closing the last one removes them
+	um.EndSession("tab2")
+	if _, ok := um.GetUser("alice"); ok {
+		t.Error("alice is still known after closing every tab")
+	}
+	if users := um.GetRoomUsers("notes"); len(users) != 0 {
+		t.Errorf("room users = %+v after everyone left", users)
+	}
+
+	// Coming back with the same identity adds them again
+	um.StartSession("tab3", "notes", alice)
+	if u, ok := um.GetUser("alice"); !ok || u != alice {
+		t.Errorf("alice = %+v, %v after coming back", u, ok)
+	}
+}
+
+func TestRestartingASessionKeepsItsUser(t *testing.T) {
+	um := NewUserManager()
+	alice := um.CreateUser("alice", "Alice")
+
+	// A client reconnecting before its old connection is gone starts the
+	// same session again
+	um.StartSession("c1", "notes", alice)
+	um.StartSession("c1", "notes", alice)
+	if u, ok := um.SessionUser("c1"); !ok || u != alice {
+		t.Fatalf("user of c1 = %+v, %v after starting it again", u, ok)
+	}
+	if users := um.GetRoomUsers("notes"); len(users) != 1 {
+		t.Fatalf("room users = %+v, want alice", users)
+	}
+
+	// It still counts once
+	um.EndSession("c1")
+	if _, ok := um.GetUser("alice"); ok {
+		t.Error("alice is still known after ending their only session")
+	}
+}
+
+func TestUserManagerIsSafeForConcurrentUse(t *testing.T) {
+	um := NewUserManager()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u := um.LoadOrCreateUser("shared", GenerateUsername())
+			for j := 0; j < 100; j++ {
+				session := fmt.Sprintf("s%d-%d", i, j)
+				um.StartSession(session, "notes", u)
+				um.UpdateSelection(session, ot.Selection{Head: j})
+				um.GetRoomUsers("notes")
+				um.GetRoomSessions("notes")
+				um.EndSession(session)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if users := um.GetRoomUsers("notes"); len(users) != 0 {
+		t.Errorf("room users = %+v after every session ended", users)
+	}
+}